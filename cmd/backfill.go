@@ -0,0 +1,138 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the command to regenerate ephemerals over a time range
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/notifications"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/primitives/ndf"
+	"gitlab.com/xx_network/primitives/utils"
+	"time"
+)
+
+var (
+	backfillFrom  string
+	backfillTo    string
+	backfillNdf   string
+	backfillSizes []uint
+)
+
+func init() {
+	rootCmd.AddCommand(backfillEphemeralsCmd)
+	backfillEphemeralsCmd.Flags().StringVarP(&cfgFile, "config", "c",
+		"", "Sets a custom config file path")
+	backfillEphemeralsCmd.Flags().StringVar(&backfillFrom, "from", "",
+		"Start of the range to backfill, in RFC 3339 format; at most 24h ago")
+	backfillEphemeralsCmd.Flags().StringVar(&backfillTo, "to", "",
+		"End of the range to backfill, in RFC 3339 format; defaults to now")
+	backfillEphemeralsCmd.Flags().StringVar(&backfillNdf, "ndf", "",
+		"Path to a downloaded NDF whose address space history is used instead of the stored one")
+	backfillEphemeralsCmd.Flags().UintSliceVar(&backfillSizes, "addressSpaceSizes",
+		nil, "Address space sizes to generate every ephemeral ID for, overriding the NDF history")
+}
+
+var backfillEphemeralsCmd = &cobra.Command{
+	Use:   "backfill-ephemerals",
+	Short: "Generates ephemerals for all identities over a time range",
+	Long: `Generates the ephemerals of every registered identity for every
+ephemeral ID valid at any time between --from and --to, to fill gaps left by
+an outage or clock jump. Ephemerals which already exist are left as they are,
+so it is safe to run repeatedly or over overlapping ranges. --from may be at
+most one ephemeral period (24h) ago: ephemerals valid only before then have
+expired, and the server deletes them.
+
+Each ephemeral ID is generated for the address space sizes in effect while it
+is valid, taken from the address space history of the NDF at --ndf or, by
+default, of the latest NDF the server received. --addressSpaceSizes overrides
+the history with a fixed list of sizes.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		initLog()
+
+		from, err := time.Parse(time.RFC3339, backfillFrom)
+		if err != nil {
+			jww.FATAL.Panicf("Invalid --from time %q: %+v", backfillFrom, err)
+		}
+		to := time.Now()
+		if backfillTo != "" {
+			to, err = time.Parse(time.RFC3339, backfillTo)
+			if err != nil {
+				jww.FATAL.Panicf("Invalid --to time %q: %+v", backfillTo, err)
+			}
+		}
+		s, err := initStorage()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				jww.WARN.Printf("Failed to close storage: %+v", err)
+			}
+		}()
+
+		sizes, err := backfillSizesFunc(s)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to get address space sizes: %+v", err)
+		}
+
+		jww.INFO.Printf("Backfilling ephemerals from %s to %s", from, to)
+		offsets, err := s.BackfillEphemerals(from, to, sizes)
+		if err != nil {
+			jww.FATAL.Panicf("Ephemeral backfill incomplete after %d offsets: %+v", offsets, err)
+		}
+		jww.INFO.Printf("Ephemeral backfill complete: generated %d offsets", offsets)
+	},
+}
+
+// backfillSizesFunc returns the function giving the address space sizes to
+// backfill each offset with: the sizes passed with --addressSpaceSizes if set,
+// otherwise those in effect according to the address space history of the NDF
+// passed with --ndf, or else of the NDF stored by the server.
+func backfillSizesFunc(s *storage.Storage) (func(time.Time) []uint8, error) {
+	if len(backfillSizes) > 0 {
+		sizes := make([]uint8, len(backfillSizes))
+		for i, size := range backfillSizes {
+			if size == 0 || size > 64 {
+				return nil, errors.Errorf("Invalid address space size %d", size)
+			}
+			sizes[i] = uint8(size)
+		}
+		jww.INFO.Printf("Using address space sizes %v for every offset", sizes)
+		return func(time.Time) []uint8 { return sizes }, nil
+	}
+
+	var spaces []ndf.AddressSpace
+	if backfillNdf != "" {
+		data, err := utils.ReadFile(backfillNdf)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to read NDF %s", backfillNdf)
+		}
+		def, err := ndf.Unmarshal(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode NDF %s", backfillNdf)
+		}
+		spaces = def.AddressSpace
+	} else {
+		var err error
+		spaces, err = notifications.StoredAddressSpaces(s)
+		if err != nil {
+			return nil, errors.WithMessage(err, "No NDF has been stored; pass --ndf or --addressSpaceSizes")
+		}
+	}
+	if len(spaces) == 0 {
+		return nil, errors.New("The NDF has no address space history; pass --addressSpaceSizes")
+	}
+	jww.INFO.Printf("Using the address space history %v", spaces)
+	return notifications.EphemeralSizesFunc(spaces), nil
+}
@@ -0,0 +1,59 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the command to encrypt existing database rows
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+var migrationBatchSize int
+
+func init() {
+	rootCmd.AddCommand(migrateEncryptionCmd)
+	migrateEncryptionCmd.Flags().StringVarP(&cfgFile, "config", "c",
+		"", "Sets a custom config file path")
+	migrateEncryptionCmd.Flags().IntVar(&migrationBatchSize, "batchSize", 500,
+		"Number of rows to read per query")
+}
+
+var migrateEncryptionCmd = &cobra.Command{
+	Use:   "migrate-encryption",
+	Short: "Encrypts stored tokens and transmission keys with the active key",
+	Long: `Encrypts any tokens and transmission keys stored in plaintext, and
+re-encrypts any stored under a key other than the active key in the
+configured encryption key file. It is safe to run repeatedly.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		initLog()
+
+		if viper.GetString("encryptionKeyFile") == "" {
+			jww.FATAL.Panicf("encryptionKeyFile must be set to migrate encryption")
+		}
+		s, err := initStorage()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
+		}
+		defer func() {
+			if err := s.Close(); err != nil {
+				jww.WARN.Printf("Failed to close storage: %+v", err)
+			}
+		}()
+
+		stats, err := s.MigrateEncryption(migrationBatchSize)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to migrate encryption: %+v", err)
+		}
+		jww.INFO.Printf("Encryption migration complete: encrypted %d tokens and %d transmission RSAs",
+			stats.Tokens, stats.TransmissionRSAs)
+	},
+}
@@ -11,15 +11,18 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/viper"
 	"gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/notifications-bot/notifications"
 	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
 	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/rateLimiting"
 	"gitlab.com/xx_network/primitives/utils"
 	"net"
 	"os"
@@ -93,6 +96,31 @@ var rootCmd = &cobra.Command{
 		viper.SetDefault("notificationsPerBatch", 20)
 		// This is set to approx. 90% of the stated limit (4096)
 		viper.SetDefault("maxNotificationPayload", 3686)
+		viper.SetDefault("requestTimestampTolerance", 5*time.Second)
+		viper.SetDefault("verificationCacheSize", 10000)
+		viper.SetDefault("requestRateLimitCapacity", 100)
+		viper.SetDefault("requestRateLimitLeakedTokens", 20)
+		viper.SetDefault("requestRateLimitLeakDuration", time.Second)
+		viper.SetDefault("clientRateLimitCapacity", 10)
+		viper.SetDefault("clientRateLimitLeakedTokens", 1)
+		viper.SetDefault("clientRateLimitLeakDuration", 6*time.Second)
+		viper.SetDefault("gatewayRateLimitCapacity", 100)
+		viper.SetDefault("gatewayRateLimitLeakedTokens", 20)
+		viper.SetDefault("gatewayRateLimitLeakDuration", time.Second)
+		viper.SetDefault("rateLimitPollDuration", time.Minute)
+		viper.SetDefault("rateLimitBucketMaxAge", 10*time.Minute)
+		viper.SetDefault("coverTrafficDistribution", notifications.CoverExponential)
+		viper.SetDefault("overflowMaxPerEphemeral", 500)
+		viper.SetDefault("bufferMaxEntries", 1000000)
+		viper.SetDefault("bufferMaxBytes", 256*1024*1024)
+		viper.SetDefault("bufferMaxAge", 10*time.Minute)
+		viper.SetDefault("dedupWindow", 10*time.Minute)
+		viper.SetDefault("overflowMaxAge", time.Hour)
+		viper.SetDefault("overflowMaxEntries", 1000000)
+		viper.SetDefault("overflowMaxBytes", 256*1024*1024)
+		viper.SetDefault("ephemeralLookAhead", 5*time.Minute)
+		viper.SetDefault("tokenCacheSize", 100000)
+		viper.SetDefault("tokenCacheMaxAge", 5*time.Minute)
 		// Populate params
 		NotificationParams = notifications.Params{
 			Address:                localAddress,
@@ -116,30 +144,66 @@ var rootCmd = &cobra.Command{
 				BundleID: viper.GetString("havenApnsBundleID"),
 				Dev:      viper.GetBool("havenApnsDev"),
 			},
-			HavenFBCreds:  havenFbCreds,
-			HttpsCertPath: httpsCertPath,
-			HttpsKeyPath:  httpsKeyPath,
+			HavenFBCreds:          havenFbCreds,
+			HttpsCertPath:         httpsCertPath,
+			HttpsKeyPath:          httpsKeyPath,
+			RequestTolerance:      viper.GetDuration("requestTimestampTolerance"),
+			VerificationCacheSize: viper.GetInt("verificationCacheSize"),
+			DedupWindow:           viper.GetDuration("dedupWindow"),
+			EphemeralLookAhead:    viper.GetDuration("ephemeralLookAhead"),
+			Overflow: notifications.OverflowParams{
+				MaxPerEphemeral: viper.GetInt("overflowMaxPerEphemeral"),
+				MaxAge:          viper.GetDuration("overflowMaxAge"),
+				MaxEntries:      viper.GetInt("overflowMaxEntries"),
+				MaxBytes:        viper.GetInt("overflowMaxBytes"),
+			},
+			Padding: notifications.PaddingParams{
+				Apps:        viper.GetStringSlice("paddedApps"),
+				BucketSizes: viper.GetIntSlice("paddingBucketSizes"),
+			},
+			CoverTraffic: notifications.CoverTrafficParams{
+				MeanInterval:   viper.GetDuration("coverTrafficMeanInterval"),
+				Distribution:   viper.GetString("coverTrafficDistribution"),
+				TokensPerRound: viper.GetInt("coverTrafficTokensPerRound"),
+				MaxLines:       viper.GetInt("coverTrafficMaxLines"),
+			},
+			RateLimits: notifications.RateLimitParams{
+				Request: rateLimiting.MapParams{
+					Capacity:     viper.GetUint32("requestRateLimitCapacity"),
+					LeakedTokens: viper.GetUint32("requestRateLimitLeakedTokens"),
+					LeakDuration: viper.GetDuration("requestRateLimitLeakDuration"),
+					PollDuration: viper.GetDuration("rateLimitPollDuration"),
+					BucketMaxAge: viper.GetDuration("rateLimitBucketMaxAge"),
+				},
+				Client: rateLimiting.MapParams{
+					Capacity:     viper.GetUint32("clientRateLimitCapacity"),
+					LeakedTokens: viper.GetUint32("clientRateLimitLeakedTokens"),
+					LeakDuration: viper.GetDuration("clientRateLimitLeakDuration"),
+					PollDuration: viper.GetDuration("rateLimitPollDuration"),
+					BucketMaxAge: viper.GetDuration("rateLimitBucketMaxAge"),
+				},
+				Gateway: rateLimiting.MapParams{
+					Capacity:     viper.GetUint32("gatewayRateLimitCapacity"),
+					LeakedTokens: viper.GetUint32("gatewayRateLimitLeakedTokens"),
+					LeakDuration: viper.GetDuration("gatewayRateLimitLeakDuration"),
+					PollDuration: viper.GetDuration("rateLimitPollDuration"),
+					BucketMaxAge: viper.GetDuration("rateLimitBucketMaxAge"),
+				},
+			},
 		}
 
-		rawAddr := viper.GetString("dbAddress")
-		var addr, port string
-		if rawAddr != "" {
-			addr, port, err = net.SplitHostPort(rawAddr)
-			if err != nil {
-				jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
-			}
-		}
 		// Initialize the storage backend
-		s, err := storage.NewStorage(
-			viper.GetString("dbUsername"),
-			viper.GetString("dbPassword"),
-			viper.GetString("dbName"),
-			addr,
-			port,
-		)
+		s, err := initStorage()
 		if err != nil {
 			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
 		}
+		s.SetBufferLimits(storage.BufferLimits{
+			MaxEntries: viper.GetInt("bufferMaxEntries"),
+			MaxBytes:   viper.GetInt("bufferMaxBytes"),
+			MaxAge:     viper.GetDuration("bufferMaxAge"),
+		})
+		s.EnableTokenCache(viper.GetInt("tokenCacheSize"), viper.GetDuration("tokenCacheMaxAge"))
+		s.SetEphemeralLookAhead(viper.GetDuration("ephemeralLookAhead"))
 
 		// Start notifications server
 		jww.INFO.Println("Starting Notifications...")
@@ -172,6 +236,7 @@ var rootCmd = &cobra.Command{
 		}
 		go impl.EphIdCreator()
 		go impl.EphIdDeleter()
+		go impl.CoverSender(NotificationParams.CoverTraffic)
 
 		// Wait forever to prevent process from ending
 		err = <-errChan
@@ -217,6 +282,94 @@ func init() {
 	handleBindingError(err, "verbose")
 }
 
+// initStorage connects to the database using the config file options and
+// enables encryption at rest if an encryption key file is configured.
+func initStorage() (*storage.Storage, error) {
+	rawAddr := viper.GetString("dbAddress")
+	var addr, port string
+	var err error
+	if rawAddr != "" {
+		addr, port, err = net.SplitHostPort(rawAddr)
+		if err != nil {
+			return nil, errors.Errorf("Unable to get database port from %s: %+v", rawAddr, err)
+		}
+	}
+	// Without a database address, a SQLite database is kept at dbPath
+	sqlitePath := viper.GetString("dbPath")
+	if sqlitePath != "" && sqlitePath != storage.SQLiteInMemory {
+		sqlitePath, err = utils.ExpandPath(sqlitePath)
+		if err != nil {
+			return nil, errors.Errorf("Unable to expand database path: %+v", err)
+		}
+	}
+	// Paths of the postgres TLS certificates and key
+	var sslPaths [3]string
+	for i, key := range []string{"dbSSLRootCert", "dbSSLCert", "dbSSLKey"} {
+		if p := viper.GetString(key); p != "" {
+			sslPaths[i], err = utils.ExpandPath(p)
+			if err != nil {
+				return nil, errors.Errorf("Unable to expand %s path: %+v", key, err)
+			}
+		}
+	}
+	s, err := storage.NewStorageWithParams(storage.DatabaseParams{
+		Username:                 viper.GetString("dbUsername"),
+		Password:                 viper.GetString("dbPassword"),
+		Name:                     viper.GetString("dbName"),
+		Address:                  addr,
+		Port:                     port,
+		PostgresDSN:              viper.GetString("dbDSN"),
+		SSLMode:                  viper.GetString("dbSSLMode"),
+		SSLRootCert:              sslPaths[0],
+		SSLCert:                  sslPaths[1],
+		SSLKey:                   sslPaths[2],
+		StatementTimeout:         viper.GetDuration("dbStatementTimeout"),
+		ApplicationName:          viper.GetString("dbApplicationName"),
+		MaxIdleConns:             viper.GetInt("dbMaxIdleConns"),
+		MaxOpenConns:             viper.GetInt("dbMaxOpenConns"),
+		ConnMaxIdleTime:          viper.GetDuration("dbConnMaxIdleTime"),
+		ConnMaxLifetime:          viper.GetDuration("dbConnMaxLifetime"),
+		SQLitePath:               sqlitePath,
+		SQLiteBusyTimeout:        viper.GetDuration("dbBusyTimeout"),
+		SQLiteCheckpointInterval: viper.GetDuration("dbCheckpointInterval"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Ephemerals, received rounds & buffered notifications may be held in redis
+	if redisAddress := viper.GetString("redisAddress"); redisAddress != "" {
+		viper.SetDefault("redisKeyPrefix", "notifications:")
+		hot, err := storage.NewRedisHotStore(storage.RedisParams{
+			Address:   redisAddress,
+			Username:  viper.GetString("redisUsername"),
+			Password:  viper.GetString("redisPassword"),
+			DB:        viper.GetInt("redisDB"),
+			KeyPrefix: viper.GetString("redisKeyPrefix"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.SetHotStore(hot)
+	}
+
+	keyFilePath := viper.GetString("encryptionKeyFile")
+	if keyFilePath == "" {
+		jww.WARN.Printf("No encryption key file configured, tokens and transmission keys will be stored in plaintext")
+		return s, nil
+	}
+	keyFilePath, err = utils.ExpandPath(keyFilePath)
+	if err != nil {
+		return nil, errors.Errorf("Unable to expand encryption key file path: %+v", err)
+	}
+	fe, err := storage.LoadKeyFile(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	s.EnableEncryption(fe)
+	return s, nil
+}
+
 // Handle flag binding errors
 func handleBindingError(err error, flag string) {
 	if err != nil {
@@ -294,4 +447,15 @@ func initLog() {
 	} else {
 		jww.SetLogOutput(logFile)
 	}
+
+	// Replace user identifiers in logs with salted digests
+	if viper.GetBool("logPrivacyMode") {
+		err = privacy.Enable([]byte(viper.GetString("logPrivacySalt")))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to enable log privacy mode: %+v", err)
+		}
+		jww.INFO.Printf("Log privacy mode enabled")
+	} else {
+		privacy.Disable()
+	}
 }
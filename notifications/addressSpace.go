@@ -0,0 +1,170 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Tracks the address space sizes ephemeral IDs are generated with
+
+package notifications
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gitlab.com/xx_network/primitives/ndf"
+	"sort"
+	"time"
+)
+
+// addressSpaceStateKey is the State key the address space history of the
+// latest NDF is stored under, so it is available without the NDF.
+const addressSpaceStateKey = "addressSpaces"
+
+// addressSpaceSizes returns every address space size in effect at any time
+// between start and end. Each entry in the NDF's address space history is in
+// effect from its timestamp until the timestamp of the next entry. If the
+// whole history starts after end, the earliest size is used.
+func addressSpaceSizes(spaces []ndf.AddressSpace, start, end time.Time) []uint8 {
+	sorted := make([]ndf.AddressSpace, len(spaces))
+	copy(sorted, spaces)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	var sizes []uint8
+	seen := make(map[uint8]bool)
+	for i, as := range sorted {
+		// Skip sizes replaced before the window starts
+		if i+1 < len(sorted) && !sorted[i+1].Timestamp.After(start) {
+			continue
+		}
+		// Stop at sizes which only take effect after the window ends
+		if i > 0 && as.Timestamp.After(end) {
+			break
+		}
+		if !seen[as.Size] {
+			seen[as.Size] = true
+			sizes = append(sizes, as.Size)
+		}
+	}
+	return sizes
+}
+
+// ephemeralSizes returns the address space sizes an ephemeral ID generated at
+// start must be tracked under, which are those in effect at any time while
+// the ID is valid.
+func ephemeralSizes(spaces []ndf.AddressSpace, start time.Time) []uint8 {
+	return addressSpaceSizes(spaces, start, start.Add(time.Duration(ephemeral.Period)))
+}
+
+// EphemeralSizesFunc returns a function which gives the address space sizes an
+// ephemeral ID generated at the passed in time must be tracked under, according
+// to the passed in address space history.
+func EphemeralSizesFunc(spaces []ndf.AddressSpace) func(time.Time) []uint8 {
+	return func(start time.Time) []uint8 {
+		return ephemeralSizes(spaces, start)
+	}
+}
+
+// StoredAddressSpaces returns the address space history of the latest NDF
+// received by the server, as recorded in storage.
+func StoredAddressSpaces(s *storage.Storage) ([]ndf.AddressSpace, error) {
+	value, err := s.GetStateValue(addressSpaceStateKey)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get stored address space history")
+	}
+	var spaces []ndf.AddressSpace
+	if err = json.Unmarshal([]byte(value), &spaces); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode stored address space history")
+	}
+	return spaces, nil
+}
+
+// storeAddressSpaces records the passed in address space history in storage.
+func (nb *Impl) storeAddressSpaces(spaces []ndf.AddressSpace) error {
+	value, err := json.Marshal(spaces)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode address space history")
+	}
+	return nb.Storage.UpsertState(&storage.State{Key: addressSpaceStateKey, Value: string(value)})
+}
+
+// currentAddressSpaces returns the address space history of the current NDF.
+func (nb *Impl) currentAddressSpaces() []ndf.AddressSpace {
+	return nb.inst.GetPartialNdf().Get().AddressSpace
+}
+
+// sameAddressSpaces returns true if both address space histories hold the same
+// sizes and timestamps in the same order.
+func sameAddressSpaces(a, b []ndf.AddressSpace) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size != b[i].Size || !a[i].Timestamp.Equal(b[i].Timestamp) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateAddressSpaces records the address space history of a new NDF. If it
+// puts a new size in effect while currently tracked ephemeral IDs are valid,
+// ephemerals for that size are generated in the background. A changed history
+// is recorded in storage. An unchanged history is ignored, as it is on most
+// NDF polls.
+func (nb *Impl) updateAddressSpaces(spaces []ndf.AddressSpace) {
+	nb.addressSpaceMux.Lock()
+	old := nb.addressSpaces
+	if old != nil && sameAddressSpaces(old, spaces) {
+		nb.addressSpaceMux.Unlock()
+		return
+	}
+	nb.addressSpaces = spaces
+	nb.addressSpaceMux.Unlock()
+
+	if nb.Storage != nil {
+		if err := nb.storeAddressSpaces(spaces); err != nil {
+			jww.WARN.Printf("Failed to store address space history: %+v", err)
+		}
+	}
+
+	// Ephemerals for the first NDF are generated by EphIdCreator
+	if old == nil {
+		return
+	}
+	go nb.regenerateEphemerals(old, spaces, time.Now())
+}
+
+// regenerateEphemerals generates ephemerals for every offset still valid at
+// now, up to the look-ahead window, under any address space size which is in
+// effect for it in the new history but not the old.
+func (nb *Impl) regenerateEphemerals(old, updated []ndf.AddressSpace, now time.Time) {
+	end := now.Add(nb.lookAhead())
+	for t := now.Add(-time.Duration(ephemeral.Period)); t.Before(end); t = t.Add(time.Duration(offsetPhase)) {
+		oldSizes := make(map[uint8]bool)
+		for _, size := range ephemeralSizes(old, t) {
+			oldSizes[size] = true
+		}
+		var added []uint8
+		for _, size := range ephemeralSizes(updated, t) {
+			if !oldSizes[size] {
+				added = append(added, size)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+
+		offset, epoch := ephemeral.HandleQuantization(t)
+		jww.INFO.Printf("Generating ephemerals for offset %d with new address space sizes %v", offset, added)
+		err := nb.Storage.AddEphemeralsForOffset(offset, epoch, t, added...)
+		if err != nil {
+			jww.WARN.Printf("Failed to generate ephemerals for new address space sizes: %+v", err)
+		}
+	}
+}
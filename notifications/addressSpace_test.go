@@ -0,0 +1,140 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gitlab.com/xx_network/primitives/ndf"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddressSpaceSizes(t *testing.T) {
+	base := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	history := []ndf.AddressSpace{
+		{Size: 18, Timestamp: base.Add(48 * time.Hour)},
+		{Size: 16, Timestamp: base},
+		{Size: 17, Timestamp: base.Add(24 * time.Hour)},
+	}
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		expected   []uint8
+	}{
+		{"before history", base.Add(-10 * time.Hour), base.Add(-5 * time.Hour), []uint8{16}},
+		{"single size", base.Add(time.Hour), base.Add(2 * time.Hour), []uint8{16}},
+		{"spans change", base.Add(20 * time.Hour), base.Add(30 * time.Hour), []uint8{16, 17}},
+		{"starts at change", base.Add(24 * time.Hour), base.Add(30 * time.Hour), []uint8{17}},
+		{"spans all", base, base.Add(72 * time.Hour), []uint8{16, 17, 18}},
+		{"after history", base.Add(100 * time.Hour), base.Add(110 * time.Hour), []uint8{18}},
+	}
+	for _, tt := range tests {
+		sizes := addressSpaceSizes(history, tt.start, tt.end)
+		if !reflect.DeepEqual(sizes, tt.expected) {
+			t.Errorf("%s: expected sizes %v, got %v", tt.name, tt.expected, sizes)
+		}
+	}
+
+	if sizes := addressSpaceSizes(nil, base, base); len(sizes) != 0 {
+		t.Errorf("Expected no sizes for empty history, got %v", sizes)
+	}
+}
+
+// Tests that a new address space size in an NDF update generates ephemerals
+// for identities which are already tracked.
+func TestImpl_regenerateEphemerals(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_regenerateEphemerals", "", "")
+	if err != nil {
+		t.Fatalf("Failed to init storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+
+	now := time.Now()
+	uid := id.NewIdFromString("regenerate_zezima", id.User, t)
+	iid, err := ephemeral.GetIntermediaryId(uid)
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ephemeral id: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(now)
+	_, err = s.RegisterForNotifications(iid, []byte("trsa"), "token", constants.MessengerIOS.String(), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register identity: %+v", err)
+	}
+
+	old := []ndf.AddressSpace{{Size: 16, Timestamp: now.Add(-72 * time.Hour)}}
+	updated := append(old, ndf.AddressSpace{Size: 17, Timestamp: now.Add(time.Hour)})
+
+	eid17, _, _, err := ephemeral.GetIdFromIntermediary(iid, 17, now.UnixNano())
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral ID: %+v", err)
+	}
+	if _, err = s.GetEphemeral(eid17.Int64()); err == nil {
+		t.Fatal("Ephemeral for new size should not exist yet")
+	}
+
+	impl.regenerateEphemerals(old, old, now)
+	if _, err = s.GetEphemeral(eid17.Int64()); err == nil {
+		t.Fatal("Unchanged address space should not generate ephemerals")
+	}
+
+	impl.regenerateEphemerals(old, updated, now)
+	if _, err = s.GetEphemeral(eid17.Int64()); err != nil {
+		t.Errorf("Ephemeral for new size was not generated: %+v", err)
+	}
+}
+
+// Tests that an NDF with an unchanged address space history is ignored, and
+// that a change to any size or timestamp is detected.
+func TestImpl_updateAddressSpaces_Unchanged(t *testing.T) {
+	base := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := []ndf.AddressSpace{{Size: 16, Timestamp: base}, {Size: 17, Timestamp: base.Add(24 * time.Hour)}}
+	impl := &Impl{addressSpaces: old}
+
+	polled := []ndf.AddressSpace{{Size: 16, Timestamp: base.Local()}, {Size: 17, Timestamp: base.Add(24 * time.Hour).Local()}}
+	impl.updateAddressSpaces(polled)
+	if &impl.addressSpaces[0] != &old[0] {
+		t.Error("Unchanged address space history should not replace the recorded one")
+	}
+
+	changed := [][]ndf.AddressSpace{
+		{{Size: 16, Timestamp: base}},
+		{{Size: 16, Timestamp: base}, {Size: 18, Timestamp: base.Add(24 * time.Hour)}},
+		{{Size: 16, Timestamp: base}, {Size: 17, Timestamp: base.Add(25 * time.Hour)}},
+	}
+	for i, spaces := range changed {
+		if sameAddressSpaces(old, spaces) {
+			t.Errorf("History %d should differ from %v: %v", i, old, spaces)
+		}
+	}
+}
+
+// Tests that a new address space history is stored, so it can be read back
+// without the NDF.
+func TestImpl_updateAddressSpaces_Stored(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_updateAddressSpaces_Stored", "", "")
+	if err != nil {
+		t.Fatalf("Failed to init storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	if _, err = StoredAddressSpaces(s); err == nil {
+		t.Fatal("Expected an error before any history is stored")
+	}
+
+	base := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	spaces := []ndf.AddressSpace{{Size: 16, Timestamp: base}, {Size: 17, Timestamp: base.Add(24 * time.Hour)}}
+	impl.updateAddressSpaces(spaces)
+	stored, err := StoredAddressSpaces(s)
+	if err != nil {
+		t.Fatalf("Failed to get stored address spaces: %+v", err)
+	}
+	if !sameAddressSpaces(stored, spaces) {
+		t.Errorf("Expected stored history %v, got %v", spaces, stored)
+	}
+	sizes := EphemeralSizesFunc(stored)(base.Add(12 * time.Hour))
+	if !reflect.DeepEqual(sizes, []uint8{16, 17}) {
+		t.Errorf("Unexpected sizes from stored history: %v", sizes)
+	}
+}
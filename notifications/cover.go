@@ -0,0 +1,172 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/primitives/format"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/crypto/csprng"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Lengths of the fields in a real notification, which decoys copy.
+const (
+	decoyMessageHashLen = 32
+	decoyIdentityFPLen  = format.SIHLen
+)
+
+// Distributions for the time between cover traffic rounds.
+const (
+	// CoverExponential draws intervals from an exponential distribution, so
+	// rounds form a Poisson process with the configured mean interval
+	CoverExponential = "exponential"
+	// CoverUniform draws intervals uniformly between zero and twice the mean
+	CoverUniform = "uniform"
+	// CoverFixed uses the mean interval for every round
+	CoverFixed = "fixed"
+)
+
+// CoverTrafficParams configures decoy notifications sent to registered tokens
+// to hide when real notifications are sent. Cover traffic is disabled if
+// MeanInterval or TokensPerRound is zero.
+type CoverTrafficParams struct {
+	// Mean time between rounds of decoy notifications
+	MeanInterval time.Duration
+	// Distribution of the time between rounds; one of CoverExponential,
+	// CoverUniform or CoverFixed
+	Distribution string
+	// Number of randomly chosen tokens sent a decoy each round
+	TokensPerRound int
+	// Maximum number of lines in a decoy CSV. Each decoy has between one and
+	// MaxLines lines, chosen uniformly. Defaults to the notifications per batch.
+	MaxLines int
+}
+
+// coverSender sends decoy notifications according to CoverTrafficParams.
+type coverSender struct {
+	params CoverTrafficParams
+	rng    *rand.Rand
+}
+
+// newCoverSender validates the passed in params and returns a coverSender,
+// or nil if cover traffic is disabled.
+func newCoverSender(params CoverTrafficParams, maxNotifications int) (*coverSender, error) {
+	if params.MeanInterval <= 0 || params.TokensPerRound <= 0 {
+		return nil, nil
+	}
+	switch strings.ToLower(params.Distribution) {
+	case "":
+		params.Distribution = CoverExponential
+	case CoverExponential, CoverUniform, CoverFixed:
+		params.Distribution = strings.ToLower(params.Distribution)
+	default:
+		return nil, errors.Errorf("Unknown cover traffic distribution %q", params.Distribution)
+	}
+	if params.MaxLines <= 0 {
+		params.MaxLines = maxNotifications
+	}
+	if params.MaxLines <= 0 {
+		params.MaxLines = 1
+	}
+
+	seed := make([]byte, 8)
+	if _, err := csprng.NewSystemRNG().Read(seed); err != nil {
+		return nil, errors.WithMessage(err, "Failed to seed cover traffic")
+	}
+	return &coverSender{
+		params: params,
+		rng:    rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed)))),
+	}, nil
+}
+
+// nextInterval returns the time to wait before the next round.
+func (cs *coverSender) nextInterval() time.Duration {
+	mean := float64(cs.params.MeanInterval)
+	switch cs.params.Distribution {
+	case CoverUniform:
+		return time.Duration(cs.rng.Float64() * 2 * mean)
+	case CoverFixed:
+		return cs.params.MeanInterval
+	default:
+		// Cap the tail so a single draw cannot stall cover traffic
+		return time.Duration(math.Min(cs.rng.ExpFloat64(), 10) * mean)
+	}
+}
+
+// decoyCSV builds a notification CSV of random lines in the same format as
+// BuildNotificationCSV, fitting within maxSize bytes.
+func (cs *coverSender) decoyCSV(maxSize int) (string, error) {
+	numLines := 1 + cs.rng.Intn(cs.params.MaxLines)
+	data := make([]*notifications.Data, numLines)
+	rng := csprng.NewSystemRNG()
+	for i := range data {
+		d := &notifications.Data{
+			MessageHash: make([]byte, decoyMessageHashLen),
+			IdentityFP:  make([]byte, decoyIdentityFPLen),
+		}
+		if _, err := rng.Read(d.MessageHash); err != nil {
+			return "", errors.WithMessage(err, "Failed to generate decoy message hash")
+		}
+		if _, err := rng.Read(d.IdentityFP); err != nil {
+			return "", errors.WithMessage(err, "Failed to generate decoy identity fingerprint")
+		}
+		data[i] = d
+	}
+	csv, _ := notifications.BuildNotificationCSV(data, maxSize)
+	return string(csv), nil
+}
+
+// CoverSender is a long-running thread which sends decoy notifications to
+// randomly chosen registered tokens, at intervals drawn from the configured
+// distribution. Decoys are sent through the same providers as real
+// notifications and are indistinguishable from them in format. It must be
+// started after Storage is set.
+func (nb *Impl) CoverSender(params CoverTrafficParams) {
+	cs, err := newCoverSender(params, nb.maxNotifications)
+	if err != nil {
+		jww.ERROR.Printf("Failed to start cover traffic: %+v", err)
+		return
+	}
+	if cs == nil {
+		jww.INFO.Println("Cover traffic disabled")
+		return
+	}
+	jww.INFO.Printf("Sending cover traffic to %d tokens every %s (%s)",
+		cs.params.TokensPerRound, cs.params.MeanInterval, cs.params.Distribution)
+
+	for {
+		time.Sleep(cs.nextInterval())
+		err = nb.sendCover(cs)
+		if err != nil {
+			jww.ERROR.Printf("Failed to send cover traffic: %+v", err)
+		}
+	}
+}
+
+// sendCover sends one round of decoy notifications.
+func (nb *Impl) sendCover(cs *coverSender) error {
+	targets, err := nb.Storage.GetRandomTokens(cs.params.TokensPerRound)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to get tokens for cover traffic")
+	}
+	for _, target := range targets {
+		csv, err := cs.decoyCSV(nb.maxPayloadBytes - len([]byte(notificationsTag)))
+		if err != nil {
+			return err
+		}
+		go nb.notify(csv, target)
+	}
+	jww.DEBUG.Printf("Sent %d decoy notifications", len(targets))
+	return nil
+}
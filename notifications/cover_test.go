@@ -0,0 +1,142 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Tests that decoy CSVs decode like real CSVs and respect the size limits.
+func TestCoverSender_decoyCSV(t *testing.T) {
+	cs, err := newCoverSender(CoverTrafficParams{
+		MeanInterval:   time.Minute,
+		TokensPerRound: 1,
+		MaxLines:       5,
+	}, 20)
+	if err != nil {
+		t.Fatalf("Failed to create cover sender: %+v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		csv, err := cs.decoyCSV(4096)
+		if err != nil {
+			t.Fatalf("Failed to build decoy CSV: %+v", err)
+		}
+		data, err := notifications.DecodeNotificationsCSV(csv)
+		if err != nil {
+			t.Fatalf("Failed to decode decoy CSV: %+v", err)
+		}
+		if len(data) < 1 || len(data) > 5 {
+			t.Errorf("Decoy CSV has %d lines, expected between 1 and 5", len(data))
+		}
+		for _, d := range data {
+			if len(d.MessageHash) != decoyMessageHashLen || len(d.IdentityFP) != decoyIdentityFPLen {
+				t.Errorf("Decoy line has unexpected lengths: %+v", d)
+			}
+		}
+	}
+
+	csv, err := cs.decoyCSV(100)
+	if err != nil {
+		t.Fatalf("Failed to build decoy CSV: %+v", err)
+	}
+	if len(csv) > 100 {
+		t.Errorf("Decoy CSV of %d bytes exceeds max size", len(csv))
+	}
+}
+
+// Tests the interval distributions and param validation.
+func TestNewCoverSender(t *testing.T) {
+	cs, err := newCoverSender(CoverTrafficParams{}, 20)
+	if err != nil || cs != nil {
+		t.Errorf("Cover traffic should be disabled with zero params, received %+v, %+v", cs, err)
+	}
+
+	_, err = newCoverSender(CoverTrafficParams{
+		MeanInterval:   time.Minute,
+		TokensPerRound: 1,
+		Distribution:   "gaussian",
+	}, 20)
+	if err == nil {
+		t.Error("Expected error for unknown distribution")
+	}
+
+	mean := time.Minute
+	for _, dist := range []string{CoverExponential, CoverUniform, CoverFixed, ""} {
+		cs, err = newCoverSender(CoverTrafficParams{
+			MeanInterval:   mean,
+			TokensPerRound: 1,
+			Distribution:   dist,
+		}, 20)
+		if err != nil {
+			t.Fatalf("Failed to create cover sender for %q: %+v", dist, err)
+		}
+		if cs.params.MaxLines != 20 {
+			t.Errorf("MaxLines should default to notifications per batch, received %d", cs.params.MaxLines)
+		}
+
+		const n = 2000
+		var total time.Duration
+		for i := 0; i < n; i++ {
+			interval := cs.nextInterval()
+			if interval < 0 {
+				t.Fatalf("Negative interval %s for %q", interval, dist)
+			}
+			total += interval
+		}
+		avg := total / n
+		if avg < mean*8/10 || avg > mean*12/10 {
+			t.Errorf("Average interval %s for %q too far from mean %s", avg, dist, mean)
+		}
+	}
+}
+
+// Tests that a round of cover traffic sends a decoy to each sampled token.
+func TestImpl_sendCover(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_sendCover", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	dchan := make(chan string, 10)
+	impl := &Impl{
+		Storage:          s,
+		providers:        map[string]providers.Provider{constants.MessengerAndroid.String(): &MockProvider{donech: dchan}},
+		maxNotifications: 20,
+		maxPayloadBytes:  4096,
+	}
+	for i := 0; i < 5; i++ {
+		err = s.RegisterToken("token"+strconv.Itoa(i), constants.MessengerAndroid.String(), []byte("trsa"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cs, err := newCoverSender(CoverTrafficParams{MeanInterval: time.Minute, TokensPerRound: 3}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = impl.sendCover(cs)
+	if err != nil {
+		t.Fatalf("Failed to send cover traffic: %+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case csv := <-dchan:
+			if _, err = notifications.DecodeNotificationsCSV(csv); err != nil {
+				t.Errorf("Failed to decode decoy: %+v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for decoy %d", i)
+		}
+	}
+	select {
+	case <-dchan:
+		t.Error("Received more decoys than tokens per round")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,109 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/primitives/notifications"
+	"sync"
+	"time"
+)
+
+// seenKey identifies a notification for deduplication.
+type seenKey struct {
+	ephemeralID int64
+	messageHash string
+}
+
+// seenSet removes notifications which have already been sent, or appear more
+// than once in a batch, so a device never receives the same entry twice. Sent
+// notifications are remembered for the configured window.
+type seenSet struct {
+	mux    sync.Mutex
+	window time.Duration
+	seen   map[seenKey]time.Time
+}
+
+// newSeenSet returns an empty seenSet which remembers sent notifications for
+// the passed in window. If the window is zero, only duplicates within a batch
+// are removed.
+func newSeenSet(window time.Duration) *seenSet {
+	return &seenSet{
+		window: window,
+		seen:   make(map[seenKey]time.Time),
+	}
+}
+
+// filter removes notifications from the batch which were sent within the
+// window, or which have the same ephemeral ID and message hash as an earlier
+// notification in the batch. Ephemeral IDs left with no notifications are
+// removed from the batch. Returns the number of notifications removed.
+func (ss *seenSet) filter(batch map[int64][]*notifications.Data, now time.Time) int {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	// Forget notifications sent before the window
+	for key, sent := range ss.seen {
+		if now.Sub(sent) > ss.window {
+			delete(ss.seen, key)
+		}
+	}
+
+	removed := 0
+	for ephemeralID, l := range batch {
+		inBatch := make(map[string]struct{}, len(l))
+		kept := l[:0]
+		for _, d := range l {
+			if IsMoreMessagesMarker(d) {
+				kept = append(kept, d)
+				continue
+			}
+			_, duplicate := inBatch[string(d.MessageHash)]
+			_, sent := ss.seen[seenKey{ephemeralID, string(d.MessageHash)}]
+			if duplicate || sent {
+				removed++
+				continue
+			}
+			inBatch[string(d.MessageHash)] = struct{}{}
+			kept = append(kept, d)
+		}
+		if len(kept) == 0 {
+			delete(batch, ephemeralID)
+		} else {
+			batch[ephemeralID] = kept
+		}
+	}
+	if removed > 0 {
+		jww.DEBUG.Printf("Removed %d duplicate notifications from batch", removed)
+	}
+	return removed
+}
+
+// markSent records every notification in the batch which is not in the
+// unsent list as sent at the passed in time.
+func (ss *seenSet) markSent(batch map[int64][]*notifications.Data,
+	unsent []*notifications.Data, now time.Time) {
+	if ss.window <= 0 {
+		return
+	}
+	notSent := make(map[*notifications.Data]struct{}, len(unsent))
+	for _, d := range unsent {
+		notSent[d] = struct{}{}
+	}
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	for ephemeralID, l := range batch {
+		for _, d := range l {
+			if _, ok := notSent[d]; ok || IsMoreMessagesMarker(d) {
+				continue
+			}
+			ss.seen[seenKey{ephemeralID, string(d.MessageHash)}] = now
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/primitives/notifications"
+	"testing"
+	"time"
+)
+
+// Tests that duplicates within a batch are removed, keeping the first.
+func TestSeenSet_filter_Batch(t *testing.T) {
+	ss := newSeenSet(0)
+	a1 := &notifications.Data{EphemeralID: 1, RoundID: 1, MessageHash: []byte("a")}
+	a2 := &notifications.Data{EphemeralID: 1, RoundID: 2, MessageHash: []byte("a")}
+	b := &notifications.Data{EphemeralID: 1, RoundID: 2, MessageHash: []byte("b")}
+	other := &notifications.Data{EphemeralID: 2, RoundID: 2, MessageHash: []byte("a")}
+	batch := map[int64][]*notifications.Data{1: {a1, a2, b}, 2: {other}}
+
+	if removed := ss.filter(batch, time.Now()); removed != 1 {
+		t.Errorf("Expected 1 duplicate removed, got %d", removed)
+	}
+	if len(batch[1]) != 2 || batch[1][0] != a1 || batch[1][1] != b {
+		t.Errorf("Unexpected notifications for ephemeral ID 1: %+v", batch[1])
+	}
+	if len(batch[2]) != 1 {
+		t.Errorf("Same message hash for another ephemeral ID should be kept")
+	}
+}
+
+// Tests that sent notifications are removed from later batches within the
+// window, and that unsent notifications are not.
+func TestSeenSet_markSent(t *testing.T) {
+	ss := newSeenSet(time.Minute)
+	now := time.Now()
+	sent := &notifications.Data{EphemeralID: 1, MessageHash: []byte("sent")}
+	unsent := &notifications.Data{EphemeralID: 1, MessageHash: []byte("unsent")}
+	marker := newMoreMessagesMarker(1)
+	batch := map[int64][]*notifications.Data{1: {marker, sent, unsent}}
+	ss.filter(batch, now)
+	ss.markSent(batch, []*notifications.Data{unsent}, now)
+
+	// The same message reported again by another gateway
+	again := &notifications.Data{EphemeralID: 1, RoundID: 5, MessageHash: []byte("sent")}
+	batch = map[int64][]*notifications.Data{1: {newMoreMessagesMarker(1), unsent, again}}
+	ss.filter(batch, now.Add(30*time.Second))
+	if len(batch[1]) != 2 || !IsMoreMessagesMarker(batch[1][0]) || batch[1][1] != unsent {
+		t.Errorf("Expected marker and unsent notification only: %+v", batch[1])
+	}
+
+	batch = map[int64][]*notifications.Data{1: {again}}
+	ss.filter(batch, now.Add(2*time.Minute))
+	if len(batch[1]) != 1 {
+		t.Errorf("Notification should be sent again after the window")
+	}
+
+	batch = map[int64][]*notifications.Data{2: {sent}}
+	ss.markSent(batch, nil, now)
+	ss.filter(batch, now)
+	if _, ok := batch[2]; ok {
+		t.Errorf("Ephemeral ID with no notifications left should be removed")
+	}
+}
@@ -10,6 +10,7 @@ package notifications
 import (
 	"fmt"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"strconv"
@@ -17,19 +18,18 @@ import (
 )
 
 const offsetPhase = ephemeral.Period / ephemeral.NumOffsets
-const creationLead = 5 * time.Minute
-const deletionDelay = -(time.Duration(ephemeral.Period) + creationLead)
+const defaultLookAhead = storage.DefaultEphemeralLookAhead
 const ephemeralStateKey = "lastEphemeralOffset"
 
 // EphIdCreator runs as a thread to track ephemeral IDs for users who registered to receive push notifications
 func (nb *Impl) EphIdCreator() {
 	nb.initCreator()
 	ticker := time.NewTicker(time.Duration(offsetPhase))
-	go nb.addEphemerals(time.Now().Add(creationLead))
+	go nb.addEphemerals(time.Now().Add(nb.lookAhead()))
 	//handle all future epochs
 	for true {
 		<-ticker.C
-		go nb.addEphemerals(time.Now().Add(creationLead))
+		go nb.addEphemerals(time.Now().Add(nb.lookAhead()))
 	}
 }
 
@@ -48,12 +48,15 @@ func (nb *Impl) initCreator() {
 		lastEpochTime = time.Unix(0, int64(lastEpochInt)*offsetPhase) // Epoch time of last ephemeral ID
 		// If the last epoch is further back than the ephemeral ID period, only go back one period for generation
 		if lastEpochTime.Before(time.Now().Add(-time.Duration(ephemeral.Period))) {
+			jww.WARN.Printf("Ephemerals were last generated for %s, more than one period ago; "+
+				"generating from %s, as ephemerals valid before then have expired",
+				lastEpochTime, time.Now().Add(-time.Duration(ephemeral.Period)))
 			lastEpochTime = time.Now().Add(-time.Duration(ephemeral.Period))
 		}
 	}
 	// Add all missed ephemeral IDs
-	// increment by offsetPhase up to 5 minutes from now making ephemerals
-	for endTime := time.Now().Add(creationLead); lastEpochTime.Before(endTime); lastEpochTime = lastEpochTime.Add(time.Duration(offsetPhase)) {
+	// increment by offsetPhase up to the look-ahead window from now making ephemerals
+	for endTime := time.Now().Add(nb.lookAhead()); lastEpochTime.Before(endTime); lastEpochTime = lastEpochTime.Add(time.Duration(offsetPhase)) {
 		nb.addEphemerals(lastEpochTime)
 	}
 	// handle the next epoch
@@ -69,9 +72,9 @@ func (nb *Impl) initCreator() {
 		jww.WARN.Printf("Found %d orphaned users in database", len(orphaned))
 	}
 	for _, i := range orphaned {
-		_, err := nb.Storage.AddLatestEphemeral(i, epoch, uint(nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)) // TODO: is this the correct epoch?  Should we do the previous one as well?
+		_, err := nb.Storage.AddLatestEphemeral(i, epoch, ephemeralSizes(nb.currentAddressSpaces(), time.Now())...) // TODO: is this the correct epoch?  Should we do the previous one as well?
 		if err != nil {
-			jww.WARN.Printf("Failed to add latest ephemeral for orphaned identity %+v: %+v", i.IntermediaryId, err)
+			jww.WARN.Printf("Failed to add latest ephemeral for orphaned identity %s: %+v", privacy.Bytes(i.IntermediaryId), err)
 		}
 	}
 
@@ -79,11 +82,26 @@ func (nb *Impl) initCreator() {
 	time.Sleep(time.Until(nextTrigger))
 }
 
+// lookAhead returns how far ahead of the current time ephemerals are generated.
+func (nb *Impl) lookAhead() time.Duration {
+	if nb.ephemeralLookAhead <= 0 {
+		return defaultLookAhead
+	}
+	return nb.ephemeralLookAhead
+}
+
+// deletionDelay returns how far before the current time an ephemeral must
+// have been generated to be deleted: one period, plus the look-ahead it was
+// generated with.
+func (nb *Impl) deletionDelay() time.Duration {
+	return -(time.Duration(ephemeral.Period) + nb.lookAhead())
+}
+
 func (nb *Impl) addEphemerals(start time.Time) {
 	currentOffset, epoch := ephemeral.HandleQuantization(start)
-	def := nb.inst.GetPartialNdf()
-	// FIXME: Does the address space need more logic here?
-	err := nb.Storage.AddEphemeralsForOffset(currentOffset, epoch, uint(def.Get().AddressSpace[0].Size), start)
+	// Generate ephemerals for every address space size in effect while they are valid
+	sizes := ephemeralSizes(nb.currentAddressSpaces(), start)
+	err := nb.Storage.AddEphemeralsForOffset(currentOffset, epoch, start, sizes...)
 	if err != nil {
 		jww.WARN.Printf("failed to update ephemerals: %+v", err)
 	}
@@ -99,7 +117,7 @@ func (nb *Impl) EphIdDeleter() {
 	//handle all future epochs
 	for true {
 		<-ticker.C
-		go nb.deleteEphemerals(time.Now().Add(deletionDelay))
+		go nb.deleteEphemerals(time.Now().Add(nb.deletionDelay()))
 	}
 }
 
@@ -109,7 +127,7 @@ func (nb *Impl) initDeleter() {
 	nextTrigger := time.Unix(0, int64(epoch+1)*offsetPhase)
 	// Bring us into phase with ephemeral identity creation
 	time.Sleep(time.Until(nextTrigger))
-	go nb.deleteEphemerals(time.Now().Add(deletionDelay))
+	go nb.deleteEphemerals(time.Now().Add(nb.deletionDelay()))
 }
 
 func (nb *Impl) deleteEphemerals(start time.Time) {
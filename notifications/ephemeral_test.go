@@ -111,3 +111,17 @@ func TestImpl_InitCreator(t *testing.T) {
 		t.Error("Did not receive ephemeral for user")
 	}
 }
+
+func TestImpl_lookAhead(t *testing.T) {
+	nb := &Impl{}
+	if nb.lookAhead() != defaultLookAhead {
+		t.Errorf("Unset look-ahead should default to %s, got %s", defaultLookAhead, nb.lookAhead())
+	}
+	nb.ephemeralLookAhead = time.Hour
+	if nb.lookAhead() != time.Hour {
+		t.Errorf("Expected configured look-ahead of %s, got %s", time.Hour, nb.lookAhead())
+	}
+	if expected := -(time.Duration(ephemeral.Period) + time.Hour); nb.deletionDelay() != expected {
+		t.Errorf("Expected deletion delay of %s, got %s", expected, nb.deletionDelay())
+	}
+}
@@ -25,8 +25,10 @@ import (
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/ndf"
 	"gitlab.com/xx_network/primitives/netTime"
+	"gitlab.com/xx_network/primitives/rateLimiting"
 	"gitlab.com/xx_network/primitives/utils"
 	"sync"
+	"time"
 )
 
 // Impl for notifications; holds comms, storage object, creds and main functions
@@ -35,12 +37,28 @@ type Impl struct {
 	Storage          *storage.Storage
 	inst             *network.Instance
 	receivedNdf      *uint32
-	roundStore       sync.Map
 	maxNotifications int
 	maxPayloadBytes  int
+	requestTolerance time.Duration
+
+	// How far ahead of the current time ephemerals are generated
+	ephemeralLookAhead time.Duration
+
+	requestLimiter *rateLimiting.BucketMap
+	clientLimiter  *rateLimiting.BucketMap
+	gatewayLimiter *rateLimiting.BucketMap
+	limiterQuit    []chan struct{}
+	limiterStop    sync.Once
+	verifyCache    *verificationCache
+	padder         *csvPadder
+	overflow       *overflowQueues
+	seen           *seenSet
 
 	providers map[string]providers.Provider
 
+	addressSpaceMux sync.Mutex
+	addressSpaces   []ndf.AddressSpace
+
 	ndfStopper Stopper
 }
 
@@ -74,7 +92,19 @@ func StartNotifications(params Params, noTLS, noFirebase bool) (*Impl, error) {
 		receivedNdf:      &receivedNdf,
 		maxNotifications: params.NotificationsPerBatch,
 		maxPayloadBytes:  params.MaxNotificationPayload,
+		requestTolerance: params.RequestTolerance,
+		verifyCache:      newVerificationCache(params.VerificationCacheSize),
+		padder:           newCSVPadder(params.Padding, params.MaxNotificationPayload-len([]byte(notificationsTag))),
+		overflow:         newOverflowQueues(params.Overflow),
+		seen:             newSeenSet(params.DedupWindow),
+		// Zero uses the default look-ahead
+		ephemeralLookAhead: params.EphemeralLookAhead,
 	}
+	var requestQuit, clientQuit, gatewayQuit chan struct{}
+	impl.requestLimiter, requestQuit = newBucketMap(params.RateLimits.Request)
+	impl.clientLimiter, clientQuit = newBucketMap(params.RateLimits.Client)
+	impl.gatewayLimiter, gatewayQuit = newBucketMap(params.RateLimits.Gateway)
+	impl.limiterQuit = []chan struct{}{requestQuit, clientQuit, gatewayQuit}
 
 	// Set up firebase messaging client
 	if !noFirebase {
@@ -115,6 +145,7 @@ func StartNotifications(params Params, noTLS, noFirebase bool) (*Impl, error) {
 	impl.Comms = comms
 	i, err := network.NewInstance(impl.Comms.ProtoComms, &ndf.NetworkDefinition{AddressSpace: []ndf.AddressSpace{{Size: 16, Timestamp: netTime.Now()}}}, nil, nil, network.None, false)
 	if err != nil {
+		impl.StopRateLimiters()
 		return nil, errors.WithMessage(err, "Failed to start instance")
 	}
 	i.SetGatewayAuthentication()
@@ -165,7 +196,10 @@ func NewImplementation(instance *Impl) *notificationBot.Implementation {
 		return err
 	}
 	impl.Functions.RegisterTrackedID = func(msg *pb.RegisterTrackedIdRequest) error {
-		err := instance.RegisterTrackedID(msg)
+		results, err := instance.RegisterTrackedID(msg)
+		if err == nil {
+			err = trackedIDResultsError(results)
+		}
 		if err != nil {
 			jww.ERROR.Printf("Failed to RegisterTrackedID: %+v", err)
 		}
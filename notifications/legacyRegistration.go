@@ -13,6 +13,7 @@ import (
 	"gitlab.com/elixxir/crypto/hash"
 	"gitlab.com/elixxir/crypto/registration"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/xx_network/crypto/signature/rsa"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
@@ -27,6 +28,10 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 	if string(request.Token) == "" {
 		return errors.New("Cannot register for notifications with empty client token")
 	}
+	err = nb.checkRequestRateLimit(request.TransmissionRsa)
+	if err != nil {
+		return err
+	}
 
 	// Verify permissioning RSA signature
 	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
@@ -56,6 +61,10 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 	if err != nil {
 		return errors.Wrap(err, "Failed to verify IID signature from client")
 	}
+	err = nb.checkClientRateLimit(request.TransmissionRsa)
+	if err != nil {
+		return err
+	}
 
 	// Add the user to storage
 	_, epoch := ephemeral.HandleQuantization(time.Now())
@@ -67,7 +76,7 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 		app = constants.MessengerIOS.String()
 	}
 
-	_, err = nb.Storage.RegisterForNotifications(request.IntermediaryId, request.TransmissionRsa, request.Token, app, epoch, nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)
+	_, err = nb.Storage.RegisterForNotifications(request.IntermediaryId, request.TransmissionRsa, request.Token, app, epoch, ephemeralSizes(nb.currentAddressSpaces(), time.Now())...)
 	if err != nil {
 		return errors.Wrap(err, "Failed to register user with notifications")
 	}
@@ -77,6 +86,10 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 
 // UnregisterForNotifications is called by the client, and removes a user registration from our database
 func (nb *Impl) UnregisterForNotifications(request *pb.NotificationUnregisterRequest) error {
+	err := nb.checkRequestRateLimit(request.IntermediaryId)
+	if err != nil {
+		return err
+	}
 	h, err := hash.NewCMixHash()
 	if err != nil {
 		return errors.WithMessage(err, "Failed to create cmix hash")
@@ -88,7 +101,7 @@ func (nb *Impl) UnregisterForNotifications(request *pb.NotificationUnregisterReq
 
 	ident, err := nb.Storage.GetIdentity(request.IntermediaryId)
 	if err != nil {
-		return errors.WithMessagef(err, "Failed to find user with intermediary ID %+v", request.IntermediaryId)
+		return errors.WithMessagef(err, "Failed to find user with intermediary ID %s", privacy.Bytes(request.IntermediaryId))
 	}
 
 	// Get the user by identity
@@ -37,6 +37,7 @@ func (nb *Impl) TrackNdf() {
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to update partial NDF")
 		}
+		nb.updateAddressSpaces(nb.currentAddressSpaces())
 		err = nb.inst.UpdateGatewayConnections()
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to update gateway connections")
@@ -123,20 +124,21 @@ func (nb *Impl) ReceivedNdf() *uint32 {
 }
 
 func (nb *Impl) Cleaner() {
-	cleanF := func(key, val interface{}) bool {
-		t := val.(time.Time)
-		if time.Since(t) > (5 * time.Minute) {
-			nb.roundStore.Delete(key)
-		}
-		return true
-	}
-
 	cleanTicker := time.NewTicker(time.Minute * 10)
 
 	for {
 		select {
 		case <-cleanTicker.C:
-			nb.roundStore.Range(cleanF)
+			if nb.Storage != nil {
+				err := nb.Storage.DeleteExpiredRounds(time.Now())
+				if err != nil {
+					jww.ERROR.Printf("Failed to delete expired rounds: %+v", err)
+				}
+				err = nb.Storage.DeleteExpiredRequestSignatures(time.Now())
+				if err != nil {
+					jww.ERROR.Printf("Failed to delete expired request signatures: %+v", err)
+				}
+			}
 		}
 	}
 }
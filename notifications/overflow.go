@@ -0,0 +1,225 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"bytes"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/format"
+	"gitlab.com/elixxir/primitives/notifications"
+	"sort"
+	"sync"
+	"time"
+)
+
+// moreMessagesHash is the message hash of the marker notification sent when
+// notifications for an ephemeral ID are dropped. Its identity fingerprint is
+// all zeros, so it matches no identity on clients which do not check for it.
+var moreMessagesHash = bytes.Repeat([]byte{0xff}, decoyMessageHashLen)
+
+// newMoreMessagesMarker returns a marker notification telling the client that
+// notifications were dropped and it should check for messages itself.
+func newMoreMessagesMarker(ephemeralID int64) *notifications.Data {
+	return &notifications.Data{
+		EphemeralID: ephemeralID,
+		MessageHash: moreMessagesHash,
+		IdentityFP:  make([]byte, format.SIHLen),
+	}
+}
+
+// IsMoreMessagesMarker returns true if the passed in notification is the
+// marker sent when notifications were dropped.
+func IsMoreMessagesMarker(d *notifications.Data) bool {
+	return bytes.Equal(d.MessageHash, moreMessagesHash) &&
+		bytes.Equal(d.IdentityFP, make([]byte, format.SIHLen))
+}
+
+// OverflowParams limits the notifications kept for an ephemeral ID which did
+// not fit in a batch. A zero value disables the limit.
+type OverflowParams struct {
+	// Maximum notifications queued per ephemeral ID; the oldest are dropped
+	MaxPerEphemeral int
+	// Maximum time a notification is queued before it is dropped
+	MaxAge time.Duration
+	// Maximum notifications and bytes queued across all ephemeral IDs; the
+	// oldest are dropped first
+	MaxEntries int
+	MaxBytes   int
+}
+
+// overflowEntry is a queued notification and the time it was first queued.
+type overflowEntry struct {
+	data   *notifications.Data
+	queued time.Time
+}
+
+// ephemeralOverflow is the queue of notifications for one ephemeral ID.
+// If dropped is set, a marker is sent with the next batch.
+type ephemeralOverflow struct {
+	entries []overflowEntry
+	dropped bool
+}
+
+// overflowQueues holds the notifications left over from each batch, keyed by
+// ephemeral ID, so that they go out ahead of newer notifications for the same
+// ephemeral ID in the next batch.
+type overflowQueues struct {
+	mux    sync.Mutex
+	params OverflowParams
+	queues map[int64]*ephemeralOverflow
+}
+
+// newOverflowQueues returns empty overflowQueues with the passed in limits.
+func newOverflowQueues(params OverflowParams) *overflowQueues {
+	return &overflowQueues{
+		params: params,
+		queues: make(map[int64]*ephemeralOverflow),
+	}
+}
+
+// take empties the queues into the passed in batch of new notifications. For
+// each ephemeral ID the batch holds a marker if notifications were dropped,
+// then the queued notifications from oldest to newest, then the new ones.
+// Ephemeral IDs with queued notifications are added to the batch even if they
+// have no new notifications. The returned map holds the time each queued
+// notification was first queued, to be passed back to requeue.
+func (oq *overflowQueues) take(batch map[int64][]*notifications.Data,
+	now time.Time) map[*notifications.Data]time.Time {
+	oq.mux.Lock()
+	defer oq.mux.Unlock()
+
+	queued := make(map[*notifications.Data]time.Time)
+	for ephemeralID, q := range oq.queues {
+		oq.expire(ephemeralID, q, now)
+
+		merged := make([]*notifications.Data, 0, len(q.entries)+len(batch[ephemeralID])+1)
+		if q.dropped {
+			merged = append(merged, newMoreMessagesMarker(ephemeralID))
+		}
+		for _, e := range q.entries {
+			merged = append(merged, e.data)
+			queued[e.data] = e.queued
+		}
+		if len(merged) > 0 {
+			batch[ephemeralID] = append(merged, batch[ephemeralID]...)
+		}
+	}
+	oq.queues = make(map[int64]*ephemeralOverflow)
+	return queued
+}
+
+// requeue adds notifications which were not sent to the queue for their
+// ephemeral ID. Notifications returned by take keep the time they were first
+// queued; others are queued at now. If the queue exceeds its cap the oldest
+// notifications are dropped, and an unsent marker is kept as a flag.
+func (oq *overflowQueues) requeue(unsent []*notifications.Data,
+	queued map[*notifications.Data]time.Time, now time.Time) {
+	oq.mux.Lock()
+	defer oq.mux.Unlock()
+
+	for _, d := range unsent {
+		q, ok := oq.queues[d.EphemeralID]
+		if !ok {
+			q = &ephemeralOverflow{}
+			oq.queues[d.EphemeralID] = q
+		}
+		if IsMoreMessagesMarker(d) {
+			q.dropped = true
+			continue
+		}
+		t, ok := queued[d]
+		if !ok {
+			t = now
+		}
+		q.entries = append(q.entries, overflowEntry{data: d, queued: t})
+	}
+
+	for ephemeralID, q := range oq.queues {
+		sort.SliceStable(q.entries, func(i, j int) bool {
+			return q.entries[i].queued.Before(q.entries[j].queued)
+		})
+		oq.expire(ephemeralID, q, now)
+		if excess := len(q.entries) - oq.params.MaxPerEphemeral; oq.params.MaxPerEphemeral > 0 && excess > 0 {
+			q.entries = q.entries[excess:]
+			q.dropped = true
+			jww.WARN.Printf("Dropped %d notifications for ephemeral ID %s over the overflow cap of %d",
+				excess, privacy.EphemeralID(ephemeralID), oq.params.MaxPerEphemeral)
+		}
+	}
+	oq.evict()
+}
+
+// evict drops the oldest queued notifications across all ephemeral IDs until
+// the queues are within the entry and byte limits. The entries of each queue
+// must be sorted by queue time and the lock held.
+func (oq *overflowQueues) evict() {
+	if oq.params.MaxEntries <= 0 && oq.params.MaxBytes <= 0 {
+		return
+	}
+	type queuedRef struct {
+		ephemeralID int64
+		entry       overflowEntry
+	}
+	var refs []queuedRef
+	var bytes int64
+	for ephemeralID, q := range oq.queues {
+		for _, e := range q.entries {
+			refs = append(refs, queuedRef{ephemeralID, e})
+			bytes += storage.DataSize(e.data)
+		}
+	}
+	overLimit := func(entries int, bytes int64) bool {
+		return (oq.params.MaxEntries > 0 && entries > oq.params.MaxEntries) ||
+			(oq.params.MaxBytes > 0 && bytes > int64(oq.params.MaxBytes))
+	}
+	if !overLimit(len(refs), bytes) {
+		return
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].entry.queued.Before(refs[j].entry.queued)
+	})
+	dropped := make(map[int64]int)
+	entries := len(refs)
+	for _, ref := range refs {
+		if !overLimit(entries, bytes) {
+			break
+		}
+		dropped[ref.ephemeralID]++
+		entries--
+		bytes -= storage.DataSize(ref.entry.data)
+	}
+	// Each queue is sorted, so its dropped notifications are at its front
+	for ephemeralID, n := range dropped {
+		q := oq.queues[ephemeralID]
+		q.entries = q.entries[n:]
+		q.dropped = true
+	}
+	jww.WARN.Printf("Dropped %d notifications for %d ephemeral IDs over the overflow limits of "+
+		"%d notifications and %d bytes", len(refs)-entries, len(dropped), oq.params.MaxEntries, oq.params.MaxBytes)
+}
+
+// expire drops queued notifications older than the max age. The entries must
+// be sorted by queue time and the lock held.
+func (oq *overflowQueues) expire(ephemeralID int64, q *ephemeralOverflow, now time.Time) {
+	if oq.params.MaxAge <= 0 {
+		return
+	}
+	expired := 0
+	for expired < len(q.entries) && now.Sub(q.entries[expired].queued) > oq.params.MaxAge {
+		expired++
+	}
+	if expired > 0 {
+		q.entries = q.entries[expired:]
+		q.dropped = true
+		jww.WARN.Printf("Dropped %d notifications for ephemeral ID %s queued longer than %s",
+			expired, privacy.EphemeralID(ephemeralID), oq.params.MaxAge)
+	}
+}
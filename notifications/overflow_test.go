@@ -0,0 +1,166 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"testing"
+	"time"
+)
+
+// newTestOverflowData returns n notifications for an ephemeral ID, with the
+// round ID set to their index.
+func newTestOverflowData(ephemeralID int64, n int) []*notifications.Data {
+	data := make([]*notifications.Data, n)
+	for i := range data {
+		data[i] = &notifications.Data{
+			EphemeralID: ephemeralID,
+			RoundID:     uint64(i),
+			MessageHash: []byte{byte(i)},
+			IdentityFP:  []byte{byte(ephemeralID)},
+		}
+	}
+	return data
+}
+
+// Tests that queued notifications are sent before new ones for the same
+// ephemeral ID, and that ephemeral IDs with only queued notifications are
+// added to the batch.
+func TestOverflowQueues_take(t *testing.T) {
+	oq := newOverflowQueues(OverflowParams{})
+	now := time.Now()
+	old := newTestOverflowData(1, 3)
+	oq.requeue(append(old, newTestOverflowData(2, 1)...), nil, now)
+
+	fresh := newTestOverflowData(1, 2)
+	batch := map[int64][]*notifications.Data{1: fresh}
+	queued := oq.take(batch, now)
+
+	if len(batch[1]) != 5 || batch[1][0] != old[0] || batch[1][2] != old[2] || batch[1][3] != fresh[0] {
+		t.Errorf("Queued notifications should come before new ones: %+v", batch[1])
+	}
+	if len(batch[2]) != 1 {
+		t.Errorf("Ephemeral ID with only queued notifications should be in the batch")
+	}
+	if len(queued) != 4 || !queued[old[0]].Equal(now) {
+		t.Errorf("Unexpected queue times: %+v", queued)
+	}
+	if len(oq.queues) != 0 {
+		t.Errorf("Queues should be empty after take")
+	}
+}
+
+// Tests that queues over the cap drop their oldest notifications and send a
+// marker in the next batch.
+func TestOverflowQueues_Cap(t *testing.T) {
+	oq := newOverflowQueues(OverflowParams{MaxPerEphemeral: 2})
+	now := time.Now()
+	data := newTestOverflowData(1, 4)
+	oq.requeue(data[:2], nil, now)
+	oq.requeue(data[2:], nil, now.Add(time.Second))
+
+	batch := map[int64][]*notifications.Data{}
+	oq.take(batch, now.Add(time.Second))
+	if len(batch[1]) != 3 {
+		t.Fatalf("Expected marker and 2 notifications, got %d", len(batch[1]))
+	}
+	if !IsMoreMessagesMarker(batch[1][0]) || batch[1][0].EphemeralID != 1 {
+		t.Errorf("Expected marker first, got %+v", batch[1][0])
+	}
+	if batch[1][1] != data[2] || batch[1][2] != data[3] {
+		t.Errorf("Expected the newest notifications to be kept")
+	}
+}
+
+// Tests that the entry limit across all queues drops the oldest notifications
+// first, whichever ephemeral ID they are queued for.
+func TestOverflowQueues_MaxEntries(t *testing.T) {
+	oq := newOverflowQueues(OverflowParams{MaxEntries: 3})
+	now := time.Now()
+	first, second := newTestOverflowData(1, 2), newTestOverflowData(2, 2)
+	oq.requeue(first, nil, now)
+	oq.requeue(second, nil, now.Add(time.Second))
+
+	batch := map[int64][]*notifications.Data{}
+	oq.take(batch, now.Add(time.Second))
+	if len(batch[1]) != 2 || !IsMoreMessagesMarker(batch[1][0]) || batch[1][1] != first[1] {
+		t.Errorf("Expected marker and newest notification for ephemeral ID 1, got %+v", batch[1])
+	}
+	if len(batch[2]) != 2 || batch[2][0] != second[0] || batch[2][1] != second[1] {
+		t.Errorf("Expected both notifications for ephemeral ID 2, got %+v", batch[2])
+	}
+}
+
+// Tests that the byte limit across all queues drops the oldest notifications.
+func TestOverflowQueues_MaxBytes(t *testing.T) {
+	data := newTestOverflowData(1, 4)
+	size := int(storage.DataSize(data[0]))
+	oq := newOverflowQueues(OverflowParams{MaxBytes: 2 * size})
+	now := time.Now()
+	for i, d := range data {
+		oq.requeue([]*notifications.Data{d}, nil, now.Add(time.Duration(i)*time.Second))
+	}
+
+	batch := map[int64][]*notifications.Data{}
+	oq.take(batch, now.Add(4*time.Second))
+	if len(batch[1]) != 3 || !IsMoreMessagesMarker(batch[1][0]) ||
+		batch[1][1] != data[2] || batch[1][2] != data[3] {
+		t.Errorf("Expected marker and 2 newest notifications, got %+v", batch[1])
+	}
+}
+
+// Tests that notifications queued longer than the max age are dropped, and
+// that the marker is sent even if nothing else is left.
+func TestOverflowQueues_MaxAge(t *testing.T) {
+	oq := newOverflowQueues(OverflowParams{MaxAge: time.Minute})
+	now := time.Now()
+	data := newTestOverflowData(1, 2)
+	oq.requeue(data, nil, now)
+
+	batch := map[int64][]*notifications.Data{}
+	queued := oq.take(batch, now.Add(2*time.Minute))
+	if len(batch[1]) != 1 || !IsMoreMessagesMarker(batch[1][0]) {
+		t.Fatalf("Expected only a marker, got %+v", batch[1])
+	}
+
+	// A marker which was not sent is kept as a flag
+	oq.requeue(batch[1], queued, now.Add(2*time.Minute))
+	batch = map[int64][]*notifications.Data{1: newTestOverflowData(1, 1)}
+	oq.take(batch, now.Add(2*time.Minute))
+	if len(batch[1]) != 2 || !IsMoreMessagesMarker(batch[1][0]) {
+		t.Errorf("Expected marker to be sent with the next batch, got %+v", batch[1])
+	}
+}
+
+// Tests that requeued notifications keep the time they were first queued, so
+// they still expire.
+func TestOverflowQueues_requeue_KeepsAge(t *testing.T) {
+	oq := newOverflowQueues(OverflowParams{MaxAge: time.Minute})
+	now := time.Now()
+	data := newTestOverflowData(1, 1)
+	oq.requeue(data, nil, now)
+
+	batch := map[int64][]*notifications.Data{}
+	queued := oq.take(batch, now.Add(50*time.Second))
+	oq.requeue(batch[1], queued, now.Add(50*time.Second))
+
+	batch = map[int64][]*notifications.Data{}
+	oq.take(batch, now.Add(70*time.Second))
+	if len(batch[1]) != 1 || !IsMoreMessagesMarker(batch[1][0]) {
+		t.Errorf("Expected requeued notification to expire, got %+v", batch[1])
+	}
+}
+
+// Tests that the marker survives encoding in a notification CSV.
+func TestMoreMessagesMarker_CSV(t *testing.T) {
+	csv, _ := notifications.BuildNotificationCSV([]*notifications.Data{newMoreMessagesMarker(1)}, 4096)
+	decoded, err := notifications.DecodeNotificationsCSV(string(csv))
+	if err != nil {
+		t.Fatalf("Failed to decode CSV: %+v", err)
+	}
+	if len(decoded) != 1 || !IsMoreMessagesMarker(decoded[0]) {
+		t.Errorf("Decoded notification is not a marker: %+v", decoded)
+	}
+	if IsMoreMessagesMarker(newTestOverflowData(1, 1)[0]) {
+		t.Error("Notification should not be a marker")
+	}
+}
@@ -0,0 +1,81 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"sort"
+	"strings"
+)
+
+// CSVPadding is the character appended to a notification CSV to pad it.
+// Clients of apps which opt in to padding must strip trailing CSVPadding
+// characters before decoding the CSV.
+const CSVPadding = "~"
+
+// PaddingParams configures padding of notification CSVs, so that their size
+// does not reveal how many notifications they contain.
+type PaddingParams struct {
+	// Apps whose notifications are padded. Padding is disabled if empty.
+	Apps []string
+	// Sizes in bytes to round each CSV up to. CSVs larger than every bucket,
+	// or all CSVs if no buckets are set, are padded to the max payload size.
+	BucketSizes []int
+}
+
+// csvPadder pads notification CSVs for apps which have opted in.
+type csvPadder struct {
+	apps    map[string]bool
+	buckets []int
+	max     int
+}
+
+// newCSVPadder returns a csvPadder for the passed in params which pads to at
+// most maxSize bytes, or nil if no apps have opted in.
+func newCSVPadder(params PaddingParams, maxSize int) *csvPadder {
+	if len(params.Apps) == 0 {
+		return nil
+	}
+	p := &csvPadder{
+		apps: make(map[string]bool, len(params.Apps)),
+		max:  maxSize,
+	}
+	for _, app := range params.Apps {
+		p.apps[app] = true
+	}
+	for _, size := range params.BucketSizes {
+		if size > 0 && size < maxSize {
+			p.buckets = append(p.buckets, size)
+		}
+	}
+	sort.Ints(p.buckets)
+	return p
+}
+
+// pad returns the CSV padded up to the next bucket size if the app has opted
+// in to padding, and the CSV unchanged otherwise.
+func (p *csvPadder) pad(app, csv string) string {
+	if p == nil || !p.apps[app] {
+		return csv
+	}
+	target := p.max
+	for _, size := range p.buckets {
+		if len(csv) <= size {
+			target = size
+			break
+		}
+	}
+	if len(csv) >= target {
+		return csv
+	}
+	return csv + strings.Repeat(CSVPadding, target-len(csv))
+}
+
+// unpadCSV strips padding added by csvPadder from a notification CSV.
+func unpadCSV(csv string) string {
+	return strings.TrimRight(csv, CSVPadding)
+}
@@ -0,0 +1,79 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"strings"
+	"testing"
+)
+
+// Tests that CSVs are rounded up to the next bucket, or the max size, only
+// for apps which opted in.
+func TestCsvPadder_pad(t *testing.T) {
+	p := newCSVPadder(PaddingParams{
+		Apps:        []string{"padded"},
+		BucketSizes: []int{1024, 256, 5000},
+	}, 2048)
+
+	tests := []struct {
+		len      int
+		expected int
+	}{
+		{0, 256},
+		{1, 256},
+		{256, 256},
+		{257, 1024},
+		{1024, 1024},
+		{1025, 2048},
+		{2048, 2048},
+		{3000, 3000},
+	}
+	for _, tt := range tests {
+		csv := strings.Repeat("a", tt.len)
+		padded := p.pad("padded", csv)
+		if len(padded) != tt.expected {
+			t.Errorf("CSV of %d bytes padded to %d, expected %d", tt.len, len(padded), tt.expected)
+		}
+		if unpadCSV(padded) != csv {
+			t.Errorf("Unpadded CSV of %d bytes does not match original", tt.len)
+		}
+		if p.pad("other", csv) != csv {
+			t.Errorf("CSV for app which did not opt in should not be padded")
+		}
+	}
+
+	noBuckets := newCSVPadder(PaddingParams{Apps: []string{"padded"}}, 2048)
+	if len(noBuckets.pad("padded", "a")) != 2048 {
+		t.Error("CSV should be padded to the max size without buckets")
+	}
+
+	disabled := newCSVPadder(PaddingParams{}, 2048)
+	if disabled != nil || disabled.pad("padded", "a") != "a" {
+		t.Error("Padding should be disabled without apps")
+	}
+}
+
+// Tests that padded CSVs decode to the original notifications once unpadded.
+func TestImpl_notify_Padded(t *testing.T) {
+	dchan := make(chan string, 1)
+	impl := &Impl{
+		providers: map[string]providers.Provider{"padded": &MockProvider{donech: dchan}},
+		padder:    newCSVPadder(PaddingParams{Apps: []string{"padded"}, BucketSizes: []int{512}}, 4096),
+	}
+	data := []*notifications.Data{{MessageHash: []byte("hash"), IdentityFP: []byte("fingerprint")}}
+	csv, _ := notifications.BuildNotificationCSV(data, 4096)
+
+	impl.notify(string(csv), storage.GTNResult{App: "padded", Token: "token"})
+	received := <-dchan
+	if len(received) != 512 {
+		t.Errorf("Expected CSV padded to 512 bytes, received %d", len(received))
+	}
+	decoded, err := notifications.DecodeNotificationsCSV(unpadCSV(received))
+	if err != nil {
+		t.Fatalf("Failed to decode unpadded CSV: %+v", err)
+	}
+	if len(decoded) != 1 || string(decoded[0].MessageHash) != "hash" {
+		t.Errorf("Unexpected decoded notifications: %+v", decoded)
+	}
+}
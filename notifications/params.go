@@ -7,7 +7,10 @@
 
 package notifications
 
-import "gitlab.com/elixxir/notifications-bot/notifications/providers"
+import (
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"time"
+)
 
 // Params struct holds info passed in for configuration
 type Params struct {
@@ -23,4 +26,12 @@ type Params struct {
 	HavenAPNS              providers.APNSParams
 	HttpsCertPath          string
 	HttpsKeyPath           string
+	RateLimits             RateLimitParams
+	RequestTolerance       time.Duration
+	VerificationCacheSize  int
+	CoverTraffic           CoverTrafficParams
+	Padding                PaddingParams
+	Overflow               OverflowParams
+	DedupWindow            time.Duration
+	EphemeralLookAhead     time.Duration
 }
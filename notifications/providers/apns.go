@@ -15,6 +15,7 @@ import (
 	apnstoken "github.com/sideshow/apns2/token"
 	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"time"
 )
@@ -94,7 +95,7 @@ func (a *apns) Notify(csv string, target storage.GTNResult) (bool, error) {
 		//	return errors.WithMessagef(err, "Failed to remove user registration tRSA hash: %+v", u.TransmissionRSAHash)
 		//}
 	}
-	jww.DEBUG.Printf("Notified ephemeral ID %+v [%+v] via APNS and received response %+v", target.EphemeralId, target.Token, resp)
+	jww.DEBUG.Printf("Notified ephemeral ID %s [%s] via APNS and received response %+v", privacy.EphemeralID(target.EphemeralId), privacy.Token(target.Token), resp)
 	return true, nil
 }
 
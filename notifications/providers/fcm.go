@@ -13,6 +13,7 @@ import (
 	"firebase.google.com/go/messaging"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"google.golang.org/api/option"
 	"strings"
@@ -67,13 +68,13 @@ func (f *fcm) Notify(csv string, target storage.GTNResult) (bool, error) {
 
 		if strings.Contains(err.Error(), "404") || invalidToken {
 			validToken = false
-			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %+v due to invalid token", target.TransmissionRSAHash)
+			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %s due to invalid token", privacy.Bytes(target.TransmissionRSAHash))
 		} else {
-			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %+v", target.TransmissionRSAHash)
+			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %s", privacy.Bytes(target.TransmissionRSAHash))
 		}
 
 		return validToken, err
 	}
-	jww.DEBUG.Printf("Notified ephemeral ID %+v [%+v] via fcm and received response %+v", target.EphemeralId, target.Token, resp)
+	jww.DEBUG.Printf("Notified ephemeral ID %s [%s] via fcm and received response %+v", privacy.EphemeralID(target.EphemeralId), privacy.Token(target.Token), resp)
 	return true, nil
 }
@@ -0,0 +1,134 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/elixxir/notifications-bot/privacy"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/rateLimiting"
+)
+
+var rateLimitError = "Rate limit exceeded for %s, please try again later"
+
+// RateLimitParams holds the leaky bucket configuration for the comms API.
+// A bucket map with a zero capacity or leak duration is disabled.
+type RateLimitParams struct {
+	// Limits client calls per claimed transmission RSA key (or intermediary
+	// ID for legacy unregistration) before their signatures are verified.
+	// The comms handlers are not passed the peer address, so this is the
+	// closest key available.
+	Request rateLimiting.MapParams
+	// Limits registration calls per transmission RSA key
+	Client rateLimiting.MapParams
+	// Limits notification batches per gateway
+	Gateway rateLimiting.MapParams
+}
+
+// newBucketMap creates a bucket map from the passed in params, returning nil
+// if the params do not describe a usable limit. If the params have a poll
+// duration, the returned channel stops the stale bucket worker when closed.
+func newBucketMap(params rateLimiting.MapParams) (*rateLimiting.BucketMap, chan struct{}) {
+	if params.Capacity == 0 || params.LeakedTokens == 0 || params.LeakDuration == 0 {
+		return nil, nil
+	}
+	var quit chan struct{}
+	if params.PollDuration > 0 {
+		quit = make(chan struct{})
+	}
+	return rateLimiting.CreateBucketMapFromParams(&params, nil, quit), quit
+}
+
+// StopRateLimiters stops the workers removing stale buckets from the rate
+// limiters. It is safe to call more than once.
+func (nb *Impl) StopRateLimiters() {
+	nb.limiterStop.Do(func() {
+		for _, quit := range nb.limiterQuit {
+			if quit != nil {
+				close(quit)
+			}
+		}
+	})
+}
+
+// rateLimitKey returns the cmix hash of the passed in value and its base64
+// encoding, which is used as a bucket map key.
+func rateLimitKey(value []byte) (string, []byte, error) {
+	h, err := hash.NewCMixHash()
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "Failed to create cmix hash")
+	}
+	_, err = h.Write(value)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "Failed to write rate limit key to hash")
+	}
+	hashed := h.Sum(nil)
+	return base64.StdEncoding.EncodeToString(hashed), hashed, nil
+}
+
+// checkRequestRateLimit adds a token to the bucket for the key a client call
+// claims to be from, returning an error if the bucket is full. It is called
+// before any signature is verified so a flood of badly signed requests for a
+// key cannot tie up the RSA work. Requests from different keys never share a
+// bucket, so one sender cannot lock out every client.
+func (nb *Impl) checkRequestRateLimit(claimedKey []byte) error {
+	if nb.requestLimiter == nil {
+		return nil
+	}
+	key, hashed, err := rateLimitKey(claimedKey)
+	if err != nil {
+		return err
+	}
+	if ok, _ := nb.requestLimiter.LookupBucket(key).Add(1); !ok {
+		jww.WARN.Printf("Rejecting client request before verification, rate limit exceeded for %s", privacy.Bytes(hashed))
+		return errors.Errorf(rateLimitError, "client requests")
+	}
+	return nil
+}
+
+// checkClientRateLimit adds a token to the bucket for the passed in
+// transmission RSA key, returning an error if the bucket is full. It must only
+// be called once the request has been verified as signed by the key, otherwise
+// anyone could fill the bucket of another user by sending forged requests.
+func (nb *Impl) checkClientRateLimit(transmissionRsaPem []byte) error {
+	if nb.clientLimiter == nil {
+		return nil
+	}
+	key, transmissionRsaHash, err := rateLimitKey(transmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	if ok, _ := nb.clientLimiter.LookupBucket(key).Add(1); !ok {
+		jww.DEBUG.Printf("Rejecting client request, rate limit exceeded for tRSA hash %s", privacy.Bytes(transmissionRsaHash))
+		return errors.Errorf(rateLimitError, "client")
+	}
+	return nil
+}
+
+// checkGatewayRateLimit adds a token to the bucket for the gateway which sent
+// a notification batch, returning an error if the bucket is full.
+func (nb *Impl) checkGatewayRateLimit(auth *connect.Auth) error {
+	if nb.gatewayLimiter == nil || auth == nil {
+		return nil
+	}
+	var key string
+	if auth.Sender != nil {
+		key = auth.Sender.GetId().String()
+	} else {
+		key = auth.IpAddress
+	}
+
+	if ok, _ := nb.gatewayLimiter.LookupBucket(key).Add(1); !ok {
+		jww.WARN.Printf("Rejecting notification batch, rate limit exceeded for gateway %s", key)
+		return errors.Errorf(rateLimitError, "gateway "+key)
+	}
+	return nil
+}
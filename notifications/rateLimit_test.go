@@ -0,0 +1,224 @@
+package notifications
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/rateLimiting"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that client requests are rejected once the bucket for a
+// transmission RSA key is full, and that other keys are unaffected.
+func TestImpl_checkClientRateLimit(t *testing.T) {
+	limiter, _ := newBucketMap(rateLimiting.MapParams{
+		Capacity:     3,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+	})
+	impl := &Impl{clientLimiter: limiter}
+
+	for i := 0; i < 3; i++ {
+		err := impl.checkClientRateLimit([]byte("trsa"))
+		if err != nil {
+			t.Fatalf("Request %d should not have been rate limited: %+v", i, err)
+		}
+	}
+
+	err := impl.checkClientRateLimit([]byte("trsa"))
+	if err == nil || !strings.Contains(err.Error(), "Rate limit exceeded") {
+		t.Fatalf("Expected rate limit error, instead got %+v", err)
+	}
+
+	err = impl.checkClientRateLimit([]byte("otherTrsa"))
+	if err != nil {
+		t.Fatalf("Request for different key should not have been rate limited: %+v", err)
+	}
+}
+
+// Tests that a disabled limiter never rejects requests.
+func TestImpl_checkClientRateLimit_Disabled(t *testing.T) {
+	limiter, _ := newBucketMap(rateLimiting.MapParams{})
+	impl := &Impl{clientLimiter: limiter}
+	if impl.clientLimiter != nil {
+		t.Fatal("Bucket map should not be created with zero capacity")
+	}
+
+	for i := 0; i < 100; i++ {
+		err := impl.checkClientRateLimit([]byte("trsa"))
+		if err != nil {
+			t.Fatalf("Disabled limiter returned an error: %+v", err)
+		}
+	}
+}
+
+// Tests that requests which fail verification do not use up the rate limit of
+// the transmission RSA key they name.
+func TestImpl_UnregisterToken_RateLimitAfterVerification(t *testing.T) {
+	s, err := storage.NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	limiter, _ := newBucketMap(rateLimiting.MapParams{
+		Capacity:     1,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+	})
+	impl := &Impl{Storage: s, clientLimiter: limiter}
+
+	for i := 0; i < 3; i++ {
+		err = impl.UnregisterToken(&pb.UnregisterTokenRequest{
+			App:                "HavenIOS",
+			Token:              "token",
+			TransmissionRsaPem: []byte("trsa"),
+			RequestTimestamp:   time.Now().UnixNano(),
+			TokenSignature:     []byte("forged"),
+		})
+		if err == nil || strings.Contains(err.Error(), "Rate limit exceeded") {
+			t.Fatalf("Expected verification error for forged request, got %+v", err)
+		}
+	}
+
+	err = impl.checkClientRateLimit([]byte("trsa"))
+	if err != nil {
+		t.Errorf("Forged requests should not have been counted: %+v", err)
+	}
+}
+
+// Tests that the pre-verification limit rejects calls once the bucket for a
+// claimed key is full, and that calls claiming other keys are unaffected.
+func TestImpl_checkRequestRateLimit(t *testing.T) {
+	limiter, _ := newBucketMap(rateLimiting.MapParams{
+		Capacity:     2,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+	})
+	impl := &Impl{requestLimiter: limiter}
+
+	for i := 0; i < 2; i++ {
+		err := impl.checkRequestRateLimit([]byte("trsa"))
+		if err != nil {
+			t.Fatalf("Request %d should not have been rate limited: %+v", i, err)
+		}
+	}
+	err := impl.checkRequestRateLimit([]byte("trsa"))
+	if err == nil || !strings.Contains(err.Error(), "Rate limit exceeded") {
+		t.Fatalf("Expected rate limit error, instead got %+v", err)
+	}
+
+	err = impl.checkRequestRateLimit([]byte("other trsa"))
+	if err != nil {
+		t.Fatalf("Request for another key should not have been rate limited: %+v", err)
+	}
+
+	disabled, _ := newBucketMap(rateLimiting.MapParams{})
+	if disabled != nil {
+		t.Fatal("Bucket map should not be created with zero capacity")
+	}
+	err = (&Impl{}).checkRequestRateLimit([]byte("trsa"))
+	if err != nil {
+		t.Fatalf("Disabled limiter returned an error: %+v", err)
+	}
+}
+
+// Tests that a flood of badly signed requests for one key is throttled before
+// their signatures are checked, without throttling requests for other keys.
+func TestImpl_UnregisterToken_RateLimitBeforeVerification(t *testing.T) {
+	s, err := storage.NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	limiter, _ := newBucketMap(rateLimiting.MapParams{
+		Capacity:     2,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+	})
+	impl := &Impl{Storage: s, requestLimiter: limiter}
+
+	for i := 0; i < 3; i++ {
+		err = impl.UnregisterToken(&pb.UnregisterTokenRequest{
+			App:                "HavenIOS",
+			Token:              "token",
+			TransmissionRsaPem: []byte("trsa"),
+			RequestTimestamp:   time.Now().UnixNano(),
+			TokenSignature:     []byte("forged"),
+		})
+		if err == nil {
+			t.Fatalf("Request %d with forged signature should have failed", i)
+		}
+		limited := strings.Contains(err.Error(), "Rate limit exceeded")
+		if limited != (i == 2) {
+			t.Fatalf("Unexpected error for request %d: %+v", i, err)
+		}
+	}
+
+	err = impl.UnregisterToken(&pb.UnregisterTokenRequest{
+		App:                "HavenIOS",
+		Token:              "token",
+		TransmissionRsaPem: []byte("other trsa"),
+		RequestTimestamp:   time.Now().UnixNano(),
+		TokenSignature:     []byte("forged"),
+	})
+	if err == nil || strings.Contains(err.Error(), "Rate limit exceeded") {
+		t.Fatalf("Request for another key should fail verification, not the rate limit: %+v", err)
+	}
+}
+
+// Tests that StopRateLimiters closes the quit channels once.
+func TestImpl_StopRateLimiters(t *testing.T) {
+	limiter, quit := newBucketMap(rateLimiting.MapParams{
+		Capacity:     1,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+		PollDuration: time.Minute,
+		BucketMaxAge: time.Hour,
+	})
+	if quit == nil {
+		t.Fatal("Expected a quit channel when a poll duration is set")
+	}
+	impl := &Impl{clientLimiter: limiter, limiterQuit: []chan struct{}{quit, nil}}
+
+	impl.StopRateLimiters()
+	impl.StopRateLimiters()
+	select {
+	case <-quit:
+	default:
+		t.Error("Quit channel was not closed")
+	}
+}
+
+// Tests that ReceiveNotificationBatch rejects batches once a gateway
+// exceeds its limit.
+func TestImpl_ReceiveNotificationBatch_RateLimited(t *testing.T) {
+	s, err := storage.NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	limiter, _ := newBucketMap(rateLimiting.MapParams{
+		Capacity:     2,
+		LeakedTokens: 1,
+		LeakDuration: time.Hour,
+	})
+	impl := &Impl{
+		Storage:        s,
+		gatewayLimiter: limiter,
+	}
+	auth := &connect.Auth{
+		IsAuthenticated: true,
+		IpAddress:       "0.0.0.0",
+	}
+
+	for i := uint64(0); i < 2; i++ {
+		err = impl.ReceiveNotificationBatch(&pb.NotificationBatch{RoundID: i}, auth)
+		if err != nil {
+			t.Fatalf("Batch %d should not have been rate limited: %+v", i, err)
+		}
+	}
+
+	err = impl.ReceiveNotificationBatch(&pb.NotificationBatch{RoundID: 3}, auth)
+	if err == nil {
+		t.Fatal("Expected error for batch over rate limit")
+	}
+}
@@ -8,6 +8,7 @@
 package notifications
 
 import (
+	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/primitives/notifications"
@@ -16,21 +17,35 @@ import (
 	"time"
 )
 
+// roundDedupTTL is how long a round is remembered after its notification batch
+// is received, so that batches for it sent by other gateways are dropped.
+const roundDedupTTL = 5 * time.Minute
+
 // ReceiveNotificationBatch receives the batch of notification data from gateway.
 func (nb *Impl) ReceiveNotificationBatch(notifBatch *pb.NotificationBatch, auth *connect.Auth) error {
+	err := nb.checkGatewayRateLimit(auth)
+	if err != nil {
+		return err
+	}
+
 	rid := notifBatch.RoundID
 
-	_, loaded := nb.roundStore.LoadOrStore(rid, time.Now())
-	if loaded {
+	first, err := nb.Storage.MarkRound(id.Round(rid), roundDedupTTL)
+	if err != nil {
+		// Accept the batch; notifications are deduplicated again when buffered
+		jww.WARN.Printf("Failed to mark round %d as received: %+v", rid, err)
+	} else if !first {
 		jww.DEBUG.Printf("Dropping duplicate notification batch for round %+v", notifBatch.RoundID)
 		return nil
 	}
 
 	jww.INFO.Printf("Received notification batch for round %+v", notifBatch.RoundID)
 
-	buffer := nb.Storage.GetNotificationBuffer()
 	data := processNotificationBatch(notifBatch)
-	buffer.Add(id.Round(notifBatch.RoundID), data)
+	err = nb.Storage.AddNotifications(id.Round(notifBatch.RoundID), data)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to buffer notifications for round %d", rid)
+	}
 
 	return nil
 }
@@ -4,7 +4,6 @@ import (
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
-	"sync"
 	"testing"
 )
 
@@ -13,7 +12,6 @@ func TestImpl_ReceiveNotificationBatch(t *testing.T) {
 	s, err := storage.NewStorage("", "", "", "", "")
 	impl := &Impl{
 		Storage:          s,
-		roundStore:       sync.Map{},
 		maxNotifications: 0,
 		maxPayloadBytes:  0,
 	}
@@ -38,7 +36,10 @@ func TestImpl_ReceiveNotificationBatch(t *testing.T) {
 		t.Errorf("ReceiveNotificationBatch() returned an error: %+v", err)
 	}
 
-	nbm := impl.Storage.GetNotificationBuffer().Swap()
+	nbm, err := impl.Storage.SwapNotifications()
+	if err != nil {
+		t.Fatalf("Failed to swap notification buffer: %+v", err)
+	}
 	if len(nbm[5]) < 1 {
 		t.Errorf("Notification was not added to notification buffer: %+v", nbm[5])
 	}
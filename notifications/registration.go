@@ -8,50 +8,87 @@
 package notifications
 
 import (
-	"encoding/base64"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/crypto/notifications"
-	"gitlab.com/elixxir/crypto/registration"
 	"gitlab.com/elixxir/crypto/rsa"
-	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/elixxir/notifications-bot/privacy"
+	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"strings"
 	"time"
 )
 
-var timestampError = "Timestamp of request must be within last 5 seconds.  Request timestamp: %s, current time: %s"
+var timestampError = "Timestamp of request must be within %s of current time.  Request timestamp: %s, current time: %s"
+
+// defaultRequestTolerance is the clock skew allowed on signed requests if
+// none is configured.
+const defaultRequestTolerance = 5 * time.Second
+
+// checkRequestTimestamp returns the time of a signed request, or an error if it
+// is further than the configured tolerance from the current time in either
+// direction.
+func (nb *Impl) checkRequestTimestamp(ts int64) (time.Time, error) {
+	tolerance := nb.requestTolerance
+	if tolerance <= 0 {
+		tolerance = defaultRequestTolerance
+	}
+	requestTimestamp := time.Unix(0, ts)
+	now := time.Now()
+	if diff := now.Sub(requestTimestamp); diff > tolerance || diff < -tolerance {
+		return requestTimestamp, errors.Errorf(timestampError, tolerance, requestTimestamp.String(), now.String())
+	}
+	return requestTimestamp, nil
+}
+
+// checkReplay records the signature of a verified request, returning an error
+// if it has been used before. Signatures are kept until the request timestamp
+// leaves the tolerance window, at which point checkRequestTimestamp rejects it.
+func (nb *Impl) checkReplay(signature []byte, requestTimestamp time.Time) error {
+	tolerance := nb.requestTolerance
+	if tolerance <= 0 {
+		tolerance = defaultRequestTolerance
+	}
+	err := nb.Storage.RecordRequestSignature(signature, requestTimestamp.Add(tolerance))
+	if err != nil {
+		return errors.WithMessage(err, "Failed to verify request is not a replay")
+	}
+	return nil
+}
 
 // RegisterToken registers the given token. It evaluates that the TransmissionRsaRegistarSig is
 // correct. The RSA->PEM relationship is one to many. It will succeed if the token is already
 // registered.
 func (nb *Impl) RegisterToken(msg *pb.RegisterTokenRequest) error {
 	jww.INFO.Println("RegisterToken")
-	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	err := nb.checkRequestRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
 	}
-	// Verify permissioning RSA signature
-	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
-	if !ok {
-		return errors.New("Could not find permissioning host to verify client signature")
+	requestTimestamp, err := nb.checkRequestTimestamp(msg.RequestTimestamp)
+	if err != nil {
+		return err
 	}
-	jww.INFO.Printf("Verifying perm sig with params:\n\tPubKey: %s\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n", base64.StdEncoding.EncodeToString(permHost.GetPubKey().Bytes()), msg.RegistrationTimestamp, base64.StdEncoding.EncodeToString(msg.TransmissionRsaPem), base64.StdEncoding.EncodeToString(msg.TransmissionRsaRegistrarSig))
-	err := registration.VerifyWithTimestamp(permHost.GetPubKey(), msg.RegistrationTimestamp,
-		string(msg.TransmissionRsaPem), msg.TransmissionRsaRegistrarSig)
+	// Verify permissioning RSA signature
+	pub, err := nb.verifyTransmissionRsa(msg.TransmissionRsaPem, msg.RegistrationTimestamp, msg.TransmissionRsaRegistrarSig)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify permissioning signature")
+		return err
 	}
 
 	// Verify token signature
-	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
-	if err != nil {
-		return errors.WithMessage(err, "Failed to unmarshal public key")
-	}
 	err = notifications.VerifyToken(pub, msg.Token, msg.App, requestTimestamp, notifications.RegisterTokenTag, msg.TokenSignature)
 	if err != nil {
 		return errors.WithMessage(err, "Failed to verify token signature")
 	}
+	err = nb.checkClientRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkReplay(msg.TokenSignature, requestTimestamp)
+	if err != nil {
+		return err
+	}
 
 	return nb.Storage.RegisterToken(msg.Token, msg.App, msg.TransmissionRsaPem)
 }
@@ -60,46 +97,76 @@ func (nb *Impl) RegisterToken(msg *pb.RegisterTokenRequest) error {
 // Returns an error if TransmissionRSA is not registered with a valid token.
 // The actual ID is not revealed, instead an intermediary value is sent which cannot
 // be revered to get the ID, but is repeatable. So it can be rainbow-tabled.
-func (nb *Impl) RegisterTrackedID(msg *pb.RegisterTrackedIdRequest) error {
+// Returns the outcome for each ID; the error is only set if the request fails
+// as a whole.
+func (nb *Impl) RegisterTrackedID(msg *pb.RegisterTrackedIdRequest) ([]storage.TrackedIDResult, error) {
 	jww.INFO.Println("RegisterTrackedID")
-	requestTimestamp := time.Unix(0, msg.Request.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
-	}
-
-	// Verify permissioning RSA signature
-	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
-	if !ok {
-		return errors.New("Could not find permissioning host to verify client signature")
+	err := nb.checkRequestRateLimit(msg.Request.TransmissionRsaPem)
+	if err != nil {
+		return nil, err
 	}
-	jww.INFO.Printf("Verifying perm sig with params:\n\tPubKey: %s\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n", base64.StdEncoding.EncodeToString(permHost.GetPubKey().Bytes()), msg.RegistrationTimestamp, base64.StdEncoding.EncodeToString(msg.Request.TransmissionRsaPem), base64.StdEncoding.EncodeToString(msg.TransmissionRsaRegistrarSig))
-	err := registration.VerifyWithTimestamp(permHost.GetPubKey(), msg.RegistrationTimestamp,
-		string(msg.Request.TransmissionRsaPem), msg.TransmissionRsaRegistrarSig)
+	requestTimestamp, err := nb.checkRequestTimestamp(msg.Request.RequestTimestamp)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify permissioning signature")
+		return nil, err
 	}
 
-	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.Request.TransmissionRsaPem)
+	// Verify permissioning RSA signature
+	pub, err := nb.verifyTransmissionRsa(msg.Request.TransmissionRsaPem, msg.RegistrationTimestamp, msg.TransmissionRsaRegistrarSig)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to unmarshal public key")
+		return nil, err
 	}
 
 	err = notifications.VerifyIdentity(pub, msg.Request.TrackedIntermediaryID, requestTimestamp, notifications.RegisterTrackedIDTag, msg.Request.Signature)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify identity signature")
+		return nil, errors.WithMessage(err, "Failed to verify identity signature")
+	}
+	err = nb.checkClientRateLimit(msg.Request.TransmissionRsaPem)
+	if err != nil {
+		return nil, err
+	}
+	err = nb.checkReplay(msg.Request.Signature, requestTimestamp)
+	if err != nil {
+		return nil, err
 	}
 	_, epoch := ephemeral.HandleQuantization(time.Now())
 
-	return nb.Storage.RegisterTrackedID(msg.Request.TrackedIntermediaryID, msg.Request.TransmissionRsaPem, epoch, nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)
+	return nb.Storage.RegisterTrackedID(msg.Request.TrackedIntermediaryID, msg.Request.TransmissionRsaPem, epoch, ephemeralSizes(nb.currentAddressSpaces(), time.Now())...)
+}
+
+// trackedIDResultsError logs the outcome of a RegisterTrackedID request and
+// returns an error listing the IDs which failed, if any. The comms response
+// is an Ack, so the error is the only way to report them to the client.
+func trackedIDResultsError(results []storage.TrackedIDResult) error {
+	var failed []string
+	counts := map[storage.TrackedIDStatus]int{}
+	for _, res := range results {
+		counts[res.Status]++
+		if res.Status == storage.TrackedIDFailed {
+			jww.WARN.Printf("Failed to register tracked ID %s: %+v", privacy.Bytes(res.IntermediaryId), res.Err)
+			failed = append(failed, privacy.Bytes(res.IntermediaryId))
+		}
+	}
+	jww.DEBUG.Printf("RegisterTrackedID results: %d %s, %d %s, %d %s",
+		counts[storage.TrackedIDCreated], storage.TrackedIDCreated,
+		counts[storage.TrackedIDAlreadyTracked], storage.TrackedIDAlreadyTracked,
+		counts[storage.TrackedIDFailed], storage.TrackedIDFailed)
+	if len(failed) > 0 {
+		return errors.Errorf("Failed to register %d of %d tracked IDs: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
 }
 
 // UnregisterToken unregisters the given device token. The request is signed.
 // Does not return an error if the token cannot be found
 func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 	jww.INFO.Println("UnregisterToken")
-	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	err := nb.checkRequestRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	requestTimestamp, err := nb.checkRequestTimestamp(msg.RequestTimestamp)
+	if err != nil {
+		return err
 	}
 
 	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
@@ -111,6 +178,14 @@ func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 	if err != nil {
 		return errors.WithMessage(err, "Failed to verify token signature")
 	}
+	err = nb.checkClientRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkReplay(msg.TokenSignature, requestTimestamp)
+	if err != nil {
+		return err
+	}
 
 	return nb.Storage.UnregisterToken(msg.Token, msg.TransmissionRsaPem)
 }
@@ -119,9 +194,13 @@ func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 // Does not return an error if the ID cannot be found
 func (nb *Impl) UnregisterTrackedID(msg *pb.TrackedIntermediaryIdRequest) error {
 	jww.INFO.Println("UnregisterTrackedID")
-	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	err := nb.checkRequestRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	requestTimestamp, err := nb.checkRequestTimestamp(msg.RequestTimestamp)
+	if err != nil {
+		return err
 	}
 
 	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
@@ -133,6 +212,14 @@ func (nb *Impl) UnregisterTrackedID(msg *pb.TrackedIntermediaryIdRequest) error
 	if err != nil {
 		return errors.WithMessage(err, "Failed to verify identity signature")
 	}
+	err = nb.checkClientRateLimit(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkReplay(msg.Signature, requestTimestamp)
+	if err != nil {
+		return err
+	}
 
 	return nb.Storage.UnregisterTrackedIDs(msg.TrackedIntermediaryID, msg.TransmissionRsaPem)
 }
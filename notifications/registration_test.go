@@ -167,7 +167,7 @@ func TestImpl_RegisterTrackedID(t *testing.T) {
 
 	iidSig, err := notifications.SignIdentity(private, [][]byte{iid}, reqTs, notifications.RegisterTrackedIDTag, csprng.NewSystemRNG())
 
-	err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
+	_, err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
 		Request: &mixmessages.TrackedIntermediaryIdRequest{
 			TrackedIntermediaryID: [][]byte{iid},
 			TransmissionRsaPem:    crt,
@@ -181,7 +181,7 @@ func TestImpl_RegisterTrackedID(t *testing.T) {
 		t.Fatal("Expected error verifying tracked ID sig")
 	}
 
-	err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
+	results, err := impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
 		Request: &mixmessages.TrackedIntermediaryIdRequest{
 			TrackedIntermediaryID: [][]byte{iid},
 			TransmissionRsaPem:    crt,
@@ -194,6 +194,40 @@ func TestImpl_RegisterTrackedID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(results) != 1 || results[0].Status != storage.TrackedIDCreated {
+		t.Errorf("Expected tracked ID to be created, got %+v", results)
+	}
+	if err = trackedIDResultsError(results); err != nil {
+		t.Errorf("Unexpected error for successful results: %+v", err)
+	}
+
+	// IDs of the wrong length fail on their own and are reported in the error
+	reqTs = time.Now()
+	list := [][]byte{[]byte("short"), iid}
+	iidSig, err = notifications.SignIdentity(private, list, reqTs, notifications.RegisterTrackedIDTag, csprng.NewSystemRNG())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
+		Request: &mixmessages.TrackedIntermediaryIdRequest{
+			TrackedIntermediaryID: list,
+			TransmissionRsaPem:    crt,
+			RequestTimestamp:      reqTs.UnixNano(),
+			Signature:             iidSig,
+		},
+		RegistrationTimestamp:       ts,
+		TransmissionRsaRegistrarSig: psig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != storage.TrackedIDFailed ||
+		results[1].Status != storage.TrackedIDAlreadyTracked {
+		t.Errorf("Unexpected results for list with a short ID: %+v", results)
+	}
+	if err = trackedIDResultsError(results); err == nil {
+		t.Errorf("Expected error reporting the short ID")
+	}
 }
 
 func TestImpl_UnregisterToken(t *testing.T) {
@@ -278,6 +312,41 @@ func TestImpl_UnregisterToken(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	err = impl.UnregisterToken(&mixmessages.UnregisterTokenRequest{
+		App:                constants.MessengerAndroid.String(),
+		Token:              token,
+		TransmissionRsaPem: crt,
+		RequestTimestamp:   reqTs.UnixNano(),
+		TokenSignature:     unregSig,
+	})
+	if err == nil {
+		t.Fatal("Expected error on replayed unregister request")
+	}
+}
+
+func TestImpl_checkRequestTimestamp(t *testing.T) {
+	impl := &Impl{requestTolerance: 2 * time.Second}
+
+	_, err := impl.checkRequestTimestamp(time.Now().UnixNano())
+	if err != nil {
+		t.Errorf("Current timestamp should be accepted: %+v", err)
+	}
+
+	_, err = impl.checkRequestTimestamp(time.Now().Add(time.Second).UnixNano())
+	if err != nil {
+		t.Errorf("Timestamp within future tolerance should be accepted: %+v", err)
+	}
+
+	_, err = impl.checkRequestTimestamp(time.Now().Add(-3 * time.Second).UnixNano())
+	if err == nil {
+		t.Error("Timestamp older than tolerance should be rejected")
+	}
+
+	_, err = impl.checkRequestTimestamp(time.Now().Add(3 * time.Second).UnixNano())
+	if err == nil {
+		t.Error("Timestamp further in the future than tolerance should be rejected")
+	}
 }
 
 func TestImpl_UnregisterTrackedID(t *testing.T) {
@@ -342,7 +411,7 @@ func TestImpl_UnregisterTrackedID(t *testing.T) {
 
 	iidSig, err := notifications.SignIdentity(private, [][]byte{iid}, reqTs, notifications.RegisterTrackedIDTag, csprng.NewSystemRNG())
 
-	err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
+	_, err = impl.RegisterTrackedID(&mixmessages.RegisterTrackedIdRequest{
 		Request: &mixmessages.TrackedIntermediaryIdRequest{
 			TrackedIntermediaryID: [][]byte{iid},
 			TransmissionRsaPem:    crt,
@@ -10,50 +10,50 @@ package notifications
 import (
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/elixxir/primitives/notifications"
-	"gitlab.com/xx_network/primitives/id"
 	"time"
 )
 
 const notificationsTag = "notificationData"
 
 // Sender is a long-running thread which sends out received notifications to
-// the appropriate providers every sendFreq seconds.
+// the appropriate providers every sendFreq seconds. Notifications which do not
+// fit in a batch are kept in per-ephemeral ID overflow queues and sent first
+// in the next batch for that ephemeral ID. Notifications already sent to an
+// ephemeral ID within the dedup window are not sent again.
 func (nb *Impl) Sender(sendFreq int) {
 	sendTicker := time.NewTicker(time.Duration(sendFreq) * time.Second)
 	for {
 		select {
 		case <-sendTicker.C:
 			go func() {
-				// Retreive & swap notification buffer
-				notifBuf := nb.Storage.GetNotificationBuffer()
-				notifMap := notifBuf.Swap()
+				// Retreive & swap notification buffer, then add anything
+				// left over from previous batches
+				notifMap, err := nb.Storage.SwapNotifications()
+				if err != nil {
+					jww.ERROR.Printf("Failed to swap notification buffer: %+v", err)
+					return
+				}
+				queued := nb.overflow.take(notifMap, time.Now())
+				nb.seen.filter(notifMap, time.Now())
 
 				if len(notifMap) == 0 {
 					return
 				}
 
-				unsent := map[uint64][]*notifications.Data{}
-				rest, err := nb.SendBatch(notifMap)
+				unsent, err := nb.SendBatch(notifMap)
 				if err != nil {
 					jww.ERROR.Printf("Failed to send notification batch: %+v", err)
-					// If we fail to run SendBatch, put everything back in unsent
+					// If we fail to run SendBatch, queue everything again
+					unsent = nil
 					for _, elist := range notifMap {
-						for _, n := range elist {
-							unsent[n.RoundID] = append(unsent[n.RoundID], n)
-						}
+						unsent = append(unsent, elist...)
 					}
-				} else {
-					// Loop through rest and add to unsent map
-					for _, n := range rest {
-						unsent[n.RoundID] = append(unsent[n.RoundID], n)
-					}
-				}
-				// Re-add unsent notifications to the buffer
-				for rid, nd := range unsent {
-					notifBuf.Add(id.Round(rid), nd)
 				}
+				nb.seen.markSent(notifMap, unsent, time.Now())
+				nb.overflow.requeue(unsent, queued, time.Now())
 			}()
 		}
 	}
@@ -65,7 +65,10 @@ func (nb *Impl) SendBatch(data map[int64][]*notifications.Data) ([]*notification
 	csvs := map[int64]string{}
 	var ephemerals []int64
 	var unsent []*notifications.Data
-	jww.INFO.Printf("data: %+v", data)
+	jww.INFO.Printf("Sending notifications for %d ephemeral IDs", len(data))
+	if !privacy.Enabled() {
+		jww.DEBUG.Printf("data: %+v", data)
+	}
 	for i, ilist := range data {
 		var overflow, toSend []*notifications.Data
 		if len(ilist) > nb.maxNotifications {
@@ -76,7 +79,7 @@ func (nb *Impl) SendBatch(data map[int64][]*notifications.Data) ([]*notification
 		}
 
 		notifs, rest := notifications.BuildNotificationCSV(toSend, nb.maxPayloadBytes-len([]byte(notificationsTag)))
-		overflow = append(overflow, rest...)
+		overflow = append(rest, overflow...)
 		csvs[i] = string(notifs)
 		ephemerals = append(ephemerals, i)
 		unsent = append(unsent, overflow...)
@@ -100,14 +103,14 @@ func (nb *Impl) notify(csv string, toNotify storage.GTNResult) {
 		jww.ERROR.Printf("Could not find provider for app %s", toNotify.App)
 		return
 	}
-	tokenValid, err := provider.Notify(csv, toNotify)
+	tokenValid, err := provider.Notify(nb.padder.pad(toNotify.App, csv), toNotify)
 	if err != nil {
 		jww.ERROR.Println(err)
 		if !tokenValid {
-			jww.DEBUG.Printf("User with tRSA hash %+v has invalid token [%+v] for app %s - attempting to remove", toNotify.TransmissionRSAHash, toNotify.Token, toNotify.App)
+			jww.DEBUG.Printf("User with tRSA hash %s has invalid token [%s] for app %s - attempting to remove", privacy.Bytes(toNotify.TransmissionRSAHash), privacy.Token(toNotify.Token), toNotify.App)
 			err := nb.Storage.DeleteToken(toNotify.Token)
 			if err != nil {
-				jww.ERROR.Printf("Failed to remove %s token registration tRSA hash %+v: %+v", toNotify.App, toNotify.TransmissionRSAHash, err)
+				jww.ERROR.Printf("Failed to remove %s token registration tRSA hash %s: %+v", toNotify.App, privacy.Bytes(toNotify.TransmissionRSAHash), err)
 			}
 		}
 	}
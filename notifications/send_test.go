@@ -7,7 +7,6 @@ import (
 	"gitlab.com/elixxir/primitives/notifications"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
-	"sync"
 	"testing"
 	"time"
 )
@@ -30,7 +29,6 @@ func TestImpl_SendBatch(t *testing.T) {
 		providers: map[string]providers.Provider{},
 		Storage:   s,
 
-		roundStore:       sync.Map{},
 		maxNotifications: 0,
 		maxPayloadBytes:  0,
 	}
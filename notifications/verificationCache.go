@@ -0,0 +1,149 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/registration"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/notifications-bot/privacy"
+	"gitlab.com/xx_network/primitives/id"
+	"sync"
+)
+
+// verificationCache is a bounded LRU cache of transmission RSA keys whose
+// permissioning signature has been verified for a given registration
+// timestamp. Entries hold the unmarshalled key so it is not parsed again.
+// The cache is cleared whenever the permissioning key changes.
+type verificationCache struct {
+	mux     sync.Mutex
+	size    int
+	permKey []byte
+	order   *list.List
+	entries map[verificationKey]*list.Element
+}
+
+// verificationKey is the hash of a transmission RSA key followed by the
+// registration timestamp it was signed with.
+type verificationKey [sha256.Size + 8]byte
+
+// verificationEntry is the value stored in the verificationCache list.
+type verificationEntry struct {
+	key verificationKey
+	pub rsa.PublicKey
+}
+
+// newVerificationCache creates a verificationCache which holds up to size
+// entries. It returns nil, disabling caching, if size is not positive.
+func newVerificationCache(size int) *verificationCache {
+	if size <= 0 {
+		return nil
+	}
+	return &verificationCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[verificationKey]*list.Element, size),
+	}
+}
+
+// makeKey builds the cache key for a transmission RSA key & registration timestamp.
+func (vc *verificationCache) makeKey(transmissionRsaPem []byte, registrationTimestamp int64) verificationKey {
+	var key verificationKey
+	h := sha256.Sum256(transmissionRsaPem)
+	copy(key[:], h[:])
+	binary.BigEndian.PutUint64(key[sha256.Size:], uint64(registrationTimestamp))
+	return key
+}
+
+// get returns the cached public key for the passed in values, if one was
+// verified against the passed in permissioning key.
+func (vc *verificationCache) get(permKey, transmissionRsaPem []byte, registrationTimestamp int64) (rsa.PublicKey, bool) {
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+
+	if !bytes.Equal(vc.permKey, permKey) {
+		return nil, false
+	}
+
+	e, ok := vc.entries[vc.makeKey(transmissionRsaPem, registrationTimestamp)]
+	if !ok {
+		return nil, false
+	}
+	vc.order.MoveToFront(e)
+	return e.Value.(*verificationEntry).pub, true
+}
+
+// add stores a verified public key, evicting the least recently used entry if
+// the cache is full. If the permissioning key has changed, all existing
+// entries are discarded first.
+func (vc *verificationCache) add(permKey, transmissionRsaPem []byte, registrationTimestamp int64, pub rsa.PublicKey) {
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+
+	if !bytes.Equal(vc.permKey, permKey) {
+		if vc.permKey != nil {
+			jww.INFO.Printf("Permissioning key changed, clearing %d cached verifications", vc.order.Len())
+		}
+		vc.permKey = permKey
+		vc.order.Init()
+		vc.entries = make(map[verificationKey]*list.Element, vc.size)
+	}
+
+	key := vc.makeKey(transmissionRsaPem, registrationTimestamp)
+	if e, ok := vc.entries[key]; ok {
+		vc.order.MoveToFront(e)
+		return
+	}
+
+	vc.entries[key] = vc.order.PushFront(&verificationEntry{key: key, pub: pub})
+	if vc.order.Len() > vc.size {
+		oldest := vc.order.Back()
+		vc.order.Remove(oldest)
+		delete(vc.entries, oldest.Value.(*verificationEntry).key)
+	}
+}
+
+// verifyTransmissionRsa verifies the permissioning signature over a
+// transmission RSA key and returns the unmarshalled key. Results are cached
+// so repeat registrations with the same key skip verification.
+func (nb *Impl) verifyTransmissionRsa(transmissionRsaPem []byte, registrationTimestamp int64, registrarSig []byte) (rsa.PublicKey, error) {
+	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
+	if !ok {
+		return nil, errors.New("Could not find permissioning host to verify client signature")
+	}
+	permKey := permHost.GetPubKey().Bytes()
+
+	if nb.verifyCache != nil {
+		if pub, ok := nb.verifyCache.get(permKey, transmissionRsaPem, registrationTimestamp); ok {
+			return pub, nil
+		}
+	}
+
+	jww.INFO.Printf("Verifying perm sig with params:\n\tPubKey: %s\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n", base64.StdEncoding.EncodeToString(permKey), registrationTimestamp, privacy.Bytes(transmissionRsaPem), privacy.Bytes(registrarSig))
+	err := registration.VerifyWithTimestamp(permHost.GetPubKey(), registrationTimestamp,
+		string(transmissionRsaPem), registrarSig)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to verify permissioning signature")
+	}
+
+	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(transmissionRsaPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to unmarshal public key")
+	}
+
+	if nb.verifyCache != nil {
+		nb.verifyCache.add(permKey, transmissionRsaPem, registrationTimestamp, pub)
+	}
+	return pub, nil
+}
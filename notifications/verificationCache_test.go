@@ -0,0 +1,76 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/xx_network/crypto/csprng"
+	"strconv"
+	"testing"
+)
+
+// Tests that the least recently used entry is evicted once the cache is full.
+func TestVerificationCache_Eviction(t *testing.T) {
+	private, err := rsa.GetScheme().Generate(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to create private key: %+v", err)
+	}
+	pub := private.Public()
+	permKey := []byte("permKey")
+
+	vc := newVerificationCache(3)
+	for i := 0; i < 3; i++ {
+		vc.add(permKey, []byte("trsa"+strconv.Itoa(i)), int64(i), pub)
+	}
+
+	// Touch the oldest entry so the second becomes least recently used
+	received, ok := vc.get(permKey, []byte("trsa0"), 0)
+	if !ok {
+		t.Fatal("Failed to get cached entry")
+	}
+	if received != pub {
+		t.Error("Cached entry did not return the stored public key")
+	}
+
+	vc.add(permKey, []byte("trsa3"), 3, pub)
+
+	if _, ok = vc.get(permKey, []byte("trsa1"), 1); ok {
+		t.Error("Least recently used entry should have been evicted")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, ok = vc.get(permKey, []byte("trsa"+strconv.Itoa(i)), int64(i)); !ok {
+			t.Errorf("Entry %d should still be cached", i)
+		}
+	}
+
+	if _, ok = vc.get(permKey, []byte("trsa0"), 5); ok {
+		t.Error("Entry should not be found for a different registration timestamp")
+	}
+}
+
+// Tests that entries verified against an old permissioning key are dropped.
+func TestVerificationCache_PermKeyChange(t *testing.T) {
+	vc := newVerificationCache(10)
+	vc.add([]byte("permKey"), []byte("trsa"), 1, nil)
+
+	if _, ok := vc.get([]byte("permKey"), []byte("trsa"), 1); !ok {
+		t.Fatal("Failed to get cached entry")
+	}
+
+	if _, ok := vc.get([]byte("newPermKey"), []byte("trsa"), 1); ok {
+		t.Error("Entry should not be returned for a different permissioning key")
+	}
+
+	vc.add([]byte("newPermKey"), []byte("trsa2"), 1, nil)
+	if _, ok := vc.get([]byte("permKey"), []byte("trsa"), 1); ok {
+		t.Error("Entries should be cleared after permissioning key changes")
+	}
+	if vc.order.Len() != 1 || len(vc.entries) != 1 {
+		t.Errorf("Expected a single entry after permissioning key change, found %d", vc.order.Len())
+	}
+}
+
+// Tests that a non-positive size disables the cache.
+func TestNewVerificationCache_Disabled(t *testing.T) {
+	if newVerificationCache(0) != nil {
+		t.Error("Cache should be nil for a size of 0")
+	}
+}
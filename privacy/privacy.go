@@ -0,0 +1,93 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package privacy formats user identifiers for logging. When privacy mode is
+// enabled, device tokens, transmission RSA keys & hashes, intermediary IDs and
+// ephemeral IDs are replaced with salted, truncated digests, so log lines can
+// be correlated with each other but not with users.
+
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// digestLen is the number of bytes of the salted digest included in logs.
+const digestLen = 6
+
+// saltLen is the length of the randomly generated salt.
+const saltLen = 32
+
+// salt is the digest salt when privacy mode is enabled, or nil if disabled.
+var salt atomic.Pointer[[]byte]
+
+// Enable turns on privacy mode using the passed in salt. If salt is empty, a
+// random salt is generated, so digests only match within a single run.
+func Enable(s []byte) error {
+	if len(s) == 0 {
+		s = make([]byte, saltLen)
+		if _, err := rand.Read(s); err != nil {
+			return errors.WithMessage(err, "Failed to generate log digest salt")
+		}
+	}
+	salt.Store(&s)
+	return nil
+}
+
+// Disable turns off privacy mode.
+func Disable() {
+	salt.Store(nil)
+}
+
+// Enabled returns true if privacy mode is on.
+func Enabled() bool {
+	return salt.Load() != nil
+}
+
+// Bytes formats an identifier such as a transmission RSA hash or intermediary
+// ID for logging. It is base64 encoded unless privacy mode is enabled.
+func Bytes(b []byte) string {
+	if s := salt.Load(); s != nil {
+		return digest(*s, b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Token formats a device token for logging. It is returned as is unless
+// privacy mode is enabled.
+func Token(token string) string {
+	if s := salt.Load(); s != nil {
+		return digest(*s, []byte(token))
+	}
+	return token
+}
+
+// EphemeralID formats an ephemeral ID for logging. It is printed as a number
+// unless privacy mode is enabled.
+func EphemeralID(ephemeralId int64) string {
+	if s := salt.Load(); s != nil {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(ephemeralId))
+		return digest(*s, b)
+	}
+	return strconv.FormatInt(ephemeralId, 10)
+}
+
+// digest returns the truncated HMAC of b keyed with the salt.
+func digest(s, b []byte) string {
+	mac := hmac.New(sha256.New, s)
+	mac.Write(b)
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:digestLen])
+}
@@ -0,0 +1,64 @@
+package privacy
+
+import (
+	"strings"
+	"testing"
+)
+
+// Tests that identifiers are printed as is when privacy mode is disabled.
+func TestDisabled(t *testing.T) {
+	Disable()
+	if Enabled() {
+		t.Fatal("Privacy mode should be disabled")
+	}
+	if Token("fcm:token") != "fcm:token" {
+		t.Errorf("Token should not be changed, received %s", Token("fcm:token"))
+	}
+	if Bytes([]byte{1, 2, 3}) != "AQID" {
+		t.Errorf("Bytes should be base64 encoded, received %s", Bytes([]byte{1, 2, 3}))
+	}
+	if EphemeralID(-42) != "-42" {
+		t.Errorf("Ephemeral ID should be printed as a number, received %s", EphemeralID(-42))
+	}
+}
+
+// Tests that identifiers are replaced with consistent salted digests when
+// privacy mode is enabled.
+func TestEnabled(t *testing.T) {
+	defer Disable()
+	if err := Enable([]byte("salt")); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled() {
+		t.Fatal("Privacy mode should be enabled")
+	}
+
+	token := "fcm:token"
+	d := Token(token)
+	if strings.Contains(d, token) || !strings.HasPrefix(d, "h:") || len(d) != 2+2*digestLen {
+		t.Errorf("Unexpected token digest %s", d)
+	}
+	if Token(token) != d {
+		t.Error("Digest should be deterministic for the same salt")
+	}
+	if Bytes([]byte(token)) != d {
+		t.Error("Bytes & Token should produce the same digest for the same value")
+	}
+	if EphemeralID(-42) == "-42" {
+		t.Error("Ephemeral ID should be replaced with a digest")
+	}
+
+	if err := Enable([]byte("other salt")); err != nil {
+		t.Fatal(err)
+	}
+	if Token(token) == d {
+		t.Error("Digest should change with the salt")
+	}
+
+	if err := Enable(nil); err != nil {
+		t.Fatal(err)
+	}
+	if Token(token) == d {
+		t.Error("Random salt should not match the passed in salt")
+	}
+}
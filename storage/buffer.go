@@ -11,109 +11,260 @@ import (
 	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/primitives/notifications"
 	"gitlab.com/xx_network/primitives/id"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// BufferLimits bounds the notification data held in a NotificationBuffer.
+// When a limit is exceeded, the oldest rounds are evicted first. A zero value
+// disables the limit.
+type BufferLimits struct {
+	// Maximum number of notifications held across all rounds
+	MaxEntries int
+	// Maximum size in bytes of the notifications held across all rounds
+	MaxBytes int
+	// Maximum time a round is held before it is evicted
+	MaxAge time.Duration
+}
+
+// BufferStats reports the contents of a NotificationBuffer and the total
+// data evicted from it.
+type BufferStats struct {
+	Entries        int64
+	Bytes          int64
+	EvictedRounds  uint64
+	EvictedEntries uint64
+}
+
+// bufferedRound is the notification data for a round and when it was first added.
+type bufferedRound struct {
+	data  []*notifications.Data
+	added time.Time
+	bytes int64
+}
+
+// dataKey identifies a notification within a round for deduplication.
+type dataKey struct {
+	ephemeralID int64
+	messageHash string
+}
+
+// DataSize returns the approximate memory used by a notification, as counted
+// against byte limits.
+func DataSize(n *notifications.Data) int64 {
+	return int64(len(n.MessageHash) + len(n.IdentityFP) + 16)
+}
+
+// newBufferedRound returns a bufferedRound holding the passed in
+// notifications with any duplicates removed.
+func newBufferedRound(l []*notifications.Data) *bufferedRound {
+	br := &bufferedRound{added: time.Now()}
+	br.merge(l)
+	return br
+}
+
+// merge appends the passed in notifications which are not already held for
+// the round, keeping the first of any duplicates. It returns the number of
+// notifications and bytes added.
+func (br *bufferedRound) merge(l []*notifications.Data) (int64, int64) {
+	seen := make(map[dataKey]struct{}, len(br.data)+len(l))
+	for _, n := range br.data {
+		seen[dataKey{n.EphemeralID, string(n.MessageHash)}] = struct{}{}
+	}
+	var entries, bytes int64
+	for _, n := range l {
+		key := dataKey{n.EphemeralID, string(n.MessageHash)}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		br.data = append(br.data, n)
+		entries++
+		bytes += DataSize(n)
+	}
+	br.bytes += bytes
+	return entries, bytes
+}
+
+// bufferShards is the number of independently locked shards in a
+// NotificationBuffer. Rounds are assigned to shards by round ID, so gateways
+// adding different rounds rarely contend for the same lock.
+const bufferShards = 32
+
+// bufferShard holds the rounds assigned to one shard of a NotificationBuffer.
+type bufferShard struct {
+	mux    sync.Mutex
+	rounds map[id.Round]*bufferedRound
+}
+
 // NotificationBuffer struct holds notifications received by the bot that have yet to be sent
-// IT uses a sync.Map with a RWMutex to allow swapping maps for faster concurrent read/write access
-// Stores lowest and highest rounds to provide ordering when queried
+// Rounds are spread across shards, each with its own lock, and are only ordered when
+// the buffer is swapped or evicted, so the cost of either depends on the number of
+// rounds held and not on the distance between the lowest and highest round ID.
 type NotificationBuffer struct {
-	lock   sync.RWMutex
-	gr     *uint64
-	lr     *uint64
-	bufMap *sync.Map
+	shards    [bufferShards]bufferShard
+	limits    atomic.Pointer[BufferLimits]
+	evictLock sync.Mutex
+
+	entries        atomic.Int64
+	bytes          atomic.Int64
+	evictedRounds  atomic.Uint64
+	evictedEntries atomic.Uint64
 }
 
-// NewNotificationBuffer is the constructor for NotificationBuffers.  Initializes maps & sets initial atomic values
+// NewNotificationBuffer is the constructor for NotificationBuffers.  Initializes shards & sets empty limits
 func NewNotificationBuffer() *NotificationBuffer {
-	gr, lr := uint64(0), uint64(0)
-
-	nb := &NotificationBuffer{
-		bufMap: &sync.Map{},
-		gr:     &gr,
-		lr:     &lr,
+	nb := &NotificationBuffer{}
+	for i := range nb.shards {
+		nb.shards[i].rounds = make(map[id.Round]*bufferedRound)
 	}
+	nb.limits.Store(&BufferLimits{})
 	return nb
 }
 
-// Swap takes the write lock, replaces the current sync.Map and round values with new ones, and
-// (outside the lock) sorts the old map into a map[ephID][]*notifications.Data, where each ephID list is sorted by RID
-// NOTE THAT ANY UNSENT NOTIFICATIONS FROM SWAP MUST BE RE-ADDED TO THE BUFFER
-func (bnm *NotificationBuffer) Swap() map[int64][]*notifications.Data {
-	bnm.lock.Lock()
+// SetLimits sets the limits on the data held in the buffer.
+func (bnm *NotificationBuffer) SetLimits(limits BufferLimits) {
+	bnm.limits.Store(&limits)
+}
 
-	// Swap map & reset greatest and least rounds
-	var m *sync.Map
-	m, bnm.bufMap = bnm.bufMap, &sync.Map{}
-	lr := atomic.SwapUint64(bnm.lr, 0)
-	gr := atomic.SwapUint64(bnm.gr, 0)
+// Stats returns the current size of the buffer and the data evicted from it.
+func (bnm *NotificationBuffer) Stats() BufferStats {
+	return BufferStats{
+		Entries:        bnm.entries.Load(),
+		Bytes:          bnm.bytes.Load(),
+		EvictedRounds:  bnm.evictedRounds.Load(),
+		EvictedEntries: bnm.evictedEntries.Load(),
+	}
+}
+
+// shard returns the shard holding the passed in round.
+func (bnm *NotificationBuffer) shard(rid id.Round) *bufferShard {
+	return &bnm.shards[uint64(rid)%bufferShards]
+}
 
-	bnm.lock.Unlock()
+// roundEntry is a round taken from the buffer, used for sorting.
+type roundEntry struct {
+	rid id.Round
+	br  *bufferedRound
+}
 
-	outMap := make(map[int64][]*notifications.Data)
+// Swap replaces the rounds in each shard with an empty map and sorts the old rounds into a
+// map[ephID][]*notifications.Data, where each ephID list is sorted by RID.
+// Rounds held longer than the max age are evicted instead of returned.
+// NOTE THAT ANY UNSENT NOTIFICATIONS FROM SWAP MUST BE RE-ADDED TO THE BUFFER OR QUEUED
+func (bnm *NotificationBuffer) Swap() map[int64][]*notifications.Data {
+	var taken []roundEntry
+	for i := range bnm.shards {
+		sh := &bnm.shards[i]
+		sh.mux.Lock()
+		rounds := sh.rounds
+		sh.rounds = make(map[id.Round]*bufferedRound)
+		sh.mux.Unlock()
 
-	// Function originally used to range over sync.Map, now called in order by RID on entries using gr and lr
-	f := func(key, value interface{}) bool {
-		l := value.([]*notifications.Data)
-		for _, n := range l {
-			nSlice, exists := outMap[n.EphemeralID]
-			if exists {
-				nSlice = append(nSlice, n)
-			} else {
-				nSlice = []*notifications.Data{n}
-			}
-			outMap[n.EphemeralID] = nSlice
+		for rid, br := range rounds {
+			taken = append(taken, roundEntry{rid: rid, br: br})
+			bnm.entries.Add(-int64(len(br.data)))
+			bnm.bytes.Add(-br.bytes)
 		}
-		return true
 	}
 
-	// Iterate through seen rounds from least to greatest
-	for i := lr; i <= gr; i++ {
-		rid := id.Round(i)
-		nlist, ok := m.Load(rid)
-		if !ok {
-			jww.DEBUG.Printf("No notification data for round %+v", rid)
+	// Only the rounds present are sorted, from least to greatest
+	sort.Slice(taken, func(i, j int) bool { return taken[i].rid < taken[j].rid })
+
+	maxAge := bnm.limits.Load().MaxAge
+	now := time.Now()
+	outMap := make(map[int64][]*notifications.Data)
+	for _, e := range taken {
+		if maxAge > 0 && now.Sub(e.br.added) > maxAge {
+			bnm.recordEviction(e.rid, e.br, "max age")
 			continue
 		}
-		f(rid, nlist)
+		for _, n := range e.br.data {
+			outMap[n.EphemeralID] = append(outMap[n.EphemeralID], n)
+		}
 	}
 
 	return outMap
 }
 
 // Add accepts a list of notification data and an associated round ID
-// The list will be inserted to the current sync.Map under the given round ID
-// NOTE: THIS WILL OVERWRITE, SHOULD BE CALLED ONCE PER ROUND, OR AGAIN TO REPLACE OVERFLOW NOTIFICATIONS
+// The list is merged into any data already held for the round, dropping notifications
+// with the same ephemeral ID and message hash as one already held, so data for a round
+// may be added by several callers concurrently without loss.
+// If the buffer is then over its entry or byte limit, the oldest rounds are evicted.
 func (bnm *NotificationBuffer) Add(rid id.Round, l []*notifications.Data) {
-	bnm.lock.RLock()
-	defer bnm.lock.RUnlock()
+	sh := bnm.shard(rid)
+	sh.mux.Lock()
+	var entries, bytes int64
+	if br, ok := sh.rounds[rid]; ok {
+		entries, bytes = br.merge(l)
+	} else {
+		br = newBufferedRound(l)
+		sh.rounds[rid] = br
+		entries, bytes = int64(len(br.data)), br.bytes
+	}
+	sh.mux.Unlock()
 
-	// Update stored round IDs
-	bnm.updateRIDs(rid)
+	entries = bnm.entries.Add(entries)
+	bytes = bnm.bytes.Add(bytes)
 
-	// Store data for round
-	bnm.bufMap.Store(rid, l)
+	if bnm.overLimit(entries, bytes) {
+		bnm.evict()
+	}
+}
+
+// overLimit returns true if the passed in totals exceed the entry or byte limit.
+func (bnm *NotificationBuffer) overLimit(entries, bytes int64) bool {
+	limits := bnm.limits.Load()
+	return (limits.MaxEntries > 0 && entries > int64(limits.MaxEntries)) ||
+		(limits.MaxBytes > 0 && bytes > int64(limits.MaxBytes))
 }
 
-func (bnm *NotificationBuffer) updateRIDs(rid id.Round) {
-	flop := false
-	for flop == false {
-		gr := atomic.LoadUint64(bnm.gr)
-		if gr < uint64(rid) || gr == 0 {
-			flop = atomic.CompareAndSwapUint64(bnm.gr, gr, uint64(rid))
-		} else {
-			flop = true
+// evict removes rounds from least to greatest until the buffer is within its
+// entry and byte limits. Only one eviction runs at a time.
+func (bnm *NotificationBuffer) evict() {
+	bnm.evictLock.Lock()
+	defer bnm.evictLock.Unlock()
+
+	if !bnm.overLimit(bnm.entries.Load(), bnm.bytes.Load()) {
+		return
+	}
+
+	var rids []id.Round
+	for i := range bnm.shards {
+		sh := &bnm.shards[i]
+		sh.mux.Lock()
+		for rid := range sh.rounds {
+			rids = append(rids, rid)
 		}
+		sh.mux.Unlock()
 	}
-	flop = false
-
-	for flop == false {
-		lr := atomic.LoadUint64(bnm.lr)
-		if lr > uint64(rid) || lr == 0 {
-			flop = atomic.CompareAndSwapUint64(bnm.lr, lr, uint64(rid))
-		} else {
-			flop = true
+	sort.Slice(rids, func(i, j int) bool { return rids[i] < rids[j] })
+
+	for _, rid := range rids {
+		if !bnm.overLimit(bnm.entries.Load(), bnm.bytes.Load()) {
+			return
+		}
+		sh := bnm.shard(rid)
+		sh.mux.Lock()
+		br, ok := sh.rounds[rid]
+		delete(sh.rounds, rid)
+		sh.mux.Unlock()
+		if !ok {
+			continue
 		}
+		bnm.entries.Add(-int64(len(br.data)))
+		bnm.bytes.Add(-br.bytes)
+		bnm.recordEviction(rid, br, "size limit")
 	}
 }
+
+// recordEviction counts and logs the eviction of a round from the buffer.
+func (bnm *NotificationBuffer) recordEviction(rid id.Round, br *bufferedRound, reason string) {
+	rounds := bnm.evictedRounds.Add(1)
+	entries := bnm.evictedEntries.Add(uint64(len(br.data)))
+	jww.WARN.Printf("Evicted %d notifications for round %d from the notification buffer (%s); "+
+		"%d rounds and %d notifications evicted in total", len(br.data), rid, reason, rounds, entries)
+}
@@ -12,6 +12,8 @@ import (
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -82,3 +84,278 @@ func TestNotificationBuffer_Sorting(t *testing.T) {
 		}
 	}
 }
+
+// newTestBufferData returns n notifications for a round with 32 byte message
+// hashes and 25 byte identity fingerprints.
+func newTestBufferData(rid uint64, n int) []*notifications.Data {
+	data := make([]*notifications.Data, n)
+	for i := range data {
+		data[i] = &notifications.Data{
+			EphemeralID: int64(i),
+			RoundID:     rid,
+			MessageHash: make([]byte, 32),
+			IdentityFP:  make([]byte, 25),
+		}
+	}
+	return data
+}
+
+// Tests that the oldest rounds are evicted once the entry limit is exceeded.
+func TestNotificationBuffer_MaxEntries(t *testing.T) {
+	nb := NewNotificationBuffer()
+	nb.SetLimits(BufferLimits{MaxEntries: 10})
+
+	nb.Add(5, newTestBufferData(5, 4))
+	nb.Add(3, newTestBufferData(3, 4))
+	nb.Add(7, newTestBufferData(7, 4))
+
+	stats := nb.Stats()
+	if stats.Entries != 8 || stats.EvictedRounds != 1 || stats.EvictedEntries != 4 {
+		t.Errorf("Unexpected stats after eviction: %+v", stats)
+	}
+	for _, l := range nb.Swap() {
+		for _, n := range l {
+			if n.RoundID == 3 {
+				t.Errorf("Oldest round should have been evicted")
+			}
+		}
+	}
+
+	// Adding a round's data again should not count it twice
+	nb.Add(9, newTestBufferData(9, 6))
+	nb.Add(9, newTestBufferData(9, 6))
+	if stats = nb.Stats(); stats.Entries != 6 || stats.EvictedRounds != 1 {
+		t.Errorf("Unexpected stats after replacing round: %+v", stats)
+	}
+}
+
+// Tests that the oldest rounds are evicted once the byte limit is exceeded.
+func TestNotificationBuffer_MaxBytes(t *testing.T) {
+	nb := NewNotificationBuffer()
+	size := int(DataSize(newTestBufferData(0, 1)[0]))
+	nb.SetLimits(BufferLimits{MaxBytes: 5 * size})
+
+	nb.Add(1, newTestBufferData(1, 3))
+	nb.Add(2, newTestBufferData(2, 3))
+	stats := nb.Stats()
+	if stats.Bytes != int64(3*size) || stats.EvictedEntries != 3 {
+		t.Errorf("Unexpected stats after eviction: %+v", stats)
+	}
+	if out := nb.Swap(); len(out) != 3 || out[0][0].RoundID != 2 {
+		t.Errorf("Expected only round 2 to remain: %+v", out)
+	}
+	if stats = nb.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("Swap should reset buffer size: %+v", stats)
+	}
+}
+
+// Tests that Swap evicts rounds held longer than the max age.
+func TestNotificationBuffer_MaxAge(t *testing.T) {
+	nb := NewNotificationBuffer()
+	nb.SetLimits(BufferLimits{MaxAge: 50 * time.Millisecond})
+
+	nb.Add(1, newTestBufferData(1, 2))
+	time.Sleep(100 * time.Millisecond)
+	nb.Add(2, newTestBufferData(2, 1))
+
+	out := nb.Swap()
+	if len(out) != 1 || out[0][0].RoundID != 2 {
+		t.Errorf("Expected only round 2 to be returned: %+v", out)
+	}
+	if stats := nb.Stats(); stats.EvictedRounds != 1 || stats.EvictedEntries != 2 {
+		t.Errorf("Unexpected stats after eviction: %+v", stats)
+	}
+}
+
+// Tests that a stale low round and a much higher round are returned in order
+// without walking the round IDs between them.
+func TestNotificationBuffer_SparseRounds(t *testing.T) {
+	nb := NewNotificationBuffer()
+	nb.Add(1, newTestBufferData(1, 1))
+	nb.Add(50_000_000, newTestBufferData(50_000_000, 1))
+	nb.Add(1_000, newTestBufferData(1_000, 1))
+
+	start := time.Now()
+	out := nb.Swap()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Swap took %s", elapsed)
+	}
+	l := out[0]
+	if len(l) != 3 || l[0].RoundID != 1 || l[1].RoundID != 1_000 || l[2].RoundID != 50_000_000 {
+		t.Errorf("Rounds not returned in order: %+v", l)
+	}
+}
+
+// Tests that notifications added concurrently with Swap are all returned by
+// one of the swaps, and that the buffer size is tracked correctly.
+func TestNotificationBuffer_ConcurrentAdd(t *testing.T) {
+	nb := NewNotificationBuffer()
+	const gateways, rounds = 16, 200
+
+	var wg sync.WaitGroup
+	for g := 0; g < gateways; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				rid := uint64(g*rounds + r + 1)
+				nb.Add(id.Round(rid), newTestBufferData(rid, 2))
+			}
+		}(g)
+	}
+
+	received := 0
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		for _, l := range nb.Swap() {
+			received += len(l)
+		}
+	}
+
+	if expected := gateways * rounds * 2; received != expected {
+		t.Errorf("Received %d notifications, expected %d", received, expected)
+	}
+	if stats := nb.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("Buffer should be empty: %+v", stats)
+	}
+}
+
+// BenchmarkNotificationBuffer_Add measures Add throughput with many gateways
+// adding distinct rounds concurrently.
+func BenchmarkNotificationBuffer_Add(b *testing.B) {
+	nb := NewNotificationBuffer()
+	data := newTestBufferData(0, 10)
+	var next uint64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nb.Add(id.Round(atomic.AddUint64(&next, 1)), data)
+		}
+	})
+}
+
+// BenchmarkNotificationBuffer_AddSwap measures Add throughput while the
+// sender swaps the buffer concurrently.
+func BenchmarkNotificationBuffer_AddSwap(b *testing.B) {
+	nb := NewNotificationBuffer()
+	data := newTestBufferData(0, 10)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				nb.Swap()
+			}
+		}
+	}()
+	defer close(stop)
+
+	var next uint64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nb.Add(id.Round(atomic.AddUint64(&next, 1)), data)
+		}
+	})
+}
+
+// BenchmarkNotificationBuffer_SwapSparse measures Swap with a stale low round
+// and a high new round, which previously walked every round ID between them.
+func BenchmarkNotificationBuffer_SwapSparse(b *testing.B) {
+	nb := NewNotificationBuffer()
+	low, high := newTestBufferData(1, 10), newTestBufferData(10_000_000, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nb.Add(1, low)
+		nb.Add(10_000_000, high)
+		nb.Swap()
+	}
+}
+
+// Tests that adding to a round which already holds data merges the two,
+// dropping notifications with the same ephemeral ID and message hash.
+func TestNotificationBuffer_Add_Merge(t *testing.T) {
+	nb := NewNotificationBuffer()
+	n := func(eid int64, hash string) *notifications.Data {
+		return &notifications.Data{EphemeralID: eid, RoundID: 1, MessageHash: []byte(hash), IdentityFP: []byte("fp")}
+	}
+
+	nb.Add(1, []*notifications.Data{n(1, "a"), n(1, "b"), n(1, "a")})
+	nb.Add(1, []*notifications.Data{n(1, "b"), n(1, "c"), n(2, "a")})
+
+	if stats := nb.Stats(); stats.Entries != 4 {
+		t.Errorf("Expected 4 entries after merge, got %+v", stats)
+	}
+	out := nb.Swap()
+	if len(out[1]) != 3 || string(out[1][0].MessageHash) != "a" ||
+		string(out[1][1].MessageHash) != "b" || string(out[1][2].MessageHash) != "c" {
+		t.Errorf("Unexpected notifications for ephemeral ID 1: %+v", out[1])
+	}
+	if len(out[2]) != 1 {
+		t.Errorf("Same message hash for a different ephemeral ID should be kept: %+v", out[2])
+	}
+}
+
+// Tests that receiving a round's data while unsent data for the same round is
+// added back loses nothing and duplicates nothing.
+func TestNotificationBuffer_Add_ReceiveRequeueRace(t *testing.T) {
+	const rounds, perRound = 50, 20
+	for iteration := 0; iteration < 20; iteration++ {
+		nb := NewNotificationBuffer()
+		received := make(map[uint64][]*notifications.Data)
+		for r := uint64(1); r <= rounds; r++ {
+			for i := 0; i < perRound; i++ {
+				hash := make([]byte, 32)
+				rand.Read(hash)
+				received[r] = append(received[r], &notifications.Data{
+					EphemeralID: int64(i % 3), RoundID: r, MessageHash: hash, IdentityFP: make([]byte, 25),
+				})
+			}
+		}
+
+		var wg sync.WaitGroup
+		for r, l := range received {
+			wg.Add(2)
+			// A gateway reports the second half of the round
+			go func(r uint64, l []*notifications.Data) {
+				defer wg.Done()
+				nb.Add(id.Round(r), l[perRound/2:])
+			}(r, l)
+			// Unsent notifications from the first half, with some overlap,
+			// are added back
+			go func(r uint64, l []*notifications.Data) {
+				defer wg.Done()
+				nb.Add(id.Round(r), l[:perRound/2+2])
+			}(r, l)
+		}
+		wg.Wait()
+
+		seen := make(map[string]bool)
+		total := 0
+		for _, l := range nb.Swap() {
+			for _, n := range l {
+				if seen[string(n.MessageHash)] {
+					t.Fatalf("Duplicate notification for round %d", n.RoundID)
+				}
+				seen[string(n.MessageHash)] = true
+				total++
+			}
+		}
+		if total != rounds*perRound {
+			t.Fatalf("Expected %d notifications, got %d", rounds*perRound, total)
+		}
+	}
+}
@@ -8,21 +8,113 @@
 package storage
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const postgresConnectString = "host=%s port=%s user=%s dbname=%s sslmode=disable"
 const sqliteDatabasePath = "file:%s?mode=memory&cache=shared"
 
-// interface declaration for storage methods
-type database interface {
+// SQLiteInMemory is the SQLitePath which selects an in-memory SQLite
+// database. Its data is lost when the process exits.
+const SQLiteInMemory = ":memory:"
+
+// sqliteFilePath is the DSN of an on-disk SQLite database. The options apply
+// to every connection in the pool: the write-ahead log lets readers proceed
+// during a write, the busy timeout makes a connection wait for a lock instead
+// of failing, and immediate transactions take the write lock up front so
+// concurrent transactions do not deadlock upgrading their locks.
+const sqliteFilePath = "file:%s?_busy_timeout=%d&_journal_mode=WAL&_foreign_keys=on&_synchronous=NORMAL&_txlock=immediate"
+
+// Defaults for the on-disk SQLite database
+const (
+	defaultSQLiteBusyTimeout        = 5 * time.Second
+	defaultSQLiteCheckpointInterval = 5 * time.Minute
+)
+
+// Defaults for the database connection pool
+const (
+	defaultMaxIdleConns    = 10
+	defaultMaxOpenConns    = 50
+	defaultConnMaxIdleTime = 10 * time.Minute
+	defaultConnMaxLifetime = 12 * time.Hour
+)
+
+// defaultSSLMode is the Postgres sslmode used if none is configured.
+const defaultSSLMode = "disable"
+
+// sslModes are the accepted Postgres sslmode values.
+var sslModes = map[string]bool{
+	"disable": true, "allow": true, "prefer": true,
+	"require": true, "verify-ca": true, "verify-full": true,
+}
+
+// DatabaseParams holds the parameters of the SQL database. If PostgresDSN, or
+// Address and Port, are set, Postgres is used. Otherwise, a SQLite database is
+// kept in the file at SQLitePath. If SQLitePath is SQLiteInMemory, an
+// in-memory SQLite database named Name is used; its data is lost when the
+// process exits, so it is only meant for tests. With none of them set, the
+// database cannot be opened.
+type DatabaseParams struct {
+	Username string
+	Password string
+	Name     string
+	Address  string
+	Port     string
+
+	// Full Postgres connection string, either as key=value pairs or as a
+	// postgres:// URL. If set, it is used as is in place of the connection,
+	// TLS, statement timeout and application name parameters.
+	PostgresDSN string
+	// Postgres sslmode: disable, allow, prefer, require, verify-ca or
+	// verify-full. Defaults to disable.
+	SSLMode string
+	// Paths of the CA certificate the server's certificate is verified with,
+	// and of the client certificate and key presented to the server
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// Longest a Postgres statement may run before it is cancelled; 0 uses
+	// the server's setting
+	StatementTimeout time.Duration
+	// Name reported to Postgres for the connections
+	ApplicationName string
+
+	// Connection pool limits. Zero values use the defaults of 10 idle and 50
+	// open connections, closed after 10m idle or 12h in use.
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxIdleTime time.Duration
+	ConnMaxLifetime time.Duration
+
+	// Path of the SQLite database file, created if it does not exist, or
+	// SQLiteInMemory
+	SQLitePath string
+	// How long a SQLite connection waits for a lock held by another before
+	// failing. Defaults to 5s.
+	SQLiteBusyTimeout time.Duration
+	// How often the SQLite write-ahead log is copied into the database file
+	// and truncated. Defaults to 5m.
+	SQLiteCheckpointInterval time.Duration
+}
+
+// Database is the SQL side of Storage, which holds users, tokens and
+// identities. DatabaseImpl is its gorm implementation.
+type Database interface {
+	Close() error
+
 	UpsertState(state *State) error
 	GetStateValue(key string) (string, error)
 
@@ -30,33 +122,53 @@ type database interface {
 	GetUser(transmissionRsaHash []byte) (*User, error)
 	deleteUser(transmissionRsaHash []byte) error
 	GetAllUsers() ([]*User, error)
+	getUsersAfter(after []byte, limit int) ([]*User, error)
+	updateTransmissionRSAs(transmissionRSAs map[string][]byte) error
 
 	registerTrackedIdentity(user User, identity Identity) error
-	registerTrackedIdentities(user User, ids []Identity) error
+	registerTrackedIdentitiesBulk(u *User, ids []Identity, ephemerals map[string][]*Ephemeral) (map[string]bool, error)
+	untrackIdentities(transmissionRsaHash []byte, iids [][]byte) ([][]byte, error)
 
 	GetIdentity(iid []byte) (*Identity, error)
 	insertIdentity(identity *Identity) error
 	getIdentitiesByOffset(offset int64) ([]*Identity, error)
+	getIdentitiesAfter(after []byte, limit int) ([]*Identity, error)
 	GetOrphanedIdentities() ([]*Identity, error)
 
 	insertEphemeral(ephemeral *Ephemeral) error
+	insertEphemerals(ephemerals []*Ephemeral) error
 	GetEphemeral(ephemeralId int64) ([]*Ephemeral, error)
+	getEphemerals(ephemeralIds []int64) ([]*Ephemeral, error)
+	getEphemeralIdentities(iids [][]byte) ([][]byte, error)
+	deleteIdentityEphemerals(iids [][]byte) error
 	GetLatestEphemeral() (*Ephemeral, error)
 	DeleteOldEphemerals(currentEpoch int32) error
 	GetToNotify(ephemeralIds []int64) ([]GTNResult, error)
+	getToNotifyRows(ephemeralIds []int64) ([]toNotifyRow, error)
+	getIdentityTokens(iids [][]byte) ([]toNotifyRow, error)
+	GetRandomTokens(n int) ([]GTNResult, error)
 
 	insertToken(token Token) error
 	DeleteToken(token string) error
+	getTokensAfter(after string, limit int) ([]Token, error)
+	replaceTokens(tokens map[string]Token) error
 
 	unregisterIdentities(u *User, iids []Identity) error
 	unregisterTokens(u *User, tokens []Token) error
 	registerForNotifications(u *User, identity Identity, token Token) error
 	LegacyUnregister(iid []byte) error
+
+	insertRequestSignature(sig *RequestSignature) (bool, error)
+	DeleteExpiredRequestSignatures(t time.Time) error
 }
 
 // DatabaseImpl is a struct which implements database on an underlying gorm.DB
 type DatabaseImpl struct {
 	db *gorm.DB // Stored database connection
+
+	// Closed to stop the background tasks of the database
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // State table
@@ -75,10 +187,15 @@ type UserV1 struct {
 	Ephemerals          []Ephemeral `gorm:"foreignKey:transmission_rsa_hash;references:transmission_rsa_hash;constraint:OnDelete:CASCADE;"`
 }
 
+// Token is a device token registered to a user. When encryption is enabled,
+// Token holds the token's blind index and EncryptedToken holds the token.
+// Sample is a random key cover traffic targets are drawn by.
 type Token struct {
 	Token               string `gorm:"primaryKey"`
 	App                 string
 	TransmissionRSAHash []byte `gorm:"not null;references users(transmission_rsa_hash)"`
+	EncryptedToken      []byte
+	Sample              int64 `gorm:"not null;default:0;index"`
 }
 
 type User struct {
@@ -100,6 +217,18 @@ type User struct {
 // "fk_user_identities_identity" FOREIGN KEY (identity_intermediary_id) REFERENCES identities(intermediary_id)
 // "fk_user_identities_user" FOREIGN KEY (user_transmission_rsa_hash) REFERENCES users(transmission_rsa_hash)
 
+// userIdentity is a row in the user_identities join table, used for batched inserts.
+type userIdentity struct {
+	UserTransmissionRSAHash []byte
+	IdentityIntermediaryId  []byte
+}
+
+// TableName sets the table for userIdentity to the many2many join table
+// created for User.Identities.
+func (userIdentity) TableName() string {
+	return "user_identities"
+}
+
 type Identity struct {
 	IntermediaryId []byte      `gorm:"primaryKey"`
 	OffsetNum      int64       `gorm:"not null; index"`
@@ -107,44 +236,90 @@ type Identity struct {
 	Ephemerals     []Ephemeral `gorm:"foreignKey:intermediary_id;references:intermediary_id;constraint:OnDelete:CASCADE;"`
 }
 
+// Ephemeral is an ephemeral ID tracked for an identity. Each is stored once
+// per identity and epoch; inserting it again has no effect.
 type Ephemeral struct {
 	ID             uint   `gorm:"primaryKey"`
-	IntermediaryId []byte `gorm:"not null;references identities(intermediary_id)"`
-	EphemeralId    int64  `gorm:"not null; index"`
-	Epoch          int32  `gorm:"not null; index"`
+	IntermediaryId []byte `gorm:"not null;references identities(intermediary_id);uniqueIndex:idx_ephemeral_unique"`
+	EphemeralId    int64  `gorm:"not null; index; uniqueIndex:idx_ephemeral_unique"`
+	Epoch          int32  `gorm:"not null; index; uniqueIndex:idx_ephemeral_unique"`
+}
+
+// ephemeralUniqueIndex is the unique index on the intermediary ID, ephemeral
+// ID and epoch of an Ephemeral.
+const ephemeralUniqueIndex = "idx_ephemeral_unique"
+
+// RequestSignature holds the hash of a signed request's signature until it
+// expires, allowing replayed requests to be rejected.
+type RequestSignature struct {
+	Hash   []byte    `gorm:"primaryKey"`
+	Expiry time.Time `gorm:"not null; index"`
 }
 
 // Initialize the database interface with database backend
 // Returns a database interface, close function, and error
+// Without an address, an in-memory database is used.
 func newDatabase(username, password, dbName, address,
-	port string) (database, error) {
+	port string) (Database, error) {
+	params := DatabaseParams{
+		Username: username,
+		Password: password,
+		Name:     dbName,
+		Address:  address,
+		Port:     port,
+	}
+	if address == "" {
+		params.SQLitePath = SQLiteInMemory
+	}
+	return openDatabase(params)
+}
+
+// openDatabase initializes the database interface with the backend selected
+// by the passed in parameters.
+func openDatabase(params DatabaseParams) (Database, error) {
 	var err error
 	var db *gorm.DB
 	var dialector gorm.Dialector
 	// Connect to the database if the correct information is provided
-	usePostgres := address != "" && port != ""
+	usePostgres := params.PostgresDSN != "" || (params.Address != "" && params.Port != "")
+	useSQLiteFile := !usePostgres && params.SQLitePath != "" && params.SQLitePath != SQLiteInMemory
 	if usePostgres {
 		// Create the database connection
-		connectString := fmt.Sprintf(
-			postgresConnectString,
-			address, port, username, dbName)
-		// Handle empty database password
-		if len(password) > 0 {
-			connectString += fmt.Sprintf(" password=%s", password)
+		connectString, err := postgresDSN(params)
+		if err != nil {
+			return nil, err
 		}
 		dialector = postgres.Open(connectString)
-	} else {
-		jww.WARN.Printf("Database backend connection information not provided")
-		temporaryDbPath := fmt.Sprintf(sqliteDatabasePath, dbName)
+	} else if useSQLiteFile {
+		busyTimeout := params.SQLiteBusyTimeout
+		if busyTimeout <= 0 {
+			busyTimeout = defaultSQLiteBusyTimeout
+		}
+		err = os.MkdirAll(filepath.Dir(params.SQLitePath), 0700)
+		if err != nil {
+			return nil, errors.Errorf("Unable to create directory for sqlite database %s: %+v", params.SQLitePath, err)
+		}
+		jww.INFO.Printf("Using sqlite database at %s", params.SQLitePath)
+		dialector = sqlite.Open(fmt.Sprintf(sqliteFilePath, params.SQLitePath, busyTimeout.Milliseconds()))
+	} else if params.SQLitePath == SQLiteInMemory {
+		jww.WARN.Printf("Using an in-memory database; all registrations will be lost when the server stops")
+		temporaryDbPath := fmt.Sprintf(sqliteDatabasePath, params.Name)
 		dialector = sqlite.Open(temporaryDbPath)
+	} else {
+		return nil, errors.Errorf("No database configured: set a postgres address or DSN, "+
+			"or a sqlite path (%q for an in-memory database)", SQLiteInMemory)
 	}
 
-	// Create the database connection
+	// Create the database connection. In privacy mode, query parameters such
+	// as tokens and hashes are left out of the query log.
 	db, err = gorm.Open(dialector, &gorm.Config{
-		Logger: logger.New(jww.TRACE, logger.Config{LogLevel: logger.Info}),
+		Logger: logger.New(jww.TRACE, logger.Config{
+			LogLevel:             logger.Info,
+			ParameterizedQueries: privacy.Enabled(),
+		}),
 	})
 	if err != nil {
-		return nil, errors.Errorf("Unable to initialize in-memory sqlite database backend: %+v", err)
+		return nil, errors.Errorf("Unable to initialize database backend: %+v", err)
 	}
 
 	if !usePostgres {
@@ -165,17 +340,30 @@ func newDatabase(username, password, dbName, address,
 		return nil, errors.Errorf("Unable to configure database connection pool: %+v", err)
 	}
 	// SetMaxIdleConns sets the maximum number of connections in the idle connection pool.
-	sqlDb.SetMaxIdleConns(10)
+	sqlDb.SetMaxIdleConns(orDefault(params.MaxIdleConns, defaultMaxIdleConns))
 	// SetMaxOpenConns sets the maximum number of open connections to the Database.
-	sqlDb.SetMaxOpenConns(50)
+	sqlDb.SetMaxOpenConns(orDefault(params.MaxOpenConns, defaultMaxOpenConns))
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be idle.
-	sqlDb.SetConnMaxIdleTime(10 * time.Minute)
+	sqlDb.SetConnMaxIdleTime(orDefault(params.ConnMaxIdleTime, defaultConnMaxIdleTime))
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
-	sqlDb.SetConnMaxLifetime(12 * time.Hour)
+	sqlDb.SetConnMaxLifetime(orDefault(params.ConnMaxLifetime, defaultConnMaxLifetime))
+
+	// Databases created before the unique index on ephemerals may hold
+	// duplicates, which must be removed before the index can be built
+	if db.Migrator().HasTable(&Ephemeral{}) && !db.Migrator().HasIndex(&Ephemeral{}, ephemeralUniqueIndex) {
+		res := db.Exec("DELETE FROM ephemerals WHERE id NOT IN " +
+			"(SELECT MIN(id) FROM ephemerals GROUP BY intermediary_id, ephemeral_id, epoch)")
+		if res.Error != nil {
+			return nil, errors.Errorf("Failed to remove duplicate ephemerals: %+v", res.Error)
+		}
+		if res.RowsAffected > 0 {
+			jww.INFO.Printf("Removed %d duplicate ephemerals", res.RowsAffected)
+		}
+	}
 
 	// Initialize the database schema
 	// WARNING: Order is important. Do not change without database testing
-	models := []interface{}{&Token{}, &User{}, &Identity{}, &Ephemeral{}, &State{}}
+	models := []interface{}{&Token{}, &User{}, &Identity{}, &Ephemeral{}, &State{}, &RequestSignature{}}
 	for _, model := range models {
 		err = db.AutoMigrate(model)
 		if err != nil {
@@ -185,9 +373,136 @@ func newDatabase(username, password, dbName, address,
 
 	// Build the interface
 	di := &DatabaseImpl{
-		db: db,
+		db:   db,
+		stop: make(chan struct{}),
+	}
+
+	// Tokens stored before sample keys were added are given one
+	if err = di.assignTokenSamples(); err != nil {
+		return nil, err
+	}
+
+	if useSQLiteFile {
+		interval := params.SQLiteCheckpointInterval
+		if interval <= 0 {
+			interval = defaultSQLiteCheckpointInterval
+		}
+		go di.checkpointer(interval)
 	}
 
 	jww.INFO.Println("Database backend initialized successfully!")
-	return database(di), nil
+	return Database(di), nil
+}
+
+// postgresDSN returns the Postgres connection string for the passed in
+// parameters. A configured DSN is returned as is; otherwise one is built from
+// the connection, TLS, statement timeout and application name parameters.
+func postgresDSN(params DatabaseParams) (string, error) {
+	if params.PostgresDSN != "" {
+		return params.PostgresDSN, nil
+	}
+
+	sslMode := params.SSLMode
+	if sslMode == "" {
+		sslMode = defaultSSLMode
+	}
+	if !sslModes[sslMode] {
+		return "", errors.Errorf("Invalid postgres sslmode %q", sslMode)
+	}
+
+	pairs := [][2]string{
+		{"host", params.Address},
+		{"port", params.Port},
+		{"user", params.Username},
+		{"dbname", params.Name},
+		{"password", params.Password},
+		{"sslmode", sslMode},
+		{"sslrootcert", params.SSLRootCert},
+		{"sslcert", params.SSLCert},
+		{"sslkey", params.SSLKey},
+		{"application_name", params.ApplicationName},
+	}
+	if params.StatementTimeout > 0 {
+		pairs = append(pairs, [2]string{"statement_timeout",
+			strconv.FormatInt(params.StatementTimeout.Milliseconds(), 10)})
+	}
+
+	// Unset parameters are left out
+	var dsn []string
+	for _, p := range pairs {
+		if p[1] != "" {
+			dsn = append(dsn, p[0]+"="+quoteDSNValue(p[1]))
+		}
+	}
+	return strings.Join(dsn, " "), nil
+}
+
+// quoteDSNValue quotes a value in a key=value Postgres connection string if it
+// is empty or holds spaces, quotes or backslashes.
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " '\\") {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// orDefault returns v, or def if v is not positive.
+func orDefault[T int | time.Duration](v, def T) T {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// checkpointer periodically copies the SQLite write-ahead log into the
+// database file and truncates it, so the log does not grow without bound
+// while readers keep the automatic checkpoints from completing. It returns
+// when the database is closed.
+func (d *DatabaseImpl) checkpointer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if err := d.checkpoint(); err != nil {
+				jww.WARN.Printf("Failed to checkpoint sqlite database: %+v", err)
+			}
+		}
+	}
+}
+
+// Close stops the background tasks of the database and closes its
+// connections. Calls after the first do nothing.
+func (d *DatabaseImpl) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		var sqlDb *sql.DB
+		sqlDb, err = d.db.DB()
+		if err == nil {
+			err = sqlDb.Close()
+		}
+	})
+	return err
+}
+
+// checkpoint copies the SQLite write-ahead log into the database file and
+// truncates it. If readers are still using the log, it is copied as far as
+// possible and truncated on a later checkpoint.
+func (d *DatabaseImpl) checkpoint() error {
+	var busy, logFrames, checkpointed int
+	err := d.db.Raw("PRAGMA wal_checkpoint(TRUNCATE)").Row().Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		jww.DEBUG.Printf("Sqlite checkpoint was blocked; %d of %d frames checkpointed", checkpointed, logFrames)
+	} else {
+		jww.TRACE.Printf("Sqlite checkpoint complete")
+	}
+	return nil
 }
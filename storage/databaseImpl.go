@@ -10,13 +10,34 @@
 package storage
 
 import (
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/binary"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"sync"
+	"time"
 )
 
+// bulkInsertBatchSize is the number of rows written per statement in batched inserts.
+const bulkInsertBatchSize = 100
+
+// ephemeralInsertBatchSize is the number of ephemerals written per INSERT when
+// generating ephemerals for an offset. Each row uses three parameters, keeping
+// a batch well under the parameter limits of both Postgres and SQLite.
+const ephemeralInsertBatchSize = 1000
+
+// toNotifyChunkSize is the number of ephemeral IDs passed to each query when
+// looking up the tokens to notify, keeping it well under the parameter limits
+// of Postgres (65535) and SQLite (32766).
+const toNotifyChunkSize = 10000
+
+// toNotifyConcurrency is the number of chunks of ephemeral IDs looked up at
+// once.
+const toNotifyConcurrency = 4
+
 // UpsertState inserts the given State into Storage if it does not exist,
 // or updates the Database State if its value does not match the given State.
 func (d *DatabaseImpl) UpsertState(state *State) error {
@@ -66,7 +87,7 @@ func (d *DatabaseImpl) deleteUser(transmissionRsaHash []byte) error {
 		TransmissionRSAHash: transmissionRsaHash,
 	}).Error
 	if err != nil {
-		return errors.Errorf("Failed to delete user with tRSA hash %s: %+v", transmissionRsaHash, err)
+		return errors.Errorf("Failed to delete user with tRSA hash %s: %+v", privacy.Bytes(transmissionRsaHash), err)
 	}
 	return nil
 }
@@ -77,6 +98,29 @@ func (d *DatabaseImpl) GetAllUsers() ([]*User, error) {
 	return dest, d.db.Find(&dest).Error
 }
 
+// getUsersAfter returns up to limit users whose primary key sorts after the
+// passed in value, in primary key order. Associations are not loaded.
+func (d *DatabaseImpl) getUsersAfter(after []byte, limit int) ([]*User, error) {
+	var result []*User
+	err := d.db.Where("transmission_rsa_hash > ?", after).Order("transmission_rsa_hash").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// updateTransmissionRSAs sets the transmission RSA of each user keyed by its
+// transmission RSA hash in the passed in map, in a single transaction.
+func (d *DatabaseImpl) updateTransmissionRSAs(transmissionRSAs map[string][]byte) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for transmissionRsaHash, transmissionRSA := range transmissionRSAs {
+			err := tx.Model(&User{}).Where("transmission_rsa_hash = ?", []byte(transmissionRsaHash)).
+				Update("transmission_rsa", transmissionRSA).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to update transmission RSA")
+			}
+		}
+		return nil
+	})
+}
+
 // GetIdentity retrieves an Identity from storage by primary key.
 func (d *DatabaseImpl) GetIdentity(iid []byte) (*Identity, error) {
 	i := &Identity{}
@@ -97,7 +141,16 @@ func (d *DatabaseImpl) insertIdentity(identity *Identity) error {
 // getIdentitiesByOffset returns a list of all identities with the given offset.
 func (d *DatabaseImpl) getIdentitiesByOffset(offset int64) ([]*Identity, error) {
 	var result []*Identity
-	err := d.db.Where(&Identity{OffsetNum: offset}).Find(&result).Error
+	// A struct condition would ignore an offset of zero and match every identity
+	err := d.db.Where("offset_num = ?", offset).Find(&result).Error
+	return result, err
+}
+
+// getIdentitiesAfter returns up to limit identities whose primary key sorts
+// after the passed in value, in primary key order. Associations are not loaded.
+func (d *DatabaseImpl) getIdentitiesAfter(after []byte, limit int) ([]*Identity, error) {
+	var result []*Identity
+	err := d.db.Where("intermediary_id > ?", after).Order("intermediary_id").Limit(limit).Find(&result).Error
 	return result, err
 }
 
@@ -107,9 +160,16 @@ func (d *DatabaseImpl) GetOrphanedIdentities() ([]*Identity, error) {
 	return dest, d.db.Find(&dest, "NOT EXISTS (select * from ephemerals where ephemerals.intermediary_id = identities.intermediary_id)").Error
 }
 
-// insertEphemeral inserts an Ephemeral into storage.
+// insertEphemeral inserts an Ephemeral into storage. Inserting an ephemeral
+// which is already stored has no effect.
 func (d *DatabaseImpl) insertEphemeral(ephemeral *Ephemeral) error {
-	return d.db.Create(&ephemeral).Error
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ephemeral).Error
+}
+
+// insertEphemerals inserts a list of Ephemerals into storage in batches, in a
+// single transaction. Ephemerals which are already stored are skipped.
+func (d *DatabaseImpl) insertEphemerals(ephemerals []*Ephemeral) error {
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(ephemerals, ephemeralInsertBatchSize).Error
 }
 
 // GetEphemeral retrieves a list of ephemerals with the given ID.
@@ -125,12 +185,41 @@ func (d *DatabaseImpl) GetEphemeral(ephemeralId int64) ([]*Ephemeral, error) {
 	return result, nil
 }
 
+// getEphemerals retrieves the ephemerals with any of the passed in IDs.
+func (d *DatabaseImpl) getEphemerals(ephemeralIds []int64) ([]*Ephemeral, error) {
+	return queryChunked(ephemeralIds, func(chunk []int64) ([]*Ephemeral, error) {
+		var result []*Ephemeral
+		err := d.db.Where("ephemeral_id IN ?", chunk).Find(&result).Error
+		return result, err
+	})
+}
+
+// getEphemeralIdentities returns those of the passed in intermediary IDs which
+// have at least one ephemeral.
+func (d *DatabaseImpl) getEphemeralIdentities(iids [][]byte) ([][]byte, error) {
+	return queryChunked(iids, func(chunk [][]byte) ([][]byte, error) {
+		var result [][]byte
+		err := d.db.Model(&Ephemeral{}).Distinct().Where("intermediary_id IN ?", chunk).
+			Pluck("intermediary_id", &result).Error
+		return result, err
+	})
+}
+
+// deleteIdentityEphemerals deletes all ephemerals of the passed in identities.
+func (d *DatabaseImpl) deleteIdentityEphemerals(iids [][]byte) error {
+	if len(iids) == 0 {
+		return nil
+	}
+	return d.db.Where("intermediary_id IN ?", iids).Delete(&Ephemeral{}).Error
+}
+
 // GTNResult is a type wrapping the custom query for GetToNotify.
 type GTNResult struct {
 	Token               string
 	App                 string
 	TransmissionRSAHash []byte
 	EphemeralId         int64
+	EncryptedToken      []byte
 }
 
 // The following struct can be used to scan in the intermediary result tables t1 and t2
@@ -150,17 +239,188 @@ type GTNResult struct {
 //}
 
 // GetToNotify returns a list of GTNResult data matching the list of ephemeral IDs passed in.
+// Long lists are looked up in concurrent chunks.
 func (d *DatabaseImpl) GetToNotify(ephemeralIds []int64) ([]GTNResult, error) {
+	return queryChunked(ephemeralIds, d.getToNotifyChunk)
+}
+
+// getToNotifyChunk runs the GetToNotify query for a list of ephemeral IDs
+// short enough to pass as query parameters.
+func (d *DatabaseImpl) getToNotifyChunk(ephemeralIds []int64) ([]GTNResult, error) {
 	var result []GTNResult
 	err := d.db.Transaction(func(tx *gorm.DB) error {
 		t1 := tx.Table("identities").Select("ephemerals.ephemeral_id, identities.intermediary_id").Joins("inner join ephemerals on ephemerals.intermediary_id = identities.intermediary_id").Where("ephemerals.ephemeral_id in ?", ephemeralIds)
 		t2 := tx.Table("user_identities").Select("t1.ephemeral_id, user_identities.user_transmission_rsa_hash as transmission_rsa_hash").Joins("right join (?) as t1 on t1.intermediary_id = user_identities.identity_intermediary_id", t1)
 		t3 := tx.Model(&User{}).Select("users.transmission_rsa_hash, t2.ephemeral_id").Joins("right join (?) as t2 on users.transmission_rsa_hash = t2.transmission_rsa_hash", t2)
-		return tx.Model(&Token{}).Distinct().Select("tokens.token, tokens.app, t3.transmission_rsa_hash, t3.ephemeral_id").Joins("right join (?) as t3 on tokens.transmission_rsa_hash = t3.transmission_rsa_hash", t3).Scan(&result).Error
+		return tx.Model(&Token{}).Distinct().Select("tokens.token, tokens.app, tokens.encrypted_token, t3.transmission_rsa_hash, t3.ephemeral_id").Joins("right join (?) as t3 on tokens.transmission_rsa_hash = t3.transmission_rsa_hash", t3).Scan(&result).Error
+	})
+	return result, err
+}
+
+// getToNotifyRows returns the rows of GetToNotify for the list of ephemeral
+// IDs passed in, along with the intermediary ID and epoch of the ephemeral
+// each row matched. Long lists are looked up in concurrent chunks.
+func (d *DatabaseImpl) getToNotifyRows(ephemeralIds []int64) ([]toNotifyRow, error) {
+	return queryChunked(ephemeralIds, d.getToNotifyRowsChunk)
+}
+
+// getToNotifyRowsChunk runs the getToNotifyRows query for a list of ephemeral
+// IDs short enough to pass as query parameters.
+func (d *DatabaseImpl) getToNotifyRowsChunk(ephemeralIds []int64) ([]toNotifyRow, error) {
+	var result []toNotifyRow
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		t1 := tx.Table("identities").Select("ephemerals.ephemeral_id, ephemerals.epoch, identities.intermediary_id").Joins("inner join ephemerals on ephemerals.intermediary_id = identities.intermediary_id").Where("ephemerals.ephemeral_id in ?", ephemeralIds)
+		t2 := tx.Table("user_identities").Select("t1.ephemeral_id, t1.epoch, t1.intermediary_id, user_identities.user_transmission_rsa_hash as transmission_rsa_hash").Joins("right join (?) as t1 on t1.intermediary_id = user_identities.identity_intermediary_id", t1)
+		t3 := tx.Model(&User{}).Select("users.transmission_rsa_hash, t2.ephemeral_id, t2.epoch, t2.intermediary_id").Joins("right join (?) as t2 on users.transmission_rsa_hash = t2.transmission_rsa_hash", t2)
+		return tx.Model(&Token{}).Distinct().Select("tokens.token, tokens.app, tokens.encrypted_token, t3.transmission_rsa_hash, t3.ephemeral_id, t3.epoch, t3.intermediary_id").Joins("right join (?) as t3 on tokens.transmission_rsa_hash = t3.transmission_rsa_hash", t3).Scan(&result).Error
 	})
 	return result, err
 }
 
+// getIdentityTokens returns a row for each token of each user registered to
+// one of the passed in intermediary IDs, holding the token and the
+// intermediary ID. The ephemeral ID and epoch of the rows are not set.
+func (d *DatabaseImpl) getIdentityTokens(iids [][]byte) ([]toNotifyRow, error) {
+	return queryChunked(iids, func(chunk [][]byte) ([]toNotifyRow, error) {
+		var result []toNotifyRow
+		err := d.db.Model(&Token{}).Distinct().Select("tokens.token, tokens.app, tokens.encrypted_token, tokens.transmission_rsa_hash, user_identities.identity_intermediary_id as intermediary_id").
+			Joins("inner join user_identities on user_identities.user_transmission_rsa_hash = tokens.transmission_rsa_hash").
+			Where("user_identities.identity_intermediary_id IN ?", chunk).Scan(&result).Error
+		return result, err
+	})
+}
+
+// queryChunked runs a query over a list of IDs in chunks of toNotifyChunkSize,
+// up to toNotifyConcurrency at a time, and merges the results. Each ID is in
+// exactly one chunk, so results which are distinct per ID remain distinct.
+func queryChunked[K, T any](ids []K, query func([]K) ([]T, error)) ([]T, error) {
+	if len(ids) <= toNotifyChunkSize {
+		return query(ids)
+	}
+
+	numChunks := (len(ids) + toNotifyChunkSize - 1) / toNotifyChunkSize
+	results := make([][]T, numChunks)
+	errs := make([]error, numChunks)
+	limit := make(chan struct{}, toNotifyConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < numChunks; i++ {
+		start := i * toNotifyChunkSize
+		end := start + toNotifyChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, chunk []K) {
+			defer wg.Done()
+			results[i], errs[i] = query(chunk)
+			<-limit
+		}(i, ids[start:end])
+	}
+	wg.Wait()
+
+	var merged []T
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errors.WithMessagef(errs[i], "Failed to look up chunk %d of %d", i+1, numChunks)
+		}
+		merged = append(merged, results[i]...)
+	}
+	return merged, nil
+}
+
+// tokenSampleColumns are the columns of a token read for cover traffic.
+const tokenSampleColumns = "token, app, encrypted_token, transmission_rsa_hash"
+
+// GetRandomTokens returns up to n registered tokens chosen at random, without
+// ephemeral IDs. It is used to pick the targets of cover traffic. Each token
+// is the first at or after a random sample key, found through the index on
+// the keys, so the table is not scanned. If that does not find n distinct
+// tokens, the rest are taken in key order from a random point.
+func (d *DatabaseImpl) GetRandomTokens(n int) ([]GTNResult, error) {
+	seen := make(map[string]bool, n)
+	results := make([]GTNResult, 0, n)
+	addUnseen := func(rows []GTNResult) {
+		for _, r := range rows {
+			if len(results) < n && !seen[r.Token] {
+				seen[r.Token] = true
+				results = append(results, r)
+			}
+		}
+	}
+
+	for attempts := 0; attempts < 2*n && len(results) < n; attempts++ {
+		rows, err := d.tokensFromSample(randomTokenSample(), 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			return results, nil
+		}
+		addUnseen(rows)
+	}
+	if len(results) < n {
+		rows, err := d.tokensFromSample(randomTokenSample(), n+len(results))
+		if err != nil {
+			return nil, err
+		}
+		addUnseen(rows)
+	}
+	return results, nil
+}
+
+// tokensFromSample returns up to limit tokens in sample key order, starting
+// from the passed in key and wrapping around to the lowest key.
+func (d *DatabaseImpl) tokensFromSample(sample int64, limit int) ([]GTNResult, error) {
+	var result []GTNResult
+	err := d.db.Model(&Token{}).Select(tokenSampleColumns).Where("sample >= ?", sample).
+		Order("sample").Limit(limit).Scan(&result).Error
+	if err != nil || len(result) == limit {
+		return result, err
+	}
+	var wrapped []GTNResult
+	err = d.db.Model(&Token{}).Select(tokenSampleColumns).Where("sample < ?", sample).
+		Order("sample").Limit(limit - len(result)).Scan(&wrapped).Error
+	return append(result, wrapped...), err
+}
+
+// assignTokenSamples gives a random sample key to each token which does not
+// have one, in batches.
+func (d *DatabaseImpl) assignTokenSamples() error {
+	for {
+		var tokens []string
+		err := d.db.Model(&Token{}).Where("sample = 0").Limit(bulkInsertBatchSize).Pluck("token", &tokens).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to find tokens without a sample key")
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+		err = d.db.Transaction(func(tx *gorm.DB) error {
+			for _, t := range tokens {
+				err := tx.Model(&Token{}).Where("token = ?", t).Update("sample", randomTokenSample()).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.WithMessage(err, "Failed to assign token sample keys")
+		}
+	}
+}
+
+// randomTokenSample returns a random, positive token sample key. Zero marks
+// a token without one.
+func randomTokenSample() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		jww.FATAL.Panicf("Failed to read random bytes: %+v", err)
+	}
+	return int64(binary.BigEndian.Uint64(b[:])>>1) | 1
+}
+
 // DeleteOldEphemerals deletes all ephemerals from storage with an epoch before the passed in value.
 func (d *DatabaseImpl) DeleteOldEphemerals(currentEpoch int32) error {
 	res := d.db.Where("epoch < ?", currentEpoch).Delete(&Ephemeral{})
@@ -296,25 +556,199 @@ func (d *DatabaseImpl) LegacyUnregister(iid []byte) error {
 	})
 }
 
+// untrackIdentities removes the links between a user and the passed in
+// identities in a single transaction. Identities which are no longer linked to
+// any user are deleted along with their ephemerals. It returns the
+// intermediary IDs of the deleted identities.
+func (d *DatabaseImpl) untrackIdentities(transmissionRsaHash []byte, iids [][]byte) ([][]byte, error) {
+	var deleted [][]byte
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_transmission_rsa_hash = ? AND identity_intermediary_id IN ?", transmissionRsaHash, iids).
+			Delete(&userIdentity{}).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to delete identity links")
+		}
+		deleted, err = deleteUnlinkedIdentities(tx, iids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// deleteUnlinkedIdentities deletes those of the passed in identities which are
+// not linked to any user, along with their ephemerals. It returns the
+// intermediary IDs of the deleted identities.
+func deleteUnlinkedIdentities(tx *gorm.DB, iids [][]byte) ([][]byte, error) {
+	if len(iids) == 0 {
+		return nil, nil
+	}
+	var unlinked [][]byte
+	err := tx.Model(&Identity{}).Where("intermediary_id IN ?", iids).
+		Where("NOT EXISTS (select * from user_identities where user_identities.identity_intermediary_id = identities.intermediary_id)").
+		Pluck("intermediary_id", &unlinked).Error
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to find orphaned identities")
+	}
+	if len(unlinked) == 0 {
+		return nil, nil
+	}
+	err = tx.Where("intermediary_id IN ?", unlinked).Delete(&Ephemeral{}).Error
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to delete ephemerals")
+	}
+	err = tx.Where("intermediary_id IN ?", unlinked).Delete(&Identity{}).Error
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to delete identities")
+	}
+	return unlinked, nil
+}
+
 // insertToken adds a token to storage.
 func (d *DatabaseImpl) insertToken(token Token) error {
 	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&token).Error
 }
 
+// getTokensAfter returns up to limit tokens whose primary key sorts after the
+// passed in value, in primary key order.
+func (d *DatabaseImpl) getTokensAfter(after string, limit int) ([]Token, error) {
+	var result []Token
+	err := d.db.Where("token > ?", after).Order("token").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// replaceTokens rewrites each token stored under a key in the passed in map
+// with its value in a single transaction. If the primary key changes, the old
+// row is deleted and the new row inserted.
+func (d *DatabaseImpl) replaceTokens(tokens map[string]Token) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for oldKey, t := range tokens {
+			if oldKey == t.Token {
+				err := tx.Model(&Token{}).Where("token = ?", oldKey).
+					Update("encrypted_token", t.EncryptedToken).Error
+				if err != nil {
+					return errors.WithMessage(err, "Failed to update token")
+				}
+				continue
+			}
+			err := tx.Where("token = ?", oldKey).Delete(&Token{}).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to delete token")
+			}
+			t := t
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&t).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to insert token")
+			}
+		}
+		return nil
+	})
+}
+
 // registerTrackedIdentity links an Identity to a User.
 func (d *DatabaseImpl) registerTrackedIdentity(user User, identity Identity) error {
 	return d.db.Model(&user).Association("Identities").Append(&identity)
 }
 
-func (d *DatabaseImpl) registerTrackedIdentities(user User, ids []Identity) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
-		for _, iid := range ids {
-			err := tx.Model(&user).Association("Identities").Append(&iid)
+// registerTrackedIdentitiesBulk links the passed in identities to a user in a
+// single transaction. The user and any identities not yet in storage are
+// created, along with the passed in ephemerals for new identities. It returns
+// the set of intermediary IDs which were already linked to the user.
+func (d *DatabaseImpl) registerTrackedIdentitiesBulk(u *User, ids []Identity, ephemerals map[string][]*Ephemeral) (map[string]bool, error) {
+	alreadyTracked := make(map[string]bool)
+	if len(ids) == 0 {
+		return alreadyTracked, nil
+	}
+
+	iids := make([][]byte, len(ids))
+	for i := range ids {
+		iids[i] = ids[i].IntermediaryId
+	}
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(u).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to insert user")
+		}
+
+		var existing [][]byte
+		err = tx.Model(&Identity{}).Where("intermediary_id IN ?", iids).Pluck("intermediary_id", &existing).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to look up existing identities")
+		}
+		existingSet := make(map[string]bool, len(existing))
+		for _, iid := range existing {
+			existingSet[string(iid)] = true
+		}
+
+		var newIds []Identity
+		var newEphemerals []*Ephemeral
+		for _, identity := range ids {
+			if existingSet[string(identity.IntermediaryId)] {
+				continue
+			}
+			newIds = append(newIds, identity)
+			newEphemerals = append(newEphemerals, ephemerals[string(identity.IntermediaryId)]...)
+		}
+		if len(newIds) > 0 {
+			err = tx.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(newIds, bulkInsertBatchSize).Error
+			if err != nil {
+				return errors.WithMessage(err, "Failed to insert identities")
+			}
+		}
+		if len(newEphemerals) > 0 {
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(newEphemerals, bulkInsertBatchSize).Error
 			if err != nil {
-				return errors.WithMessagef(err, "Failed to register identity %s to user with transmission RSA hash %s",
-					base64.StdEncoding.EncodeToString(iid.IntermediaryId), base64.StdEncoding.EncodeToString(user.TransmissionRSAHash))
+				return errors.WithMessage(err, "Failed to insert ephemerals")
+			}
+		}
+
+		var linked [][]byte
+		err = tx.Model(&userIdentity{}).Where("user_transmission_rsa_hash = ? AND identity_intermediary_id IN ?",
+			u.TransmissionRSAHash, iids).Pluck("identity_intermediary_id", &linked).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to look up tracked identities")
+		}
+		for _, iid := range linked {
+			alreadyTracked[string(iid)] = true
+		}
+
+		var links []userIdentity
+		for _, iid := range iids {
+			if !alreadyTracked[string(iid)] {
+				links = append(links, userIdentity{
+					UserTransmissionRSAHash: u.TransmissionRSAHash,
+					IdentityIntermediaryId:  iid,
+				})
+			}
+		}
+		if len(links) > 0 {
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(links, bulkInsertBatchSize).Error
+			if err != nil {
+				return errors.WithMessagef(err, "Failed to register identities to user with transmission RSA hash %s",
+					privacy.Bytes(u.TransmissionRSAHash))
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return alreadyTracked, nil
+}
+
+// insertRequestSignature adds a RequestSignature to storage.
+// It returns false if the signature hash was already present.
+func (d *DatabaseImpl) insertRequestSignature(sig *RequestSignature) (bool, error) {
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(sig)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteExpiredRequestSignatures deletes all request signatures which expired before the passed in time.
+func (d *DatabaseImpl) DeleteExpiredRequestSignatures(t time.Time) error {
+	return d.db.Where("expiry < ?", t).Delete(&RequestSignature{}).Error
 }
@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"gitlab.com/elixxir/crypto/hash"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/xx_network/crypto/csprng"
@@ -10,7 +11,9 @@ import (
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"gorm.io/gorm"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDatabaseImpl_UpsertState(t *testing.T) {
@@ -411,6 +414,22 @@ func TestDatabaseImpl_insertEphemeral(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Inserting the same ephemeral again has no effect
+	err = db.insertEphemeral(&Ephemeral{
+		IntermediaryId: identity.IntermediaryId,
+		EphemeralId:    123,
+		Epoch:          123,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eList, err := db.GetEphemeral(123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eList) != 1 {
+		t.Fatalf("Expected 1 ephemeral after duplicate insert, found %d", len(eList))
+	}
 }
 
 func TestDatabaseImpl_GetEphemeral(t *testing.T) {
@@ -1034,3 +1053,226 @@ func generateTestUser(t *testing.T) *User {
 	}
 	return u
 }
+
+func TestDatabaseImpl_DeleteExpiredRequestSignatures(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_DeleteExpiredRequestSignatures", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := &RequestSignature{Hash: []byte("expired"), Expiry: now.Add(-time.Minute)}
+	active := &RequestSignature{Hash: []byte("active"), Expiry: now.Add(time.Minute)}
+	for _, sig := range []*RequestSignature{expired, active} {
+		inserted, err := db.insertRequestSignature(sig)
+		if err != nil {
+			t.Fatalf("Failed to insert request signature: %+v", err)
+		}
+		if !inserted {
+			t.Fatalf("Request signature %s should have been inserted", sig.Hash)
+		}
+	}
+
+	err = db.DeleteExpiredRequestSignatures(now)
+	if err != nil {
+		t.Fatalf("Failed to delete expired request signatures: %+v", err)
+	}
+
+	inserted, err := db.insertRequestSignature(&RequestSignature{Hash: expired.Hash, Expiry: expired.Expiry})
+	if err != nil {
+		t.Fatalf("Failed to reinsert expired signature: %+v", err)
+	}
+	if !inserted {
+		t.Error("Expired signature should have been deleted")
+	}
+	inserted, err = db.insertRequestSignature(&RequestSignature{Hash: active.Hash, Expiry: active.Expiry})
+	if err != nil {
+		t.Fatalf("Failed to reinsert active signature: %+v", err)
+	}
+	if inserted {
+		t.Error("Active signature should not have been deleted")
+	}
+}
+
+// Tests that GetToNotify and getToNotifyRows look up more ephemeral IDs than
+// Postgres or SQLite accept as parameters to one query, finding matches in
+// every chunk.
+func TestDatabaseImpl_GetToNotify_Chunked(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_GetToNotify_Chunked", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ephemeralIds := make([]int64, 70000)
+	for i := range ephemeralIds {
+		ephemeralIds[i] = int64(i)
+	}
+
+	// Register a token for an ephemeral ID in the first, a middle and the
+	// last chunk
+	expected := map[int64]string{
+		5:                            "apnstoken01",
+		3*toNotifyChunkSize + 5:      "apnstoken02",
+		int64(len(ephemeralIds)) - 1: "apnstoken03",
+	}
+	for eid, token := range expected {
+		identity := generateTestIdentity(t)
+		u := generateTestUser(t)
+		if err = db.insertUser(u); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.insertIdentity(&identity); err != nil {
+			t.Fatal(err)
+		}
+		err = db.registerForNotifications(u, identity, Token{
+			Token:               token,
+			App:                 constants.MessengerIOS.String(),
+			TransmissionRSAHash: u.TransmissionRSAHash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.insertEphemeral(&Ephemeral{
+			IntermediaryId: identity.IntermediaryId,
+			EphemeralId:    eid,
+			Epoch:          1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := db.GetToNotify(ephemeralIds)
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d: %+v", len(expected), len(results), results)
+	}
+	for _, r := range results {
+		if expected[r.EphemeralId] != r.Token {
+			t.Errorf("Unexpected token %q for ephemeral ID %d", r.Token, r.EphemeralId)
+		}
+	}
+
+	rows, err := db.getToNotifyRows(ephemeralIds)
+	if err != nil {
+		t.Fatalf("Failed to get rows to notify: %+v", err)
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %d: %+v", len(expected), len(rows), rows)
+	}
+	for _, r := range rows {
+		if expected[r.EphemeralId] != r.Token || r.Epoch != 1 {
+			t.Errorf("Unexpected row for ephemeral ID %d: %+v", r.EphemeralId, r)
+		}
+	}
+}
+
+// Tests that assignTokenSamples gives every token a sample key, and that
+// GetRandomTokens returns distinct tokens, all of them if fewer than requested
+// are registered.
+func TestDatabaseImpl_GetRandomTokens(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_GetRandomTokens", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numTokens = 5
+	for i := 0; i < numTokens; i++ {
+		identity := generateTestIdentity(t)
+		u := generateTestUser(t)
+		if err = db.insertUser(u); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.insertIdentity(&identity); err != nil {
+			t.Fatal(err)
+		}
+		err = db.registerForNotifications(u, identity, Token{
+			Token:               fmt.Sprintf("apnstoken%02d", i),
+			App:                 constants.MessengerIOS.String(),
+			TransmissionRSAHash: u.TransmissionRSAHash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	di := db.(*DatabaseImpl)
+	if err = di.db.Model(&Token{}).Where("1 = 1").Update("sample", 0).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err = di.assignTokenSamples(); err != nil {
+		t.Fatalf("Failed to assign token samples: %+v", err)
+	}
+	var unsampled int64
+	if err = di.db.Model(&Token{}).Where("sample = 0").Count(&unsampled).Error; err != nil {
+		t.Fatal(err)
+	}
+	if unsampled != 0 {
+		t.Fatalf("%d tokens were not assigned a sample key", unsampled)
+	}
+
+	for _, n := range []int{1, 3, numTokens, 2 * numTokens} {
+		results, err := db.GetRandomTokens(n)
+		if err != nil {
+			t.Fatalf("Failed to get %d random tokens: %+v", n, err)
+		}
+		expected := n
+		if expected > numTokens {
+			expected = numTokens
+		}
+		if len(results) != expected {
+			t.Errorf("Expected %d random tokens, got %d: %+v", expected, len(results), results)
+		}
+		seen := make(map[string]bool)
+		for _, r := range results {
+			if seen[r.Token] {
+				t.Errorf("Token %q returned more than once", r.Token)
+			}
+			seen[r.Token] = true
+		}
+	}
+}
+
+// Tests that queryChunked splits a list into chunks of at most
+// toNotifyChunkSize, covering each ephemeral ID once, and returns any error.
+func TestQueryChunked(t *testing.T) {
+	ephemeralIds := make([]int64, 2*toNotifyChunkSize+1)
+	for i := range ephemeralIds {
+		ephemeralIds[i] = int64(i)
+	}
+
+	var mux sync.Mutex
+	chunks := 0
+	results, err := queryChunked(ephemeralIds, func(chunk []int64) ([]int64, error) {
+		mux.Lock()
+		chunks++
+		mux.Unlock()
+		if len(chunk) > toNotifyChunkSize {
+			t.Errorf("Chunk of %d exceeds the chunk size", len(chunk))
+		}
+		return chunk, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 3 {
+		t.Errorf("Expected 3 chunks, got %d", chunks)
+	}
+	for i, eid := range results {
+		if eid != int64(i) {
+			t.Fatalf("Result %d is ephemeral ID %d; results should keep their order", i, eid)
+		}
+	}
+
+	_, err = queryChunked(ephemeralIds, func(chunk []int64) ([]int64, error) {
+		if chunk[0] == toNotifyChunkSize {
+			return nil, errors.New("chunk failed")
+		}
+		return chunk, nil
+	})
+	if err == nil {
+		t.Errorf("Expected error from a failed chunk")
+	}
+}
@@ -0,0 +1,307 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles encryption & decryption of values passing through Storage
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// defaultMigrationBatchSize is the number of rows read per query by MigrateEncryption.
+const defaultMigrationBatchSize = 500
+
+// EnableEncryption sets the FieldEncryptor used to encrypt tokens and
+// transmission RSA keys written to storage. It must be called before storage
+// is used. Rows written before encryption was enabled remain readable and are
+// encrypted by MigrateEncryption.
+func (s *Storage) EnableEncryption(fe *FieldEncryptor) {
+	s.encryptor = fe
+}
+
+// sealToken builds the Token row for the passed in values, replacing the
+// token with its blind index and encrypting it if encryption is enabled.
+func (s *Storage) sealToken(token, app string, transmissionRSAHash []byte) (Token, error) {
+	t := Token{
+		Token:               token,
+		App:                 app,
+		TransmissionRSAHash: transmissionRSAHash,
+		Sample:              randomTokenSample(),
+	}
+	if s.encryptor == nil {
+		return t, nil
+	}
+	encrypted, err := s.encryptor.encrypt([]byte(token), tokenLabel, transmissionRSAHash)
+	if err != nil {
+		return Token{}, errors.WithMessage(err, "Failed to encrypt token")
+	}
+	t.Token = s.encryptor.blindIndex(token)
+	t.EncryptedToken = encrypted
+	return t, nil
+}
+
+// sealTransmissionRSA encrypts a transmission RSA key if encryption is enabled.
+func (s *Storage) sealTransmissionRSA(transmissionRSA, transmissionRSAHash []byte) ([]byte, error) {
+	if s.encryptor == nil {
+		return transmissionRSA, nil
+	}
+	encrypted, err := s.encryptor.encrypt(transmissionRSA, transmissionRSALabel, transmissionRSAHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to encrypt transmission RSA")
+	}
+	return encrypted, nil
+}
+
+// tokenKeys returns the primary keys a token may be stored under: its blind
+// index, and the token itself for rows which have not yet been migrated.
+func (s *Storage) tokenKeys(token string) []string {
+	if s.encryptor == nil {
+		return []string{token}
+	}
+	return []string{s.encryptor.blindIndex(token), token}
+}
+
+// openToken returns the plaintext of a token read from storage.
+func (s *Storage) openToken(token string, encryptedToken, transmissionRSAHash []byte) (string, error) {
+	if len(encryptedToken) == 0 {
+		return token, nil
+	}
+	if s.encryptor == nil {
+		return "", errors.New("Found encrypted token but no encryption key file is configured")
+	}
+	plaintext, err := s.encryptor.decrypt(encryptedToken, tokenLabel, transmissionRSAHash)
+	if err != nil {
+		return "", errors.WithMessage(err, "Failed to decrypt token")
+	}
+	return string(plaintext), nil
+}
+
+// openTransmissionRSA returns the plaintext of a transmission RSA key read from storage.
+func (s *Storage) openTransmissionRSA(transmissionRSA, transmissionRSAHash []byte) ([]byte, error) {
+	if !isEncrypted(transmissionRSA) {
+		return transmissionRSA, nil
+	}
+	if s.encryptor == nil {
+		return nil, errors.New("Found encrypted transmission RSA but no encryption key file is configured")
+	}
+	plaintext, err := s.encryptor.decrypt(transmissionRSA, transmissionRSALabel, transmissionRSAHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to decrypt transmission RSA")
+	}
+	return plaintext, nil
+}
+
+// openUser decrypts the transmission RSA and tokens of a user in place.
+// The decrypted user must not be written back to storage.
+func (s *Storage) openUser(u *User) error {
+	var err error
+	u.TransmissionRSA, err = s.openTransmissionRSA(u.TransmissionRSA, u.TransmissionRSAHash)
+	if err != nil {
+		return err
+	}
+	for i := range u.Tokens {
+		t := &u.Tokens[i]
+		t.Token, err = s.openToken(t.Token, t.EncryptedToken, t.TransmissionRSAHash)
+		if err != nil {
+			return err
+		}
+		t.EncryptedToken = nil
+	}
+	return nil
+}
+
+// GetUser retrieves a user from storage with the passed in key, decrypting
+// its transmission RSA and tokens.
+func (s *Storage) GetUser(transmissionRSAHash []byte) (*User, error) {
+	u, err := s.Database.GetUser(transmissionRSAHash)
+	if err != nil {
+		return nil, err
+	}
+	return u, s.openUser(u)
+}
+
+// GetAllUsers returns a list of all users in storage, with their transmission
+// RSA decrypted.
+func (s *Storage) GetAllUsers() ([]*User, error) {
+	users, err := s.Database.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if err = s.openUser(u); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// GetIdentity retrieves an Identity from storage by primary key, decrypting
+// the transmission RSA of its users.
+func (s *Storage) GetIdentity(iid []byte) (*Identity, error) {
+	i, err := s.Database.GetIdentity(iid)
+	if err != nil {
+		return nil, err
+	}
+	for j := range i.Users {
+		if err = s.openUser(&i.Users[j]); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// GetToNotify returns a list of GTNResult data matching the list of ephemeral
+// IDs passed in, with each token decrypted. If the token cache is enabled,
+// only ephemeral IDs which are not cached are read from the database.
+func (s *Storage) GetToNotify(ephemeralIds []int64) ([]GTNResult, error) {
+	var results []GTNResult
+	var err error
+	if s.tokenCache != nil {
+		results, err = s.getToNotifyCached(ephemeralIds)
+	} else if s.ephemeralsInDatabase() {
+		results, err = s.Database.GetToNotify(ephemeralIds)
+	} else {
+		var rows []toNotifyRow
+		rows, err = s.toNotifyRows(ephemeralIds)
+		results = distinctResults(rows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, s.openResults(results)
+}
+
+// GetRandomTokens returns up to n registered tokens chosen at random, with
+// each token decrypted.
+func (s *Storage) GetRandomTokens(n int) ([]GTNResult, error) {
+	results, err := s.Database.GetRandomTokens(n)
+	if err != nil {
+		return nil, err
+	}
+	return results, s.openResults(results)
+}
+
+// openResults decrypts the tokens of a list of GTNResult in place.
+func (s *Storage) openResults(results []GTNResult) error {
+	var err error
+	for i := range results {
+		r := &results[i]
+		r.Token, err = s.openToken(r.Token, r.EncryptedToken, r.TransmissionRSAHash)
+		if err != nil {
+			return err
+		}
+		r.EncryptedToken = nil
+	}
+	return nil
+}
+
+// DeleteToken deletes the given token from storage.
+func (s *Storage) DeleteToken(token string) error {
+	keys := s.tokenKeys(token)
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateTokens(keys...)
+	for _, key := range keys {
+		if err := s.Database.DeleteToken(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptionMigrationStats reports the rows rewritten by MigrateEncryption.
+type EncryptionMigrationStats struct {
+	Tokens           int
+	TransmissionRSAs int
+}
+
+// MigrateEncryption encrypts every token and transmission RSA which is
+// stored in plaintext or under a key other than the active key, reading
+// batchSize rows at a time. It is safe to run repeatedly and alongside a
+// running server.
+func (s *Storage) MigrateEncryption(batchSize int) (EncryptionMigrationStats, error) {
+	var stats EncryptionMigrationStats
+	if s.encryptor == nil {
+		return stats, errors.New("Encryption must be enabled to migrate")
+	}
+	if batchSize <= 0 {
+		batchSize = defaultMigrationBatchSize
+	}
+	defer s.tokenCache.clear()
+
+	after := ""
+	for {
+		tokens, err := s.getTokensAfter(after, batchSize)
+		if err != nil {
+			return stats, errors.WithMessage(err, "Failed to read tokens")
+		}
+		if len(tokens) == 0 {
+			break
+		}
+		after = tokens[len(tokens)-1].Token
+
+		replaced := make(map[string]Token)
+		for _, t := range tokens {
+			if len(t.EncryptedToken) > 0 && !s.encryptor.needsRotation(t.EncryptedToken) {
+				continue
+			}
+			plaintext, err := s.openToken(t.Token, t.EncryptedToken, t.TransmissionRSAHash)
+			if err != nil {
+				return stats, err
+			}
+			sealed, err := s.sealToken(plaintext, t.App, t.TransmissionRSAHash)
+			if err != nil {
+				return stats, err
+			}
+			replaced[t.Token] = sealed
+		}
+		if len(replaced) > 0 {
+			if err = s.replaceTokens(replaced); err != nil {
+				return stats, errors.WithMessage(err, "Failed to write encrypted tokens")
+			}
+			stats.Tokens += len(replaced)
+			jww.INFO.Printf("Encrypted %d tokens", stats.Tokens)
+		}
+	}
+
+	afterHash := []byte{}
+	for {
+		users, err := s.getUsersAfter(afterHash, batchSize)
+		if err != nil {
+			return stats, errors.WithMessage(err, "Failed to read users")
+		}
+		if len(users) == 0 {
+			break
+		}
+		afterHash = users[len(users)-1].TransmissionRSAHash
+
+		updated := make(map[string][]byte)
+		for _, u := range users {
+			if !s.encryptor.needsRotation(u.TransmissionRSA) {
+				continue
+			}
+			plaintext, err := s.openTransmissionRSA(u.TransmissionRSA, u.TransmissionRSAHash)
+			if err != nil {
+				return stats, err
+			}
+			updated[string(u.TransmissionRSAHash)], err = s.sealTransmissionRSA(plaintext, u.TransmissionRSAHash)
+			if err != nil {
+				return stats, err
+			}
+		}
+		if len(updated) > 0 {
+			if err = s.updateTransmissionRSAs(updated); err != nil {
+				return stats, errors.WithMessage(err, "Failed to write encrypted transmission RSAs")
+			}
+			stats.TransmissionRSAs += len(updated)
+			jww.INFO.Printf("Encrypted %d transmission RSAs", stats.TransmissionRSAs)
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that tokens and transmission RSAs are encrypted in the database but
+// returned in plaintext, and that tokens can be found by value.
+func TestStorage_Encryption(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_Encryption", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	s.EnableEncryption(newTestEncryptor(t, "key1"))
+	db := s.Database.(*DatabaseImpl).db
+
+	trsa := []byte("-----BEGIN RSA PUBLIC KEY-----")
+	token := "fcm:token"
+	addressSpace := uint8(16)
+	uid := id.NewIdFromString("zezima", id.User, t)
+	iid, err := ephemeral.GetIntermediaryId(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eph, _, _, err := ephemeral.GetId(uid, uint(addressSpace), time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	_, err = s.RegisterForNotifications(iid, trsa, token, constants.MessengerAndroid.String(), epoch, addressSpace)
+	if err != nil {
+		t.Fatalf("Failed to register: %+v", err)
+	}
+
+	var rawTokens []Token
+	if err = db.Find(&rawTokens).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rawTokens) != 1 || rawTokens[0].Token == token || len(rawTokens[0].EncryptedToken) == 0 ||
+		strings.Contains(string(rawTokens[0].EncryptedToken), token) {
+		t.Errorf("Token was not encrypted in storage: %+v", rawTokens)
+	}
+	var rawUsers []User
+	if err = db.Find(&rawUsers).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rawUsers) != 1 || bytes.Contains(rawUsers[0].TransmissionRSA, trsa) {
+		t.Errorf("Transmission RSA was not encrypted in storage: %+v", rawUsers)
+	}
+
+	trsaHash, err := getHash(trsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if !bytes.Equal(u.TransmissionRSA, trsa) || len(u.Tokens) != 1 || u.Tokens[0].Token != token {
+		t.Errorf("User was not decrypted: %+v", u)
+	}
+
+	gtn, err := s.GetToNotify([]int64{eph.Int64()})
+	if err != nil {
+		t.Fatalf("Failed to get to notify: %+v", err)
+	}
+	if len(gtn) != 1 || gtn[0].Token != token {
+		t.Errorf("GetToNotify did not return decrypted token: %+v", gtn)
+	}
+
+	err = s.DeleteToken(token)
+	if err != nil {
+		t.Fatalf("Failed to delete token: %+v", err)
+	}
+	var count int64
+	if err = db.Model(&Token{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Token was not deleted by value, %d remain", count)
+	}
+}
+
+// Tests that MigrateEncryption encrypts rows written in plaintext and
+// re-encrypts rows written under an old key.
+func TestStorage_MigrateEncryption(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_MigrateEncryption", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	db := s.Database.(*DatabaseImpl).db
+	app := constants.MessengerIOS.String()
+
+	// Write plaintext rows, then rows encrypted under an old key
+	for i := 0; i < 5; i++ {
+		err = s.RegisterToken("plainToken"+string(rune('a'+i)), app, []byte("plainTrsa"+string(rune('a'+i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.EnableEncryption(newTestEncryptor(t, "old"))
+	for i := 0; i < 3; i++ {
+		err = s.RegisterToken("oldToken"+string(rune('a'+i)), app, []byte("oldTrsa"+string(rune('a'+i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.EnableEncryption(newTestEncryptor(t, "new", "old"))
+	stats, err := s.MigrateEncryption(2)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %+v", err)
+	}
+	if stats.Tokens != 8 || stats.TransmissionRSAs != 8 {
+		t.Errorf("Unexpected migration stats: %+v", stats)
+	}
+
+	var rawTokens []Token
+	if err = db.Find(&rawTokens).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rawTokens) != 8 {
+		t.Errorf("Expected 8 tokens after migration, found %d", len(rawTokens))
+	}
+	for _, tok := range rawTokens {
+		if s.encryptor.needsRotation(tok.EncryptedToken) {
+			t.Errorf("Token was not encrypted with the active key: %+v", tok)
+		}
+	}
+	var rawUsers []User
+	if err = db.Find(&rawUsers).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range rawUsers {
+		if s.encryptor.needsRotation(u.TransmissionRSA) {
+			t.Errorf("Transmission RSA was not encrypted with the active key: %+v", u)
+		}
+	}
+
+	trsaHash, err := getHash([]byte("plainTrsaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get migrated user: %+v", err)
+	}
+	if string(u.TransmissionRSA) != "plainTrsaa" || len(u.Tokens) != 1 || u.Tokens[0].Token != "plainTokena" {
+		t.Errorf("Migrated user was not decrypted: %+v", u)
+	}
+
+	stats, err = s.MigrateEncryption(2)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %+v", err)
+	}
+	if stats.Tokens != 0 || stats.TransmissionRSAs != 0 {
+		t.Errorf("Second migration should not rewrite any rows: %+v", stats)
+	}
+}
@@ -0,0 +1,266 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles envelope encryption of sensitive columns
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// encryptionMagic prefixes every encrypted value, distinguishing it from
+// plaintext written before encryption was enabled.
+var encryptionMagic = []byte("xxe1")
+
+const (
+	encryptionKeyLen = 32
+	maxKeyIDLen      = 255
+)
+
+// Labels bound to each encrypted column as associated data, so that a
+// ciphertext cannot be moved to a different column or row.
+const (
+	tokenLabel           = "tokens.token"
+	transmissionRSALabel = "users.transmission_rsa"
+)
+
+// keyFile is the JSON format of the encryption key file.
+//
+//	{
+//	  "activeKeyId": "2023-06",
+//	  "indexKey": "<base64 32 bytes>",
+//	  "keys": {"2023-06": "<base64 32 bytes>", "2023-01": "<base64 32 bytes>"}
+//	}
+//
+// New values are encrypted under activeKeyId; older keys are kept so
+// existing rows can still be read until they are migrated.
+type keyFile struct {
+	ActiveKeyID string            `json:"activeKeyId"`
+	IndexKey    string            `json:"indexKey"`
+	Keys        map[string]string `json:"keys"`
+}
+
+// FieldEncryptor encrypts device tokens and transmission RSA keys at rest.
+// Each value is encrypted with a random data key, which is itself wrapped by a
+// master key identified by its key ID. Tokens additionally get a
+// deterministic blind index so they can still be looked up by value.
+type FieldEncryptor struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+	indexKey    []byte
+}
+
+// LoadKeyFile reads a key file from the passed in path and returns a
+// FieldEncryptor using its keys.
+func LoadKeyFile(path string) (*FieldEncryptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to read encryption key file")
+	}
+	kf := &keyFile{}
+	err = json.Unmarshal(data, kf)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to parse encryption key file")
+	}
+
+	keys := make(map[string][]byte, len(kf.Keys))
+	for keyID, encoded := range kf.Keys {
+		keys[keyID], err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to decode key %s", keyID)
+		}
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(kf.IndexKey)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to decode index key")
+	}
+	return newFieldEncryptor(kf.ActiveKeyID, keys, indexKey)
+}
+
+// newFieldEncryptor creates a FieldEncryptor from raw keys.
+func newFieldEncryptor(activeKeyID string, keys map[string][]byte, indexKey []byte) (*FieldEncryptor, error) {
+	if _, ok := keys[activeKeyID]; !ok {
+		return nil, errors.Errorf("Active key %q not found in key file", activeKeyID)
+	}
+	if len(indexKey) < encryptionKeyLen {
+		return nil, errors.Errorf("Index key must be at least %d bytes, received %d", encryptionKeyLen, len(indexKey))
+	}
+
+	fe := &FieldEncryptor{
+		activeKeyID: activeKeyID,
+		keys:        make(map[string]cipher.AEAD, len(keys)),
+		indexKey:    indexKey,
+	}
+	for keyID, key := range keys {
+		if len(keyID) == 0 || len(keyID) > maxKeyIDLen {
+			return nil, errors.Errorf("Key ID %q must be between 1 and %d bytes", keyID, maxKeyIDLen)
+		}
+		if len(key) != encryptionKeyLen {
+			return nil, errors.Errorf("Key %s must be %d bytes, received %d", keyID, encryptionKeyLen, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to initialize key %s", keyID)
+		}
+		fe.keys[keyID] = aead
+	}
+	return fe, nil
+}
+
+// newAEAD returns an AES-256-GCM cipher for the passed in key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blindIndex returns the deterministic HMAC of a token, which is stored in
+// place of the token so it can be used as a lookup key.
+func (fe *FieldEncryptor) blindIndex(token string) string {
+	mac := hmac.New(sha256.New, fe.indexKey)
+	mac.Write([]byte(tokenLabel))
+	mac.Write([]byte(token))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt seals plaintext under a new data key, wrapped with the active
+// master key. The result has the format:
+//
+//	magic | len(keyID) | keyID | nonce | wrapped data key | nonce | ciphertext
+//
+// The associated data binds the value to its header, column and row key.
+func (fe *FieldEncryptor) encrypt(plaintext []byte, label string, rowKey []byte) ([]byte, error) {
+	kek := fe.keys[fe.activeKeyID]
+
+	dataKey := make([]byte, encryptionKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.WithMessage(err, "Failed to generate data key")
+	}
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptionMagic)+1+len(fe.activeKeyID))
+	header = append(header, encryptionMagic...)
+	header = append(header, byte(len(fe.activeKeyID)))
+	header = append(header, fe.activeKeyID...)
+	aad := associatedData(header, label, rowKey)
+
+	out := header
+	out, err = seal(kek, out, dataKey, aad)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to wrap data key")
+	}
+	out, err = seal(dek, out, plaintext, aad)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to encrypt value")
+	}
+	return out, nil
+}
+
+// decrypt opens a value sealed by encrypt using the master key named in it.
+func (fe *FieldEncryptor) decrypt(ciphertext []byte, label string, rowKey []byte) ([]byte, error) {
+	keyID, header, rest, err := parseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := fe.keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("Value is encrypted with unknown key %q", keyID)
+	}
+	aad := associatedData(header, label, rowKey)
+
+	dataKey, rest, err := open(kek, rest, encryptionKeyLen+kek.Overhead(), aad)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to unwrap data key")
+	}
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, err := open(dek, rest, -1, aad)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to decrypt value")
+	}
+	return plaintext, nil
+}
+
+// needsRotation returns true if the passed in value is plaintext or was
+// encrypted with a key other than the active key.
+func (fe *FieldEncryptor) needsRotation(value []byte) bool {
+	keyID, _, _, err := parseHeader(value)
+	return err != nil || keyID != fe.activeKeyID
+}
+
+// isEncrypted returns true if the passed in value was written by encrypt.
+func isEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, encryptionMagic)
+}
+
+// parseHeader splits an encrypted value into its key ID, its header bytes
+// and the remaining wrapped key & ciphertext.
+func parseHeader(value []byte) (string, []byte, []byte, error) {
+	if !isEncrypted(value) || len(value) < len(encryptionMagic)+1 {
+		return "", nil, nil, errors.New("Value is not encrypted")
+	}
+	keyIDLen := int(value[len(encryptionMagic)])
+	headerLen := len(encryptionMagic) + 1 + keyIDLen
+	if len(value) < headerLen {
+		return "", nil, nil, errors.New("Encrypted value is truncated")
+	}
+	return string(value[len(encryptionMagic)+1 : headerLen]), value[:headerLen], value[headerLen:], nil
+}
+
+// associatedData binds a ciphertext to its header, column and row.
+func associatedData(header []byte, label string, rowKey []byte) []byte {
+	aad := make([]byte, 0, len(header)+len(label)+len(rowKey))
+	aad = append(aad, header...)
+	aad = append(aad, label...)
+	return append(aad, rowKey...)
+}
+
+// seal appends a random nonce and the sealed plaintext to dst.
+func seal(aead cipher.AEAD, dst, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, aad), nil
+}
+
+// open reads a nonce and a sealed value from the front of src, returning the
+// plaintext and the remainder of src. If sealedLen is negative, the sealed
+// value takes up the rest of src.
+func open(aead cipher.AEAD, src []byte, sealedLen int, aad []byte) ([]byte, []byte, error) {
+	nonceSize := aead.NonceSize()
+	if sealedLen < 0 {
+		sealedLen = len(src) - nonceSize
+	}
+	if sealedLen < aead.Overhead() || len(src) < nonceSize+sealedLen {
+		return nil, nil, errors.New("Encrypted value is truncated")
+	}
+	nonce, sealed := src[:nonceSize], src[nonceSize:nonceSize+sealedLen]
+	plaintext, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, src[nonceSize+sealedLen:], nil
+}
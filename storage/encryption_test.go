@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestEncryptor returns a FieldEncryptor with the passed in key IDs, the
+// first of which is active. Keys are derived from their IDs so the same ID
+// always has the same key.
+func newTestEncryptor(t *testing.T, keyIDs ...string) *FieldEncryptor {
+	keys := make(map[string][]byte, len(keyIDs))
+	for _, keyID := range keyIDs {
+		key := sha256.Sum256([]byte(keyID))
+		keys[keyID] = key[:]
+	}
+	fe, err := newFieldEncryptor(keyIDs[0], keys, bytes.Repeat([]byte{0xff}, encryptionKeyLen))
+	if err != nil {
+		t.Fatalf("Failed to create field encryptor: %+v", err)
+	}
+	return fe
+}
+
+// Tests that values round trip and are bound to their column & row.
+func TestFieldEncryptor_EncryptDecrypt(t *testing.T) {
+	fe := newTestEncryptor(t, "key1")
+	plaintext := []byte("fcm:token")
+
+	ct, err := fe.encrypt(plaintext, tokenLabel, []byte("row"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %+v", err)
+	}
+	if !isEncrypted(ct) || bytes.Contains(ct, plaintext) {
+		t.Fatalf("Ciphertext is not encrypted: %v", ct)
+	}
+
+	ct2, err := fe.encrypt(plaintext, tokenLabel, []byte("row"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %+v", err)
+	}
+	if bytes.Equal(ct, ct2) {
+		t.Error("Encrypting the same value twice should not produce the same ciphertext")
+	}
+
+	received, err := fe.decrypt(ct, tokenLabel, []byte("row"))
+	if err != nil {
+		t.Fatalf("Failed to decrypt: %+v", err)
+	}
+	if !bytes.Equal(received, plaintext) {
+		t.Errorf("Decrypted value does not match.\nexpected: %s\nreceived: %s", plaintext, received)
+	}
+
+	if _, err = fe.decrypt(ct, tokenLabel, []byte("otherRow")); err == nil {
+		t.Error("Decrypting with a different row key should fail")
+	}
+	if _, err = fe.decrypt(ct, transmissionRSALabel, []byte("row")); err == nil {
+		t.Error("Decrypting with a different column label should fail")
+	}
+	if _, err = fe.decrypt(ct[:len(ct)-1], tokenLabel, []byte("row")); err == nil {
+		t.Error("Decrypting a truncated value should fail")
+	}
+}
+
+// Tests that values encrypted under an old key can still be read after
+// rotation, and are reported as needing rotation.
+func TestFieldEncryptor_Rotation(t *testing.T) {
+	old := newTestEncryptor(t, "old")
+	ct, err := old.encrypt([]byte("value"), tokenLabel, nil)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %+v", err)
+	}
+	if old.needsRotation(ct) {
+		t.Error("Value encrypted with the active key should not need rotation")
+	}
+
+	rotated := newTestEncryptor(t, "new", "old")
+	if !rotated.needsRotation(ct) {
+		t.Error("Value encrypted with an old key should need rotation")
+	}
+	if !rotated.needsRotation([]byte("plaintext")) {
+		t.Error("Plaintext value should need rotation")
+	}
+	received, err := rotated.decrypt(ct, tokenLabel, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt with old key: %+v", err)
+	}
+	if string(received) != "value" {
+		t.Errorf("Unexpected decrypted value %q", received)
+	}
+
+	if _, err = newTestEncryptor(t, "new").decrypt(ct, tokenLabel, nil); err == nil ||
+		!strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("Expected unknown key error, received %+v", err)
+	}
+}
+
+// Tests that the blind index is deterministic and keyed.
+func TestFieldEncryptor_blindIndex(t *testing.T) {
+	fe := newTestEncryptor(t, "key1")
+	if fe.blindIndex("token") != fe.blindIndex("token") {
+		t.Error("Blind index should be deterministic")
+	}
+	if fe.blindIndex("token") == fe.blindIndex("token2") {
+		t.Error("Different tokens should have different blind indexes")
+	}
+
+	other, err := newFieldEncryptor("key1", map[string][]byte{"key1": make([]byte, encryptionKeyLen)},
+		bytes.Repeat([]byte{0xee}, encryptionKeyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fe.blindIndex("token") == other.blindIndex("token") {
+		t.Error("Blind index should depend on the index key")
+	}
+}
+
+// Tests loading a key file and rejecting invalid key files.
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(make([]byte, encryptionKeyLen))
+	write := func(kf keyFile) string {
+		data, err := json.Marshal(kf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "keys.json")
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fe, err := LoadKeyFile(write(keyFile{
+		ActiveKeyID: "a",
+		IndexKey:    key,
+		Keys:        map[string]string{"a": key, "b": key},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to load key file: %+v", err)
+	}
+	if fe.activeKeyID != "a" || len(fe.keys) != 2 {
+		t.Errorf("Unexpected encryptor loaded: %+v", fe)
+	}
+
+	invalid := []keyFile{
+		{ActiveKeyID: "missing", IndexKey: key, Keys: map[string]string{"a": key}},
+		{ActiveKeyID: "a", IndexKey: "", Keys: map[string]string{"a": key}},
+		{ActiveKeyID: "a", IndexKey: key, Keys: map[string]string{"a": "c2hvcnQ="}},
+		{ActiveKeyID: "a", IndexKey: key, Keys: map[string]string{"a": "not base64"}},
+	}
+	for i, kf := range invalid {
+		if _, err = LoadKeyFile(write(kf)); err == nil {
+			t.Errorf("Expected error loading invalid key file %d", i)
+		}
+	}
+
+	if _, err = LoadKeyFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error loading missing key file")
+	}
+}
@@ -0,0 +1,350 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the short-lived, frequently written data of the bot
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// identityPageSize is the number of identities read at a time when checking
+// identities against a HotStore.
+const identityPageSize = 1000
+
+// hotStoreWriteAttempts is the number of times a write to the HotStore is
+// tried before it fails.
+const hotStoreWriteAttempts = 3
+
+// hotStoreRetryDelay is the delay before the first retry of a write to the
+// HotStore. It doubles with each retry.
+var hotStoreRetryDelay = 100 * time.Millisecond
+
+// HotStore holds the short-lived, frequently written data of the bot: the
+// ephemerals of each identity, the rounds whose notifications have been
+// received, and the notifications waiting to be sent. Users, tokens and
+// identities are always held in the SQL database.
+//
+// By default, ephemerals are held in the SQL database and rounds and
+// notifications in memory. A HotStore shared by several bots, such as a
+// RedisHotStore, may be set with Storage.SetHotStore.
+type HotStore interface {
+	// AddEphemerals stores the passed in ephemerals. Ephemerals which are
+	// already stored are skipped.
+	AddEphemerals(ephemerals []*Ephemeral) error
+	// GetEphemerals returns the ephemerals with any of the passed in IDs.
+	GetEphemerals(ephemeralIds []int64) ([]*Ephemeral, error)
+	// GetLatestEphemeral returns an ephemeral with the highest epoch, or
+	// gorm.ErrRecordNotFound if none are stored.
+	GetLatestEphemeral() (*Ephemeral, error)
+	// DeleteOldEphemerals deletes all ephemerals with an epoch before the
+	// passed in value.
+	DeleteOldEphemerals(currentEpoch int32) error
+	// HasEphemerals returns the set of the passed in intermediary IDs which
+	// have at least one ephemeral stored.
+	HasEphemerals(iids [][]byte) (map[string]bool, error)
+	// DeleteIdentityEphemerals deletes all ephemerals of the passed in
+	// intermediary IDs.
+	DeleteIdentityEphemerals(iids [][]byte) error
+	// JoinsDatabase returns true if ephemerals are held in the SQL Database,
+	// so queries may join them with identities and they are deleted along
+	// with their identities.
+	JoinsDatabase() bool
+
+	// MarkRound records that the notifications for a round have been
+	// received. It returns false if the round was already marked and has
+	// not expired.
+	MarkRound(rid id.Round, ttl time.Duration) (bool, error)
+	// DeleteExpiredRounds removes the rounds marked before their ttl.
+	DeleteExpiredRounds(now time.Time) error
+
+	// SetBufferLimits sets the limits on the notifications held.
+	SetBufferLimits(limits BufferLimits)
+	// AddNotifications adds the notifications of a round to those waiting to
+	// be sent, skipping any already held.
+	AddNotifications(rid id.Round, l []*notifications.Data) error
+	// SwapNotifications removes and returns all notifications waiting to be
+	// sent, keyed by ephemeral ID and sorted by round ID.
+	SwapNotifications() (map[int64][]*notifications.Data, error)
+}
+
+// localHotStore is the default HotStore. It holds ephemerals in the SQL
+// database, where they can be joined with the identities they belong to, and
+// rounds and notifications in memory.
+type localHotStore struct {
+	db     Database
+	rounds sync.Map
+	buffer *NotificationBuffer
+}
+
+// newLocalHotStore returns a localHotStore which holds ephemerals in the
+// passed in database.
+func newLocalHotStore(db Database) *localHotStore {
+	return &localHotStore{
+		db:     db,
+		buffer: NewNotificationBuffer(),
+	}
+}
+
+// AddEphemerals stores the passed in ephemerals in the database.
+func (l *localHotStore) AddEphemerals(ephemerals []*Ephemeral) error {
+	if len(ephemerals) == 1 {
+		return l.db.insertEphemeral(ephemerals[0])
+	}
+	return l.db.insertEphemerals(ephemerals)
+}
+
+// GetEphemerals returns the ephemerals with any of the passed in IDs from the
+// database.
+func (l *localHotStore) GetEphemerals(ephemeralIds []int64) ([]*Ephemeral, error) {
+	return l.db.getEphemerals(ephemeralIds)
+}
+
+// GetLatestEphemeral returns an ephemeral with the highest epoch from the
+// database.
+func (l *localHotStore) GetLatestEphemeral() (*Ephemeral, error) {
+	return l.db.GetLatestEphemeral()
+}
+
+// DeleteOldEphemerals deletes the ephemerals with an epoch before the passed
+// in value from the database.
+func (l *localHotStore) DeleteOldEphemerals(currentEpoch int32) error {
+	return l.db.DeleteOldEphemerals(currentEpoch)
+}
+
+// HasEphemerals returns the set of the passed in intermediary IDs which have
+// ephemerals in the database.
+func (l *localHotStore) HasEphemerals(iids [][]byte) (map[string]bool, error) {
+	found, err := l.db.getEphemeralIdentities(iids)
+	if err != nil {
+		return nil, err
+	}
+	has := make(map[string]bool, len(found))
+	for _, iid := range found {
+		has[string(iid)] = true
+	}
+	return has, nil
+}
+
+// DeleteIdentityEphemerals deletes the ephemerals of the passed in identities
+// from the database.
+func (l *localHotStore) DeleteIdentityEphemerals(iids [][]byte) error {
+	return l.db.deleteIdentityEphemerals(iids)
+}
+
+// JoinsDatabase returns true, as ephemerals are held in the SQL database.
+func (l *localHotStore) JoinsDatabase() bool {
+	return true
+}
+
+// MarkRound records the round in memory until the ttl has passed and it is
+// removed by DeleteExpiredRounds.
+func (l *localHotStore) MarkRound(rid id.Round, ttl time.Duration) (bool, error) {
+	_, loaded := l.rounds.LoadOrStore(rid, time.Now().Add(ttl))
+	return !loaded, nil
+}
+
+// DeleteExpiredRounds removes the rounds whose ttl has passed from memory.
+func (l *localHotStore) DeleteExpiredRounds(now time.Time) error {
+	l.rounds.Range(func(key, val interface{}) bool {
+		if now.After(val.(time.Time)) {
+			l.rounds.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+// SetBufferLimits sets the limits of the in-memory NotificationBuffer.
+func (l *localHotStore) SetBufferLimits(limits BufferLimits) {
+	l.buffer.SetLimits(limits)
+}
+
+// AddNotifications adds the notifications to the in-memory NotificationBuffer.
+func (l *localHotStore) AddNotifications(rid id.Round, data []*notifications.Data) error {
+	l.buffer.Add(rid, data)
+	return nil
+}
+
+// SwapNotifications swaps out the contents of the in-memory NotificationBuffer.
+func (l *localHotStore) SwapNotifications() (map[int64][]*notifications.Data, error) {
+	return l.buffer.Swap(), nil
+}
+
+// SetHotStore replaces the store holding ephemerals, received rounds and
+// buffered notifications. It must be called before storage is used; data
+// held by the previous store is not moved. The token cache is disabled if
+// ephemerals are no longer held in the database.
+func (s *Storage) SetHotStore(hot HotStore) {
+	s.hot = hot
+	s.tokenCache.clear()
+	s.disableSharedTokenCache()
+}
+
+// retryHotStore calls a write to the HotStore until it succeeds, up to
+// hotStoreWriteAttempts times, and returns the last error.
+func retryHotStore(write func() error) error {
+	delay := hotStoreRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt == hotStoreWriteAttempts {
+			return err
+		}
+		jww.DEBUG.Printf("Hot store write failed on attempt %d of %d, retrying in %s: %+v",
+			attempt, hotStoreWriteAttempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// deleteHotEphemerals deletes the ephemerals of the passed in identities from
+// the HotStore, if ephemerals are held outside the database. Ephemerals in the
+// database are deleted along with their identities.
+func (s *Storage) deleteHotEphemerals(iids [][]byte) error {
+	if len(iids) == 0 || s.ephemeralsInDatabase() {
+		return nil
+	}
+	err := retryHotStore(func() error { return s.hot.DeleteIdentityEphemerals(iids) })
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to delete the ephemerals of %d identities", len(iids))
+	}
+	return nil
+}
+
+// ephemeralsInDatabase returns true if ephemerals are held in the SQL
+// database, so queries may join them with identities.
+func (s *Storage) ephemeralsInDatabase() bool {
+	return s.hot.JoinsDatabase()
+}
+
+// GetEphemeral retrieves a list of ephemerals with the given ID.
+func (s *Storage) GetEphemeral(ephemeralId int64) ([]*Ephemeral, error) {
+	result, err := s.hot.GetEphemerals([]int64{ephemeralId})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) < 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return result, nil
+}
+
+// GetLatestEphemeral retrieves an ephemeral with the highest epoch from storage.
+func (s *Storage) GetLatestEphemeral() (*Ephemeral, error) {
+	return s.hot.GetLatestEphemeral()
+}
+
+// GetOrphanedIdentities returns a list of identities with no associated
+// ephemerals. If ephemerals are held outside the database, every identity is
+// checked against the hot store.
+func (s *Storage) GetOrphanedIdentities() ([]*Identity, error) {
+	if s.ephemeralsInDatabase() {
+		return s.Database.GetOrphanedIdentities()
+	}
+
+	var orphaned []*Identity
+	after := []byte{}
+	for {
+		identities, err := s.getIdentitiesAfter(after, identityPageSize)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to read identities")
+		}
+		if len(identities) == 0 {
+			return orphaned, nil
+		}
+		iids := make([][]byte, len(identities))
+		for i, identity := range identities {
+			iids[i] = identity.IntermediaryId
+		}
+		has, err := s.hot.HasEphemerals(iids)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to check identities for ephemerals")
+		}
+		for _, identity := range identities {
+			if !has[string(identity.IntermediaryId)] {
+				orphaned = append(orphaned, identity)
+			}
+		}
+		after = iids[len(iids)-1]
+	}
+}
+
+// toNotifyRows returns the rows of GetToNotify for the passed in ephemeral
+// IDs. If ephemerals are held outside the database, they are looked up in the
+// hot store and the tokens of their identities read from the database.
+func (s *Storage) toNotifyRows(ephemeralIds []int64) ([]toNotifyRow, error) {
+	if s.ephemeralsInDatabase() {
+		return s.Database.getToNotifyRows(ephemeralIds)
+	}
+
+	eList, err := s.hot.GetEphemerals(ephemeralIds)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to look up ephemerals")
+	}
+	byIdentity := make(map[string][]*Ephemeral)
+	var iids [][]byte
+	for _, e := range eList {
+		if _, ok := byIdentity[string(e.IntermediaryId)]; !ok {
+			iids = append(iids, e.IntermediaryId)
+		}
+		byIdentity[string(e.IntermediaryId)] = append(byIdentity[string(e.IntermediaryId)], e)
+	}
+	if len(iids) == 0 {
+		return nil, nil
+	}
+
+	tokens, err := s.Database.getIdentityTokens(iids)
+	if err != nil {
+		return nil, err
+	}
+	var rows []toNotifyRow
+	for _, t := range tokens {
+		for _, e := range byIdentity[string(t.IntermediaryId)] {
+			r := t
+			r.EphemeralId = e.EphemeralId
+			r.Epoch = e.Epoch
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
+// MarkRound records that the notifications for a round have been received
+// until the ttl has passed. It returns false if the round was already marked.
+func (s *Storage) MarkRound(rid id.Round, ttl time.Duration) (bool, error) {
+	return s.hot.MarkRound(rid, ttl)
+}
+
+// DeleteExpiredRounds removes the rounds marked before their ttl.
+func (s *Storage) DeleteExpiredRounds(now time.Time) error {
+	return s.hot.DeleteExpiredRounds(now)
+}
+
+// SetBufferLimits sets the limits on the notifications waiting to be sent.
+func (s *Storage) SetBufferLimits(limits BufferLimits) {
+	s.hot.SetBufferLimits(limits)
+}
+
+// AddNotifications adds the notifications of a round to those waiting to be
+// sent.
+func (s *Storage) AddNotifications(rid id.Round, l []*notifications.Data) error {
+	return s.hot.AddNotifications(rid, l)
+}
+
+// SwapNotifications removes and returns all notifications waiting to be sent,
+// keyed by ephemeral ID and sorted by round ID.
+// NOTE THAT ANY UNSENT NOTIFICATIONS MUST BE RE-ADDED OR QUEUED
+func (s *Storage) SwapNotifications() (map[int64][]*notifications.Data, error) {
+	return s.hot.SwapNotifications()
+}
@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that a round is only marked once in memory until it is deleted after
+// its ttl.
+func TestLocalHotStore_MarkRound(t *testing.T) {
+	l := newLocalHotStore(nil)
+
+	if first, _ := l.MarkRound(42, time.Minute); !first {
+		t.Fatalf("Expected round to be marked")
+	}
+	if first, _ := l.MarkRound(42, time.Minute); first {
+		t.Errorf("Expected round to already be marked")
+	}
+
+	_ = l.DeleteExpiredRounds(time.Now())
+	if first, _ := l.MarkRound(42, time.Minute); first {
+		t.Errorf("Round should not be deleted before its ttl")
+	}
+	_ = l.DeleteExpiredRounds(time.Now().Add(2 * time.Minute))
+	if first, _ := l.MarkRound(42, time.Minute); !first {
+		t.Errorf("Expected round to be marked again once deleted")
+	}
+}
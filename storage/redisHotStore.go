@@ -0,0 +1,557 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the Redis backend for the short-lived data of the bot
+
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// redisConnectTimeout is how long NewRedisHotStore waits for Redis to respond.
+const redisConnectTimeout = 10 * time.Second
+
+// RedisParams holds the connection parameters of a RedisHotStore.
+type RedisParams struct {
+	// Address of the Redis server, as host:port
+	Address  string
+	Username string
+	Password string
+	// Database number on the server
+	DB int
+	// Prepended to every key, such as "notifications:", so other data may be
+	// held on the same server
+	KeyPrefix string
+}
+
+// RedisHotStore is a HotStore on a Redis or Redis-compatible server, so that
+// several bots may share ephemerals, received rounds and buffered
+// notifications. Users, tokens and identities remain in the SQL database.
+// Ephemerals held in Redis cannot be joined with identities in
+// the database, so looking up the tokens to notify takes a query to each.
+//
+// Keys are laid out as follows, under the key prefix:
+//
+//	eph:<ephemeral ID>    set of epoch & intermediary ID of each ephemeral
+//	epoch:<epoch>         set of ephemeral ID & intermediary ID of each ephemeral
+//	epochs                sorted set of the epochs with ephemerals
+//	iid:<hex iid>         set of ephemeral ID & epoch of each ephemeral
+//	round:<round ID>      marker of a received round, expiring after its ttl
+//	buffer:<round ID>     hash of the notifications of a round by ephemeral ID & message hash
+//	rounds                sorted set of the rounds with buffered notifications
+//	bufferEntries         hash of the number of notifications buffered per round
+//	bufferBytes           hash of the size of the notifications buffered per round
+//
+// The max age of buffered notifications is enforced by expiring the
+// notifications of a round, and the entry and byte limits by evicting the
+// oldest rounds when notifications are added.
+type RedisHotStore struct {
+	client *redis.Client
+	prefix string
+	limits atomic.Pointer[BufferLimits]
+
+	evictedRounds  atomic.Uint64
+	evictedEntries atomic.Uint64
+}
+
+// NewRedisHotStore connects to the Redis server with the passed in parameters
+// and returns a RedisHotStore on it.
+func NewRedisHotStore(params RedisParams) (*RedisHotStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     params.Address,
+		Username: params.Username,
+		Password: params.Password,
+		DB:       params.DB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, errors.Errorf("Unable to connect to redis at %s: %+v", params.Address, err)
+	}
+	jww.INFO.Printf("Redis hot store connected at %s", params.Address)
+	r := &RedisHotStore{client: client, prefix: params.KeyPrefix}
+	r.limits.Store(&BufferLimits{})
+	return r, nil
+}
+
+// Close closes the connection to the Redis server.
+func (r *RedisHotStore) Close() error {
+	return r.client.Close()
+}
+
+// key returns the key with the passed in name under the key prefix.
+func (r *RedisHotStore) key(parts ...string) string {
+	k := r.prefix
+	for i, p := range parts {
+		if i > 0 {
+			k += ":"
+		}
+		k += p
+	}
+	return k
+}
+
+func (r *RedisHotStore) ephemeralKey(ephemeralId int64) string {
+	return r.key("eph", strconv.FormatInt(ephemeralId, 10))
+}
+
+func (r *RedisHotStore) epochKey(epoch int32) string {
+	return r.key("epoch", strconv.FormatInt(int64(epoch), 10))
+}
+
+func (r *RedisHotStore) identityKey(iid []byte) string {
+	return r.key("iid", hex.EncodeToString(iid))
+}
+
+func (r *RedisHotStore) roundKey(rid id.Round) string {
+	return r.key("round", strconv.FormatUint(uint64(rid), 10))
+}
+
+func (r *RedisHotStore) bufferKey(rid id.Round) string {
+	return r.key("buffer", strconv.FormatUint(uint64(rid), 10))
+}
+
+// ephemeralMember encodes an ephemeral as a member of its eph set.
+func ephemeralMember(e *Ephemeral) string {
+	b := make([]byte, 4, 4+len(e.IntermediaryId))
+	binary.BigEndian.PutUint32(b, uint32(e.Epoch))
+	return string(append(b, e.IntermediaryId...))
+}
+
+// epochMember encodes an ephemeral as a member of its epoch set.
+func epochMember(e *Ephemeral) string {
+	b := make([]byte, 8, 8+len(e.IntermediaryId))
+	binary.BigEndian.PutUint64(b, uint64(e.EphemeralId))
+	return string(append(b, e.IntermediaryId...))
+}
+
+// identityMember encodes an ephemeral as a member of its iid set.
+func identityMember(e *Ephemeral) string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(e.EphemeralId))
+	binary.BigEndian.PutUint32(b[8:], uint32(e.Epoch))
+	return string(b)
+}
+
+// AddEphemerals stores the passed in ephemerals in batches. Each batch is
+// written in a single transaction.
+func (r *RedisHotStore) AddEphemerals(ephemerals []*Ephemeral) error {
+	ctx := context.Background()
+	for start := 0; start < len(ephemerals); start += ephemeralInsertBatchSize {
+		end := start + ephemeralInsertBatchSize
+		if end > len(ephemerals) {
+			end = len(ephemerals)
+		}
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, e := range ephemerals[start:end] {
+				pipe.SAdd(ctx, r.ephemeralKey(e.EphemeralId), ephemeralMember(e))
+				pipe.SAdd(ctx, r.epochKey(e.Epoch), epochMember(e))
+				pipe.ZAdd(ctx, r.key("epochs"), redis.Z{Score: float64(e.Epoch), Member: e.Epoch})
+				pipe.SAdd(ctx, r.identityKey(e.IntermediaryId), identityMember(e))
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.WithMessage(err, "Failed to add ephemerals to redis")
+		}
+	}
+	return nil
+}
+
+// GetEphemerals returns the ephemerals with any of the passed in IDs.
+func (r *RedisHotStore) GetEphemerals(ephemeralIds []int64) ([]*Ephemeral, error) {
+	ctx := context.Background()
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(ephemeralIds))
+	for i, eid := range ephemeralIds {
+		cmds[i] = pipe.SMembers(ctx, r.ephemeralKey(eid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, errors.WithMessage(err, "Failed to get ephemerals from redis")
+	}
+
+	var result []*Ephemeral
+	for i, cmd := range cmds {
+		for _, m := range cmd.Val() {
+			if len(m) < 4 {
+				continue
+			}
+			result = append(result, &Ephemeral{
+				IntermediaryId: []byte(m[4:]),
+				EphemeralId:    ephemeralIds[i],
+				Epoch:          int32(binary.BigEndian.Uint32([]byte(m[:4]))),
+			})
+		}
+	}
+	return result, nil
+}
+
+// GetLatestEphemeral returns an ephemeral from the highest epoch stored.
+func (r *RedisHotStore) GetLatestEphemeral() (*Ephemeral, error) {
+	ctx := context.Background()
+	epochs, err := r.client.ZRevRange(ctx, r.key("epochs"), 0, 0).Result()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get latest epoch from redis")
+	}
+	if len(epochs) < 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	epoch, err := strconv.ParseInt(epochs[0], 10, 32)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Invalid epoch %q in redis", epochs[0])
+	}
+	m, err := r.client.SRandMember(ctx, r.epochKey(int32(epoch))).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.WithMessage(err, "Failed to get latest ephemeral from redis")
+	}
+	if len(m) < 8 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &Ephemeral{
+		IntermediaryId: []byte(m[8:]),
+		EphemeralId:    int64(binary.BigEndian.Uint64([]byte(m[:8]))),
+		Epoch:          int32(epoch),
+	}, nil
+}
+
+// DeleteOldEphemerals deletes all ephemerals with an epoch before the passed
+// in value, one epoch at a time.
+func (r *RedisHotStore) DeleteOldEphemerals(currentEpoch int32) error {
+	ctx := context.Background()
+	epochs, err := r.client.ZRangeByScore(ctx, r.key("epochs"), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(int64(currentEpoch), 10),
+	}).Result()
+	if err != nil {
+		return errors.WithMessage(err, "Failed to get old epochs from redis")
+	}
+
+	for _, epochStr := range epochs {
+		epoch, err := strconv.ParseInt(epochStr, 10, 32)
+		if err != nil {
+			return errors.WithMessagef(err, "Invalid epoch %q in redis", epochStr)
+		}
+		members, err := r.client.SMembers(ctx, r.epochKey(int32(epoch))).Result()
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to get ephemerals for epoch %d from redis", epoch)
+		}
+		_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, m := range members {
+				if len(m) < 8 {
+					continue
+				}
+				e := &Ephemeral{
+					IntermediaryId: []byte(m[8:]),
+					EphemeralId:    int64(binary.BigEndian.Uint64([]byte(m[:8]))),
+					Epoch:          int32(epoch),
+				}
+				pipe.SRem(ctx, r.ephemeralKey(e.EphemeralId), ephemeralMember(e))
+				pipe.SRem(ctx, r.identityKey(e.IntermediaryId), identityMember(e))
+			}
+			pipe.Del(ctx, r.epochKey(int32(epoch)))
+			pipe.ZRem(ctx, r.key("epochs"), epochStr)
+			return nil
+		})
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to delete ephemerals for epoch %d from redis", epoch)
+		}
+	}
+	return nil
+}
+
+// HasEphemerals returns the set of the passed in intermediary IDs which have
+// at least one ephemeral stored.
+func (r *RedisHotStore) HasEphemerals(iids [][]byte) (map[string]bool, error) {
+	ctx := context.Background()
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(iids))
+	for i, iid := range iids {
+		cmds[i] = pipe.Exists(ctx, r.identityKey(iid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, errors.WithMessage(err, "Failed to check identities in redis")
+	}
+	has := make(map[string]bool)
+	for i, cmd := range cmds {
+		if cmd.Val() > 0 {
+			has[string(iids[i])] = true
+		}
+	}
+	return has, nil
+}
+
+// DeleteIdentityEphemerals deletes all ephemerals of the passed in
+// intermediary IDs in a single transaction.
+func (r *RedisHotStore) DeleteIdentityEphemerals(iids [][]byte) error {
+	if len(iids) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(iids))
+	for i, iid := range iids {
+		cmds[i] = pipe.SMembers(ctx, r.identityKey(iid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.WithMessage(err, "Failed to get identity ephemerals from redis")
+	}
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, cmd := range cmds {
+			for _, m := range cmd.Val() {
+				if len(m) < 12 {
+					continue
+				}
+				e := &Ephemeral{
+					IntermediaryId: iids[i],
+					EphemeralId:    int64(binary.BigEndian.Uint64([]byte(m[:8]))),
+					Epoch:          int32(binary.BigEndian.Uint32([]byte(m[8:12]))),
+				}
+				pipe.SRem(ctx, r.ephemeralKey(e.EphemeralId), ephemeralMember(e))
+				pipe.SRem(ctx, r.epochKey(e.Epoch), epochMember(e))
+			}
+			pipe.Del(ctx, r.identityKey(iids[i]))
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to delete identity ephemerals from redis")
+	}
+	return nil
+}
+
+// MarkRound sets a marker for the round which expires after the ttl, unless
+// one is already set.
+func (r *RedisHotStore) MarkRound(rid id.Round, ttl time.Duration) (bool, error) {
+	ok, err := r.client.SetNX(context.Background(), r.roundKey(rid), 1, ttl).Result()
+	if err != nil {
+		return false, errors.WithMessagef(err, "Failed to mark round %d in redis", rid)
+	}
+	return ok, nil
+}
+
+// DeleteExpiredRounds does nothing, as Redis expires round markers itself.
+func (r *RedisHotStore) DeleteExpiredRounds(time.Time) error {
+	return nil
+}
+
+// JoinsDatabase returns false, as ephemerals are held in Redis.
+func (r *RedisHotStore) JoinsDatabase() bool {
+	return false
+}
+
+// SetBufferLimits sets the limits on buffered notifications. The max age is
+// enforced by expiring the notifications of a round, and the entry and byte
+// limits by evicting the oldest rounds when notifications are added.
+func (r *RedisHotStore) SetBufferLimits(limits BufferLimits) {
+	r.limits.Store(&limits)
+}
+
+// addNotificationsScript adds each notification to the hash of its round
+// unless already present, counts the entries and bytes added, records the
+// round, and sets the max age of the hash when it is created. If the buffered
+// rounds are then over the entry or byte limit, they are evicted from lowest to
+// highest round ID until the buffer is within its limits. Rounds whose hash has
+// expired are dropped from the counts. It returns the ID and entry count of
+// each evicted round.
+// KEYS[1] is the rounds key, KEYS[2] and KEYS[3] the entry and byte count
+// hashes, KEYS[4] the round's buffer key, followed by the buffer key of every
+// buffered round, including this one, in ascending order. ARGV[1] is the round
+// ID, ARGV[2] the max age in milliseconds, ARGV[3] and ARGV[4] the entry and
+// byte limits, followed by the ID of each buffered round in the order of KEYS,
+// then the field, value & size of each notification.
+var addNotificationsScript = redis.NewScript(`
+local rid = ARGV[1]
+local created = redis.call("EXISTS", KEYS[4]) == 0
+if created then
+	redis.call("HDEL", KEYS[2], rid)
+	redis.call("HDEL", KEYS[3], rid)
+end
+local rounds = #KEYS - 4
+for i = 5 + rounds, #ARGV, 3 do
+	if redis.call("HSETNX", KEYS[4], ARGV[i], ARGV[i + 1]) == 1 then
+		redis.call("HINCRBY", KEYS[2], rid, 1)
+		redis.call("HINCRBY", KEYS[3], rid, ARGV[i + 2])
+	end
+end
+redis.call("ZADD", KEYS[1], rid, rid)
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[4], ARGV[2])
+end
+
+local maxEntries, maxBytes = tonumber(ARGV[3]), tonumber(ARGV[4])
+local entries, bytes = 0, 0
+local live = {}
+for i = 1, rounds do
+	local r = ARGV[4 + i]
+	if redis.call("EXISTS", KEYS[4 + i]) == 1 then
+		entries = entries + tonumber(redis.call("HGET", KEYS[2], r) or 0)
+		bytes = bytes + tonumber(redis.call("HGET", KEYS[3], r) or 0)
+		live[#live + 1] = i
+	else
+		redis.call("ZREM", KEYS[1], r)
+		redis.call("HDEL", KEYS[2], r)
+		redis.call("HDEL", KEYS[3], r)
+	end
+end
+
+local evicted = {}
+for _, i in ipairs(live) do
+	if not ((maxEntries > 0 and entries > maxEntries) or (maxBytes > 0 and bytes > maxBytes)) then
+		break
+	end
+	local r = ARGV[4 + i]
+	local e = tonumber(redis.call("HGET", KEYS[2], r) or 0)
+	entries = entries - e
+	bytes = bytes - tonumber(redis.call("HGET", KEYS[3], r) or 0)
+	redis.call("DEL", KEYS[4 + i])
+	redis.call("ZREM", KEYS[1], r)
+	redis.call("HDEL", KEYS[2], r)
+	redis.call("HDEL", KEYS[3], r)
+	evicted[#evicted + 1] = r
+	evicted[#evicted + 1] = e
+end
+return evicted
+`)
+
+// swapNotificationsScript removes the passed in buffered rounds and returns the
+// notifications of each, in the order passed. The notifications within a round
+// are in no particular order.
+// KEYS[1] is the rounds key, KEYS[2] and KEYS[3] the entry and byte count
+// hashes, followed by the buffer key of each round, and ARGV holds the round
+// IDs in the same order.
+var swapNotificationsScript = redis.NewScript(`
+local out = {}
+for i = 4, #KEYS do
+	redis.call("ZREM", KEYS[1], ARGV[i - 3])
+	redis.call("HDEL", KEYS[2], ARGV[i - 3])
+	redis.call("HDEL", KEYS[3], ARGV[i - 3])
+	local vals = redis.call("HVALS", KEYS[i])
+	redis.call("DEL", KEYS[i])
+	for _, v in ipairs(vals) do
+		out[#out + 1] = v
+	end
+end
+return out
+`)
+
+// bufferedRounds returns the IDs of the rounds with buffered notifications, from
+// lowest to highest.
+func (r *RedisHotStore) bufferedRounds(ctx context.Context) ([]string, error) {
+	rids, err := r.client.ZRange(ctx, r.key("rounds"), 0, -1).Result()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get buffered rounds from redis")
+	}
+	return rids, nil
+}
+
+// AddNotifications adds the notifications of a round to its hash, keyed by
+// ephemeral ID and message hash so duplicates are skipped. Rounds evicted to
+// keep the buffer within its limits are logged. Rounds buffered by another bot
+// while this is called are not counted against the limits until the next call.
+func (r *RedisHotStore) AddNotifications(rid id.Round, l []*notifications.Data) error {
+	if len(l) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	rids, err := r.bufferedRounds(ctx)
+	if err != nil {
+		return err
+	}
+	round := strconv.FormatUint(uint64(rid), 10)
+	i := sort.Search(len(rids), func(i int) bool {
+		n, _ := strconv.ParseUint(rids[i], 10, 64)
+		return n >= uint64(rid)
+	})
+	if i == len(rids) || rids[i] != round {
+		rids = append(rids[:i], append([]string{round}, rids[i:]...)...)
+	}
+
+	limits := r.limits.Load()
+	keys := make([]string, 0, 4+len(rids))
+	keys = append(keys, r.key("rounds"), r.key("bufferEntries"), r.key("bufferBytes"), r.bufferKey(rid))
+	args := make([]interface{}, 0, 4+len(rids)+3*len(l))
+	args = append(args, round, limits.MaxAge.Milliseconds(), limits.MaxEntries, limits.MaxBytes)
+	for _, buffered := range rids {
+		keys = append(keys, r.key("buffer", buffered))
+		args = append(args, buffered)
+	}
+	for _, n := range l {
+		field := make([]byte, 8, 8+len(n.MessageHash))
+		binary.BigEndian.PutUint64(field, uint64(n.EphemeralID))
+		field = append(field, n.MessageHash...)
+		value, err := json.Marshal(n)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to encode notification")
+		}
+		args = append(args, string(field), string(value), DataSize(n))
+	}
+	evicted, err := addNotificationsScript.Run(ctx, r.client, keys, args...).Slice()
+	if err != nil && err != redis.Nil {
+		return errors.WithMessagef(err, "Failed to buffer notifications for round %d in redis", rid)
+	}
+	for i := 0; i+1 < len(evicted); i += 2 {
+		entries, _ := evicted[i+1].(int64)
+		rounds := r.evictedRounds.Add(1)
+		total := r.evictedEntries.Add(uint64(entries))
+		jww.WARN.Printf("Evicted %d notifications for round %v from the redis notification buffer (size limit); "+
+			"%d rounds and %d notifications evicted in total by this bot", entries, evicted[i], rounds, total)
+	}
+	return nil
+}
+
+// SwapNotifications removes and returns all buffered notifications. Each round
+// is removed atomically, so each notification is returned to only one bot.
+func (r *RedisHotStore) SwapNotifications() (map[int64][]*notifications.Data, error) {
+	ctx := context.Background()
+	outMap := make(map[int64][]*notifications.Data)
+	// Rounds buffered after this read are left for the next swap
+	rids, err := r.bufferedRounds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(rids) == 0 {
+		return outMap, nil
+	}
+	keys := make([]string, 0, 3+len(rids))
+	keys = append(keys, r.key("rounds"), r.key("bufferEntries"), r.key("bufferBytes"))
+	args := make([]interface{}, len(rids))
+	for i, rid := range rids {
+		keys = append(keys, r.key("buffer", rid))
+		args[i] = rid
+	}
+
+	vals, err := swapNotificationsScript.Run(ctx, r.client, keys, args...).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, errors.WithMessage(err, "Failed to swap notification buffer in redis")
+	}
+
+	for _, v := range vals {
+		n := &notifications.Data{}
+		if err = json.Unmarshal([]byte(v), n); err != nil {
+			jww.WARN.Printf("Dropping undecodable notification from redis: %+v", err)
+			continue
+		}
+		outMap[n.EphemeralID] = append(outMap[n.EphemeralID], n)
+	}
+	return outMap, nil
+}
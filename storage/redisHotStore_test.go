@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// newTestRedisHotStore returns a RedisHotStore on an in-process redis server.
+func newTestRedisHotStore(t *testing.T) (*RedisHotStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	r, err := NewRedisHotStore(RedisParams{Address: mr.Addr(), KeyPrefix: "test:"})
+	if err != nil {
+		t.Fatalf("Failed to create redis hot store: %+v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r, mr
+}
+
+// Tests that a RedisHotStore cannot be created without a server.
+func TestNewRedisHotStore_Error(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	_, err := NewRedisHotStore(RedisParams{Address: addr})
+	if err == nil {
+		t.Errorf("Expected an error connecting to a stopped server")
+	}
+}
+
+// Tests adding, reading and deleting ephemerals in redis.
+func TestRedisHotStore_Ephemerals(t *testing.T) {
+	r, _ := newTestRedisHotStore(t)
+
+	_, err := r.GetLatestEphemeral()
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Expected record not found from empty store, got %+v", err)
+	}
+
+	e1 := &Ephemeral{IntermediaryId: []byte("iid1"), EphemeralId: 5, Epoch: 10}
+	e2 := &Ephemeral{IntermediaryId: []byte("iid2"), EphemeralId: 5, Epoch: 11}
+	e3 := &Ephemeral{IntermediaryId: []byte("iid1"), EphemeralId: -6, Epoch: 11}
+	// Adding an ephemeral twice has no effect
+	for i := 0; i < 2; i++ {
+		if err = r.AddEphemerals([]*Ephemeral{e1, e2, e3}); err != nil {
+			t.Fatalf("Failed to add ephemerals: %+v", err)
+		}
+	}
+
+	eList, err := r.GetEphemerals([]int64{5, 7})
+	if err != nil {
+		t.Fatalf("Failed to get ephemerals: %+v", err)
+	}
+	if len(eList) != 2 {
+		t.Fatalf("Expected 2 ephemerals, got %d", len(eList))
+	}
+	for _, e := range eList {
+		if e.EphemeralId != 5 || !(e.Epoch == 10 && bytes.Equal(e.IntermediaryId, e1.IntermediaryId) ||
+			e.Epoch == 11 && bytes.Equal(e.IntermediaryId, e2.IntermediaryId)) {
+			t.Errorf("Unexpected ephemeral %+v", e)
+		}
+	}
+
+	latest, err := r.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get latest ephemeral: %+v", err)
+	}
+	if latest.Epoch != 11 {
+		t.Errorf("Expected latest ephemeral from epoch 11, got %+v", latest)
+	}
+
+	if err = r.DeleteOldEphemerals(11); err != nil {
+		t.Fatalf("Failed to delete old ephemerals: %+v", err)
+	}
+	eList, err = r.GetEphemerals([]int64{5, -6})
+	if err != nil {
+		t.Fatalf("Failed to get ephemerals: %+v", err)
+	}
+	if len(eList) != 2 {
+		t.Errorf("Expected only the ephemerals of epoch 11 to remain, got %+v", eList)
+	}
+	has, err := r.HasEphemerals([][]byte{[]byte("iid1"), []byte("iid2"), []byte("iid3")})
+	if err != nil {
+		t.Fatalf("Failed to check identities: %+v", err)
+	}
+	if !has["iid1"] || !has["iid2"] || has["iid3"] {
+		t.Errorf("Unexpected identities with ephemerals: %v", has)
+	}
+
+	if err = r.DeleteOldEphemerals(12); err != nil {
+		t.Fatalf("Failed to delete old ephemerals: %+v", err)
+	}
+	has, err = r.HasEphemerals([][]byte{[]byte("iid1"), []byte("iid2")})
+	if err != nil {
+		t.Fatalf("Failed to check identities: %+v", err)
+	}
+	if len(has) != 0 {
+		t.Errorf("Expected no identities with ephemerals, got %v", has)
+	}
+	_, err = r.GetLatestEphemeral()
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Expected record not found once all are deleted, got %+v", err)
+	}
+}
+
+// Tests that DeleteIdentityEphemerals removes every ephemeral of the passed in
+// identities and leaves the rest.
+func TestRedisHotStore_DeleteIdentityEphemerals(t *testing.T) {
+	r, _ := newTestRedisHotStore(t)
+
+	e1 := &Ephemeral{IntermediaryId: []byte("iid1"), EphemeralId: 5, Epoch: 10}
+	e2 := &Ephemeral{IntermediaryId: []byte("iid2"), EphemeralId: 5, Epoch: 10}
+	e3 := &Ephemeral{IntermediaryId: []byte("iid1"), EphemeralId: -6, Epoch: 11}
+	if err := r.AddEphemerals([]*Ephemeral{e1, e2, e3}); err != nil {
+		t.Fatalf("Failed to add ephemerals: %+v", err)
+	}
+
+	if err := r.DeleteIdentityEphemerals([][]byte{[]byte("iid1"), []byte("iid3")}); err != nil {
+		t.Fatalf("Failed to delete identity ephemerals: %+v", err)
+	}
+	eList, err := r.GetEphemerals([]int64{5, -6})
+	if err != nil {
+		t.Fatalf("Failed to get ephemerals: %+v", err)
+	}
+	if len(eList) != 1 || !bytes.Equal(eList[0].IntermediaryId, e2.IntermediaryId) {
+		t.Errorf("Expected only the ephemeral of iid2 to remain, got %+v", eList)
+	}
+	has, err := r.HasEphemerals([][]byte{[]byte("iid1"), []byte("iid2")})
+	if err != nil {
+		t.Fatalf("Failed to check identities: %+v", err)
+	}
+	if has["iid1"] || !has["iid2"] {
+		t.Errorf("Unexpected identities with ephemerals: %v", has)
+	}
+}
+
+// Tests that a round is only marked once until its ttl passes.
+func TestRedisHotStore_MarkRound(t *testing.T) {
+	r, mr := newTestRedisHotStore(t)
+
+	first, err := r.MarkRound(42, time.Minute)
+	if err != nil || !first {
+		t.Fatalf("Expected round to be marked, got %v %+v", first, err)
+	}
+	first, err = r.MarkRound(42, time.Minute)
+	if err != nil || first {
+		t.Errorf("Expected round to already be marked, got %v %+v", first, err)
+	}
+
+	mr.FastForward(2 * time.Minute)
+	first, err = r.MarkRound(42, time.Minute)
+	if err != nil || !first {
+		t.Errorf("Expected round to be marked again once expired, got %v %+v", first, err)
+	}
+}
+
+// Tests that buffered notifications are deduplicated, returned in round order
+// and removed when swapped.
+func TestRedisHotStore_Notifications(t *testing.T) {
+	r, _ := newTestRedisHotStore(t)
+
+	n := func(eid int64, rid uint64, hash string) *notifications.Data {
+		return &notifications.Data{EphemeralID: eid, RoundID: rid, IdentityFP: []byte("fp"), MessageHash: []byte(hash)}
+	}
+	err := r.AddNotifications(7, []*notifications.Data{n(1, 7, "a"), n(2, 7, "b")})
+	if err != nil {
+		t.Fatalf("Failed to add notifications: %+v", err)
+	}
+	err = r.AddNotifications(3, []*notifications.Data{n(1, 3, "c")})
+	if err != nil {
+		t.Fatalf("Failed to add notifications: %+v", err)
+	}
+	// The same notification from another gateway is dropped
+	err = r.AddNotifications(7, []*notifications.Data{n(1, 7, "a"), n(1, 7, "d")})
+	if err != nil {
+		t.Fatalf("Failed to add notifications: %+v", err)
+	}
+
+	m, err := r.SwapNotifications()
+	if err != nil {
+		t.Fatalf("Failed to swap notifications: %+v", err)
+	}
+	if len(m[1]) != 3 || len(m[2]) != 1 {
+		t.Fatalf("Unexpected notifications: %+v", m)
+	}
+	if m[1][0].RoundID != 3 || !bytes.Equal(m[1][0].IdentityFP, []byte("fp")) {
+		t.Errorf("Expected notifications sorted by round, got %+v", m[1])
+	}
+
+	m, err = r.SwapNotifications()
+	if err != nil {
+		t.Fatalf("Failed to swap notifications: %+v", err)
+	}
+	if len(m) != 0 {
+		t.Errorf("Expected empty buffer after swap, got %+v", m)
+	}
+}
+
+// Tests that swapping removes only the rounds passed to the script, so rounds
+// buffered after they are read are left for the next swap.
+func TestRedisHotStore_SwapNotifications_LaterRound(t *testing.T) {
+	r, _ := newTestRedisHotStore(t)
+
+	for _, rid := range []id.Round{1, 2} {
+		err := r.AddNotifications(rid, []*notifications.Data{{EphemeralID: 1, RoundID: uint64(rid), MessageHash: []byte("a")}})
+		if err != nil {
+			t.Fatalf("Failed to add notifications: %+v", err)
+		}
+	}
+	vals, err := swapNotificationsScript.Run(context.Background(), r.client,
+		[]string{r.key("rounds"), r.key("bufferEntries"), r.key("bufferBytes"), r.bufferKey(1)}, "1").StringSlice()
+	if err != nil || len(vals) != 1 {
+		t.Fatalf("Failed to swap round 1: %v %+v", vals, err)
+	}
+
+	m, err := r.SwapNotifications()
+	if err != nil {
+		t.Fatalf("Failed to swap notifications: %+v", err)
+	}
+	if len(m[1]) != 1 || m[1][0].RoundID != 2 {
+		t.Errorf("Expected only round 2 to be left, got %+v", m)
+	}
+}
+
+// Tests that buffered notifications expire after the max age.
+func TestRedisHotStore_NotificationsMaxAge(t *testing.T) {
+	r, mr := newTestRedisHotStore(t)
+	r.SetBufferLimits(BufferLimits{MaxAge: time.Minute})
+
+	err := r.AddNotifications(1, []*notifications.Data{{EphemeralID: 1, RoundID: 1, MessageHash: []byte("a")}})
+	if err != nil {
+		t.Fatalf("Failed to add notifications: %+v", err)
+	}
+	mr.FastForward(2 * time.Minute)
+	m, err := r.SwapNotifications()
+	if err != nil {
+		t.Fatalf("Failed to swap notifications: %+v", err)
+	}
+	if len(m) != 0 {
+		t.Errorf("Expected notifications past the max age to be dropped, got %+v", m)
+	}
+}
+
+// Tests that the oldest buffered rounds are evicted once the entry or byte
+// limit is exceeded, and that expired rounds are not counted.
+func TestRedisHotStore_NotificationsLimits(t *testing.T) {
+	r, mr := newTestRedisHotStore(t)
+	n := func(rid uint64, hash string) *notifications.Data {
+		return &notifications.Data{EphemeralID: 1, RoundID: rid, IdentityFP: []byte("fp"), MessageHash: []byte(hash)}
+	}
+	add := func(rid id.Round, l ...*notifications.Data) {
+		if err := r.AddNotifications(rid, l); err != nil {
+			t.Fatalf("Failed to add notifications for round %d: %+v", rid, err)
+		}
+	}
+	rounds := func() map[uint64]int {
+		m, err := r.SwapNotifications()
+		if err != nil {
+			t.Fatalf("Failed to swap notifications: %+v", err)
+		}
+		out := map[uint64]int{}
+		for _, n := range m[1] {
+			out[n.RoundID]++
+		}
+		return out
+	}
+
+	r.SetBufferLimits(BufferLimits{MaxEntries: 3})
+	add(2, n(2, "a"), n(2, "b"))
+	add(1, n(1, "c"))
+	// A duplicate is not counted
+	add(2, n(2, "a"))
+	add(3, n(3, "d"))
+	got := rounds()
+	if len(got) != 2 || got[2] != 2 || got[3] != 1 {
+		t.Errorf("Expected round 1 to be evicted by the entry limit, got %v", got)
+	}
+
+	r.SetBufferLimits(BufferLimits{MaxBytes: int(2 * DataSize(n(1, "a")))})
+	add(1, n(1, "a"))
+	add(2, n(2, "b"), n(2, "c"))
+	got = rounds()
+	if len(got) != 1 || got[2] != 2 {
+		t.Errorf("Expected round 1 to be evicted by the byte limit, got %v", got)
+	}
+
+	r.SetBufferLimits(BufferLimits{MaxEntries: 2, MaxAge: time.Minute})
+	add(1, n(1, "a"), n(1, "b"))
+	mr.FastForward(2 * time.Minute)
+	add(2, n(2, "c"), n(2, "d"))
+	got = rounds()
+	if len(got) != 1 || got[2] != 2 {
+		t.Errorf("Expected the expired round not to be counted, got %v", got)
+	}
+}
+
+// Tests that Storage keeps ephemerals in a RedisHotStore and still finds the
+// tokens to notify for them in the database.
+func TestStorage_RedisHotStore(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RedisHotStore", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	r, _ := newTestRedisHotStore(t)
+	s.SetHotStore(r)
+
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	_, err = s.RegisterForNotifications(iid, []byte("trsa"), "token", constants.MessengerIOS.String(), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register for notifications: %+v", err)
+	}
+	trackedIid := []byte("trackedIntermediaryIdOf32Bytes!!")
+	_, err = s.RegisterTrackedID([][]byte{trackedIid}, []byte("trsa"), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+
+	// Ephemerals are only held in redis
+	var count int64
+	s.Database.(*DatabaseImpl).db.Model(&Ephemeral{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Expected no ephemerals in the database, found %d", count)
+	}
+
+	e, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get latest ephemeral: %+v", err)
+	}
+	tracked, err := r.GetEphemerals([]int64{e.EphemeralId})
+	if err != nil || len(tracked) == 0 {
+		t.Fatalf("Failed to get ephemeral from redis: %+v", err)
+	}
+	var eids []int64
+	for _, iid := range [][]byte{iid, trackedIid} {
+		eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+		eids = append(eids, eid.Int64())
+	}
+
+	results, err := s.GetToNotify(eids)
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected a result for each ephemeral ID, got %+v", results)
+	}
+	for _, res := range results {
+		if res.Token != "token" {
+			t.Errorf("Unexpected result %+v", res)
+		}
+	}
+
+	orphaned, err := s.GetOrphanedIdentities()
+	if err != nil {
+		t.Fatalf("Failed to get orphaned identities: %+v", err)
+	}
+	if len(orphaned) != 0 {
+		t.Errorf("Expected no orphaned identities, got %d", len(orphaned))
+	}
+
+	err = s.DeleteOldEphemerals(epoch + 2)
+	if err != nil {
+		t.Fatalf("Failed to delete old ephemerals: %+v", err)
+	}
+	orphaned, err = s.GetOrphanedIdentities()
+	if err != nil {
+		t.Fatalf("Failed to get orphaned identities: %+v", err)
+	}
+	if len(orphaned) != 2 {
+		t.Errorf("Expected both identities to be orphaned, got %d", len(orphaned))
+	}
+	results, err = s.GetToNotify(eids)
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no results once ephemerals are deleted, got %+v", results)
+	}
+}
+
+// Tests that registrations whose ephemerals cannot be written to redis are
+// rolled back.
+func TestStorage_RedisHotStore_Consistency(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RedisHotStore_Consistency", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	r, mr := newTestRedisHotStore(t)
+	s.SetHotStore(r)
+	defer func(delay time.Duration) { hotStoreRetryDelay = delay }(hotStoreRetryDelay)
+	hotStoreRetryDelay = time.Millisecond
+
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	trackedIid := []byte("trackedIntermediaryIdOf32Bytes!!")
+
+	mr.SetError("unavailable")
+	_, err = s.RegisterForNotifications(iid, []byte("trsa"), "token", constants.MessengerIOS.String(), epoch, 16)
+	if err == nil {
+		t.Errorf("Expected an error registering while redis is unavailable")
+	}
+	results, err := s.RegisterTrackedID([][]byte{trackedIid}, []byte("trsa"), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if len(results) != 1 || results[0].Status != TrackedIDFailed {
+		t.Errorf("Expected the tracked ID to fail, got %+v", results)
+	}
+	for _, i := range [][]byte{iid, trackedIid} {
+		if _, err = s.GetIdentity(i); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("Expected identity %x to be rolled back, got %+v", i, err)
+		}
+	}
+	mr.SetError("")
+
+	results, err = s.RegisterTrackedID([][]byte{trackedIid}, []byte("trsa"), epoch, 16)
+	if err != nil || results[0].Status != TrackedIDCreated {
+		t.Fatalf("Failed to register tracked ID: %+v %+v", results, err)
+	}
+	has, err := r.HasEphemerals([][]byte{trackedIid})
+	if err != nil || !has[string(trackedIid)] {
+		t.Fatalf("Expected ephemerals for the tracked ID in redis: %v %+v", has, err)
+	}
+
+	// Legacy unregistration deletes the identity's ephemerals from redis
+	_, err = s.RegisterForNotifications(iid, []byte("legacy trsa"), "legacy token", constants.MessengerIOS.String(), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register for notifications: %+v", err)
+	}
+	err = s.LegacyUnregister(iid)
+	if err != nil {
+		t.Fatalf("Failed to legacy unregister: %+v", err)
+	}
+	has, err = r.HasEphemerals([][]byte{iid})
+	if err != nil || has[string(iid)] {
+		t.Errorf("Expected the unregistered identity's ephemerals to be deleted from redis: %v %+v", has, err)
+	}
+}
@@ -8,27 +8,69 @@
 package storage
 
 import (
-	"fmt"
 	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/elixxir/notifications-bot/privacy"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"gorm.io/gorm"
+	"io"
+	"runtime"
+	"sync"
 	"time"
 )
 
+// ErrReplayedRequest is returned when a signed request has already been seen.
+var ErrReplayedRequest = errors.New("Request signature has already been used")
+
 type Storage struct {
-	database
-	notificationBuffer *NotificationBuffer
+	Database
+	hot        HotStore
+	encryptor  *FieldEncryptor
+	tokenCache *tokenCache
+	lookAhead  time.Duration
 }
 
-// NewStorage creates a new Storage object with the given connection parameters
+// DefaultEphemeralLookAhead is how far ahead of the current time ephemerals
+// are generated if no look-ahead is set.
+const DefaultEphemeralLookAhead = 5 * time.Minute
+
+// NewStorage creates a new Storage object with the given connection parameters.
+// Without an address, it uses an in-memory database for tests.
 func NewStorage(username, password, dbName, address, port string) (*Storage, error) {
-	db, err := newDatabase(username, password, dbName, address, port)
-	nb := NewNotificationBuffer()
-	storage := &Storage{db, nb}
+	params := DatabaseParams{
+		Username: username,
+		Password: password,
+		Name:     dbName,
+		Address:  address,
+		Port:     port,
+	}
+	if address == "" {
+		params.SQLitePath = SQLiteInMemory
+	}
+	return NewStorageWithParams(params)
+}
+
+// NewStorageWithParams creates a new Storage object on the database described
+// by the passed in parameters.
+func NewStorageWithParams(params DatabaseParams) (*Storage, error) {
+	db, err := openDatabase(params)
+	storage := &Storage{Database: db, hot: newLocalHotStore(db)}
 	return storage, err
 }
 
+// Close stops the background tasks of the storage and closes its database
+// connections, and the connection to the hot store if it has one.
+func (s *Storage) Close() error {
+	err := s.Database.Close()
+	if closer, ok := s.hot.(io.Closer); ok {
+		if hotErr := closer.Close(); err == nil {
+			err = hotErr
+		}
+	}
+	return err
+}
+
 // RegisterToken registers a token to a user based on their transmission RSA
 func (s *Storage) RegisterToken(token, app string, transmissionRSA []byte) error {
 	transmissionRSAHash, err := getHash(transmissionRSA)
@@ -36,27 +78,33 @@ func (s *Storage) RegisterToken(token, app string, transmissionRSA []byte) error
 		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
 
-	u, err := s.GetUser(transmissionRSAHash)
+	t, err := s.sealToken(token, app, transmissionRSAHash)
+	if err != nil {
+		return err
+	}
+	// Registering a token may move it from another user
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateTokens(t.Token)
+	defer s.tokenCache.invalidateUser(transmissionRSAHash)
+
+	_, err = s.Database.GetUser(transmissionRSAHash)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u = &User{
-				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
-				Tokens: []Token{
-					{Token: token, TransmissionRSAHash: transmissionRSAHash, App: app},
-				},
+			sealedRSA, err := s.sealTransmissionRSA(transmissionRSA, transmissionRSAHash)
+			if err != nil {
+				return err
 			}
-			return s.insertUser(u)
+			return s.insertUser(&User{
+				TransmissionRSAHash: transmissionRSAHash,
+				TransmissionRSA:     sealedRSA,
+				Tokens:              []Token{t},
+			})
 		} else {
 			return err
 		}
 	}
 
-	return s.database.insertToken(Token{
-		App:                 app,
-		Token:               token,
-		TransmissionRSAHash: transmissionRSAHash,
-	})
+	return s.Database.insertToken(t)
 }
 
 // UnregisterToken token unregisters a token from the user with the passed in RSA
@@ -65,8 +113,10 @@ func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 	if err != nil {
 		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateUser(transmissionRSAHash)
 
-	u, err := s.GetUser(transmissionRSAHash)
+	u, err := s.Database.GetUser(transmissionRSAHash)
 	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return errors.WithMessage(err, "Failed to retrieve user")
@@ -74,7 +124,11 @@ func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 		return nil
 	}
 
-	err = s.database.unregisterTokens(u, []Token{{Token: token}})
+	var tokens []Token
+	for _, key := range s.tokenKeys(token) {
+		tokens = append(tokens, Token{Token: key})
+	}
+	err = s.Database.unregisterTokens(u, tokens)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil
@@ -84,54 +138,193 @@ func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 	return nil
 }
 
-// RegisterTrackedID registers a tracked ID for the user with the passed in RSA
-func (s *Storage) RegisterTrackedID(iidList [][]byte, transmissionRSA []byte, epoch int32, addressSpace uint8) error {
+// intermediaryIdLen is the length of an intermediary ID, which is a BLAKE2b-256 hash of the ID.
+const intermediaryIdLen = 32
+
+// TrackedIDStatus describes the outcome of registering a single tracked ID.
+type TrackedIDStatus uint8
+
+const (
+	// TrackedIDCreated indicates the ID is newly tracked for the user
+	TrackedIDCreated TrackedIDStatus = iota
+	// TrackedIDAlreadyTracked indicates the user was already tracking the ID
+	TrackedIDAlreadyTracked
+	// TrackedIDFailed indicates the ID could not be registered
+	TrackedIDFailed
+)
+
+func (s TrackedIDStatus) String() string {
+	switch s {
+	case TrackedIDCreated:
+		return "created"
+	case TrackedIDAlreadyTracked:
+		return "already-tracked"
+	case TrackedIDFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// TrackedIDResult holds the outcome of registering one ID in RegisterTrackedID.
+type TrackedIDResult struct {
+	IntermediaryId []byte
+	Status         TrackedIDStatus
+	Err            error
+}
+
+// RegisterTrackedID registers a list of tracked IDs for the user with the passed in RSA.
+// The user, any new identities & their ephemerals, and the user's links to
+// each identity are written in a single transaction. If it fails, each ID is
+// written in its own transaction. IDs which cannot be registered are reported
+// as failed without aborting the rest of the list. If ephemerals are held in
+// the hot store and cannot be written to it, the new links are rolled back
+// and their IDs reported as failed.
+// Ephemerals are generated for each of the passed in address space sizes.
+func (s *Storage) RegisterTrackedID(iidList [][]byte, transmissionRSA []byte, epoch int32, addressSpaces ...uint8) ([]TrackedIDResult, error) {
 	transmissionRSAHash, err := getHash(transmissionRSA)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
+		return nil, errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
 
-	u, err := s.GetUser(transmissionRSAHash)
+	now := time.Now()
+	results := make([]TrackedIDResult, len(iidList))
+	ephemerals := make(map[string][]*Ephemeral, len(iidList))
+	var ids []Identity
+	for i, iid := range iidList {
+		results[i].IntermediaryId = iid
+		if _, exists := ephemerals[string(iid)]; exists {
+			continue
+		}
+		if len(iid) != intermediaryIdLen {
+			results[i].Status = TrackedIDFailed
+			results[i].Err = errors.Errorf("Intermediary ID must be %d bytes, received %d", intermediaryIdLen, len(iid))
+			continue
+		}
+		eList, err := getLatestEphemerals(iid, epoch, addressSpaces, now, s.ephemeralLookAhead())
+		if err != nil {
+			results[i].Status = TrackedIDFailed
+			results[i].Err = err
+			continue
+		}
+		ephemerals[string(iid)] = eList
+		ids = append(ids, Identity{
+			IntermediaryId: iid,
+			OffsetNum:      ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)),
+		})
+	}
+
+	sealedRSA, err := s.sealTransmissionRSA(transmissionRSA, transmissionRSAHash)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u = &User{
-				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
+		return nil, err
+	}
+	u := &User{
+		TransmissionRSAHash: transmissionRSAHash,
+		TransmissionRSA:     sealedRSA,
+	}
+	defer s.refreshTokenCache()
+	defer s.invalidateTracked(transmissionRSAHash, ids, ephemerals)
+
+	// Ephemerals held outside the database are added once the identities exist
+	dbEphemerals := ephemerals
+	if !s.ephemeralsInDatabase() {
+		dbEphemerals = nil
+	}
+	alreadyTracked, err := s.Database.registerTrackedIdentitiesBulk(u, ids, dbEphemerals)
+	if err != nil {
+		// Register the identities one at a time so only the failing IDs are lost
+		jww.DEBUG.Printf("Failed to register %d tracked identities together, registering individually: %+v", len(ids), err)
+		alreadyTracked = make(map[string]bool, len(ids))
+		failed := make(map[string]error)
+		registered := make([]Identity, 0, len(ids))
+		for _, identity := range ids {
+			iid := string(identity.IntermediaryId)
+			var single map[string][]*Ephemeral
+			if dbEphemerals != nil {
+				single = map[string][]*Ephemeral{iid: dbEphemerals[iid]}
 			}
-			err = s.insertUser(u)
+			tracked, err := s.Database.registerTrackedIdentitiesBulk(u, []Identity{identity}, single)
 			if err != nil {
-				return errors.WithMessage(err, "Failed to register user")
+				failed[iid] = errors.WithMessage(err, "Failed to register tracked identity")
+				continue
+			}
+			alreadyTracked[iid] = tracked[iid]
+			registered = append(registered, identity)
+		}
+		ids = registered
+		for i := range results {
+			if err, ok := failed[string(results[i].IntermediaryId)]; ok {
+				results[i].Status = TrackedIDFailed
+				results[i].Err = err
 			}
-		} else {
-			return errors.WithMessage(err, "Failed to look up user")
 		}
 	}
-
-	var ids []Identity
-	for _, iid := range iidList {
-		identity, err := s.GetIdentity(iid)
+	if dbEphemerals == nil {
+		var eList []*Ephemeral
+		for _, identity := range ids {
+			eList = append(eList, ephemerals[string(identity.IntermediaryId)]...)
+		}
+		err = retryHotStore(func() error { return s.hot.AddEphemerals(eList) })
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				identity = &Identity{
-					IntermediaryId: iid,
-					OffsetNum:      ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)),
-				}
-				err = s.insertIdentity(identity)
-				if err != nil {
-					return err
-				}
-				_, err = s.AddLatestEphemeral(identity, epoch, uint(addressSpace))
-				if err != nil {
-					return err
+			err = errors.WithMessage(err, "Failed to add ephemerals for tracked identity")
+			if rbErr := s.untrackNewIdentities(transmissionRSAHash, ids, alreadyTracked); rbErr != nil {
+				return nil, errors.WithMessagef(rbErr, "%v, and failed to roll back", err)
+			}
+			for i := range results {
+				if results[i].Status != TrackedIDFailed && !alreadyTracked[string(results[i].IntermediaryId)] {
+					results[i].Status = TrackedIDFailed
+					results[i].Err = err
 				}
-			} else {
-				return err
 			}
 		}
-		ids = append(ids, *identity)
 	}
 
-	return s.database.registerTrackedIdentities(*u, ids)
+	for i := range results {
+		if results[i].Status == TrackedIDFailed {
+			continue
+		}
+		if alreadyTracked[string(results[i].IntermediaryId)] {
+			results[i].Status = TrackedIDAlreadyTracked
+		} else {
+			results[i].Status = TrackedIDCreated
+		}
+	}
+	return results, nil
+}
+
+// untrackNewIdentities removes the links between a user and those of the
+// passed in identities it did not already track, after their ephemerals could
+// not be written to the hot store. Identities left without a user are deleted,
+// along with any of their ephemerals which were written.
+func (s *Storage) untrackNewIdentities(transmissionRSAHash []byte, ids []Identity, alreadyTracked map[string]bool) error {
+	var iids [][]byte
+	for _, identity := range ids {
+		if !alreadyTracked[string(identity.IntermediaryId)] {
+			iids = append(iids, identity.IntermediaryId)
+		}
+	}
+	if len(iids) == 0 {
+		return nil
+	}
+	deleted, err := s.Database.untrackIdentities(transmissionRSAHash, iids)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to remove tracked identities")
+	}
+	// Ephemerals left behind have no tokens to notify and expire with their epoch
+	if err = s.deleteHotEphemerals(deleted); err != nil {
+		jww.WARN.Printf("Failed to delete ephemerals of untracked identities: %+v", err)
+	}
+	return nil
+}
+
+// invalidateTracked removes the cache entries affected by registering the
+// passed in identities and their ephemerals to a user.
+func (s *Storage) invalidateTracked(transmissionRSAHash []byte, ids []Identity, ephemerals map[string][]*Ephemeral) {
+	s.tokenCache.invalidateUser(transmissionRSAHash)
+	for _, identity := range ids {
+		s.tokenCache.invalidateIdentities(identity.IntermediaryId)
+		s.tokenCache.invalidateEphemerals(ephemeralIds(ephemerals[string(identity.IntermediaryId)])...)
+	}
 }
 
 // UnregisterTrackedIDs unregisters a tracked id from the user with the passed in RSA
@@ -141,7 +334,7 @@ func (s *Storage) UnregisterTrackedIDs(trackedIdList [][]byte, transmissionRSA [
 		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
 
-	u, err := s.GetUser(transmissionRSAHash)
+	u, err := s.Database.GetUser(transmissionRSAHash)
 	if err != nil {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return errors.WithMessage(err, "Failed to retrieve user")
@@ -153,8 +346,10 @@ func (s *Storage) UnregisterTrackedIDs(trackedIdList [][]byte, transmissionRSA [
 	for _, i := range trackedIdList {
 		ids = append(ids, Identity{IntermediaryId: i})
 	}
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateUser(transmissionRSAHash)
 
-	err = s.database.unregisterIdentities(u, ids)
+	err = s.Database.unregisterIdentities(u, ids)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil
@@ -165,13 +360,22 @@ func (s *Storage) UnregisterTrackedIDs(trackedIdList [][]byte, transmissionRSA [
 }
 
 // RegisterForNotifications registers a user with the passed in transmissionRSA
-// to receive notifications on the identity with intermediary id iid, with the passed in token
-func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, app string, epoch int32, addressSpace uint8) (*User, error) {
+// to receive notifications on the identity with intermediary id iid, with the passed in token.
+// Ephemerals for a new identity are generated for each of the passed in address space sizes.
+func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, app string, epoch int32, addressSpaces ...uint8) (*User, error) {
 	transmissionRSAHash, err := getHash(transmissionRSA)
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
-	identity, err := s.GetIdentity(iid)
+	t, err := s.sealToken(token, app, transmissionRSAHash)
+	if err != nil {
+		return nil, err
+	}
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateTokens(t.Token)
+	defer s.tokenCache.invalidateUser(transmissionRSAHash)
+	defer s.tokenCache.invalidateIdentities(iid)
+	identity, err := s.Database.GetIdentity(iid)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			identity = &Identity{
@@ -182,8 +386,12 @@ func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, a
 			if err != nil {
 				return nil, err
 			}
-			_, err = s.AddLatestEphemeral(identity, epoch, uint(addressSpace))
+			_, err = s.AddLatestEphemeral(identity, epoch, addressSpaces...)
 			if err != nil {
+				// Remove the new identity so it is not left without ephemerals
+				if rbErr := s.untrackNewIdentities(transmissionRSAHash, []Identity{*identity}, nil); rbErr != nil {
+					jww.ERROR.Printf("Failed to roll back identity %s: %+v", privacy.Bytes(iid), rbErr)
+				}
 				return nil, err
 			}
 		} else {
@@ -191,91 +399,269 @@ func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, a
 		}
 	}
 
-	u, err := s.GetUser(transmissionRSAHash)
+	u, err := s.Database.GetUser(transmissionRSAHash)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			var sealedRSA []byte
+			sealedRSA, err = s.sealTransmissionRSA(transmissionRSA, transmissionRSAHash)
+			if err != nil {
+				return nil, err
+			}
 			u = &User{
 				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
-				Tokens: []Token{
-					{Token: token, TransmissionRSAHash: transmissionRSAHash, App: app},
-				}, Identities: []Identity{*identity},
+				TransmissionRSA:     sealedRSA,
+				Tokens:              []Token{t},
+				Identities:          []Identity{*identity},
 			}
-			return u, s.insertUser(u)
+			err = s.insertUser(u)
 		} else {
 			return nil, err
 		}
+	} else {
+		err = s.registerForNotifications(u, *identity, t)
+	}
+	if err != nil {
+		return u, err
 	}
+	return u, s.openUser(u)
+}
 
-	return u, s.registerForNotifications(u, *identity, Token{Token: token, App: app, TransmissionRSAHash: transmissionRSAHash})
+// SetEphemeralLookAhead sets how far ahead of the current time ephemerals are
+// generated when an identity is registered.
+func (s *Storage) SetEphemeralLookAhead(lookAhead time.Duration) {
+	s.lookAhead = lookAhead
 }
 
-// AddLatestEphemeral generates an ephemeral ID for the passed in identity and adds it to storage
-func (s *Storage) AddLatestEphemeral(i *Identity, epoch int32, size uint) (*Ephemeral, error) {
-	now := time.Now()
-	eid, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, now.UnixNano())
-	if err != nil {
-		return nil, errors.WithMessage(err, "Failed to get ephemeral id for user")
+// ephemeralLookAhead returns how far ahead of the current time ephemerals are
+// generated.
+func (s *Storage) ephemeralLookAhead() time.Duration {
+	if s.lookAhead <= 0 {
+		return DefaultEphemeralLookAhead
 	}
+	return s.lookAhead
+}
 
-	e := &Ephemeral{
-		IntermediaryId: i.IntermediaryId,
-		EphemeralId:    eid.Int64(),
-		Epoch:          epoch,
-	}
-	err = s.insertEphemeral(e)
+// AddLatestEphemeral generates an ephemeral ID for the passed in identity for
+// each address space size and adds them to storage, retrying a failed write.
+func (s *Storage) AddLatestEphemeral(i *Identity, epoch int32, sizes ...uint8) (*Ephemeral, error) {
+	eList, err := getLatestEphemerals(i.IntermediaryId, epoch, sizes, time.Now(), s.ephemeralLookAhead())
 	if err != nil {
 		return nil, err
 	}
 
-	eid2, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, now.Add(5*time.Minute).UnixNano())
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateEphemerals(ephemeralIds(eList)...)
+	err = retryHotStore(func() error { return s.hot.AddEphemerals(eList) })
 	if err != nil {
-		return nil, errors.WithMessage(err, "Failed to get ephemeral id for user")
+		return nil, err
 	}
-	if eid2.Int64() != eid.Int64() {
-		e := &Ephemeral{
-			IntermediaryId: i.IntermediaryId,
-			EphemeralId:    eid2.Int64(),
-			Epoch:          epoch + 1,
-		}
-		fmt.Printf("Adding ephemeral: %+v\n", e)
-		err = s.insertEphemeral(e)
-		if err != nil {
-			return nil, err
+
+	return eList[0], nil
+}
+
+// getLatestEphemerals returns the ephemeral for the passed in intermediary ID
+// at time now, and every following ephemeral which becomes valid before
+// now+lookAhead, for each of the passed in address space sizes.
+func getLatestEphemerals(iid []byte, epoch int32, sizes []uint8, now time.Time, lookAhead time.Duration) ([]*Ephemeral, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("No address space size to generate ephemeral IDs for")
+	}
+	end := now.Add(lookAhead)
+	var eList []*Ephemeral
+	for _, size := range sizes {
+		t, tEpoch := now, epoch
+		for !t.After(end) {
+			eid, _, validUntil, err := ephemeral.GetIdFromIntermediary(iid, uint(size), t.UnixNano())
+			if err != nil {
+				return nil, errors.WithMessage(err, "Failed to get ephemeral id for user")
+			}
+			e := &Ephemeral{
+				IntermediaryId: iid,
+				EphemeralId:    eid.Int64(),
+				Epoch:          tEpoch,
+			}
+			if !t.Equal(now) {
+				jww.DEBUG.Printf("Adding ephemeral %s for identity %s at epoch %d", privacy.EphemeralID(e.EphemeralId), privacy.Bytes(iid), e.Epoch)
+			}
+			eList = append(eList, e)
+
+			// The next ephemeral ID is valid from the end of this one
+			t = validUntil
+			_, tEpoch = ephemeral.HandleQuantization(t)
 		}
 	}
 
-	return e, err
+	return eList, nil
 }
 
-// AddEphemeralsForOffset generates new ephemerals for all identities with the given offset, using the passed in parameters
-func (s *Storage) AddEphemeralsForOffset(offset int64, epoch int32, size uint, t time.Time) error {
+// ephemeralWorkers is the number of goroutines computing ephemeral IDs when
+// generating the ephemerals for an offset.
+var ephemeralWorkers = runtime.NumCPU()
+
+// AddEphemeralsForOffset generates new ephemerals for all identities with the given offset, using the passed in parameters.
+// An ephemeral is generated for each of the passed in address space sizes.
+// IDs are computed in parallel and stored in batches. Identities whose
+// ephemerals cannot be generated or stored do not stop the rest; they are
+// reported in the returned error once all others have been stored.
+func (s *Storage) AddEphemeralsForOffset(offset int64, epoch int32, t time.Time, sizes ...uint8) error {
 	identities, err := s.getIdentitiesByOffset(offset)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return errors.WithMessage(err, "Failed to get users for given offset")
 	}
-	if len(identities) > 0 {
-		fmt.Println(fmt.Sprintf("Adding ephemerals for identities: %+v", identities))
+	if len(identities) == 0 {
+		return nil
+	}
+	jww.DEBUG.Printf("Adding ephemerals for %d identities at offset %d", len(identities), offset)
+
+	eList, failed := generateEphemerals(identities, epoch, t, sizes)
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateEphemerals(ephemeralIds(eList)...)
+	for start := 0; start < len(eList); start += ephemeralInsertBatchSize {
+		end := start + ephemeralInsertBatchSize
+		if end > len(eList) {
+			end = len(eList)
+		}
+		if err = s.hot.AddEphemerals(eList[start:end]); err == nil {
+			continue
+		}
+
+		// Insert the batch one row at a time so only the failing rows are lost
+		jww.DEBUG.Printf("Failed to insert batch of ephemerals at offset %d, inserting individually: %+v", offset, err)
+		for _, e := range eList[start:end] {
+			if err = s.hot.AddEphemerals([]*Ephemeral{e}); err != nil {
+				failed[string(e.IntermediaryId)] = errors.WithMessage(err, "Failed to insert ephemeral ID for user")
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	var firstErr error
+	for iid, err := range failed {
+		jww.DEBUG.Printf("Failed to add ephemerals for identity %s at offset %d: %+v", privacy.Bytes([]byte(iid)), offset, err)
+		firstErr = err
 	}
-	for _, i := range identities {
-		eid, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, t.UnixNano())
+	return errors.WithMessagef(firstErr, "Failed to add ephemerals for %d of %d identities at offset %d",
+		len(failed), len(identities), offset)
+}
+
+// generateEphemerals computes the ephemerals of each identity at the passed in
+// time for each address space size, split across ephemeralWorkers goroutines.
+// Identities whose IDs cannot be computed are returned with their error,
+// keyed by intermediary ID.
+func generateEphemerals(identities []*Identity, epoch int32, t time.Time,
+	sizes []uint8) ([]*Ephemeral, map[string]error) {
+	results := make([][]*Ephemeral, len(identities))
+	errs := make([]error, len(identities))
+
+	workers := ephemeralWorkers
+	if workers > len(identities) {
+		workers = len(identities)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	chunkSize := (len(identities) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(identities); start += chunkSize {
+		end := start + chunkSize
+		if end > len(identities) {
+			end = len(identities)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				results[i], errs[i] = identityEphemerals(identities[i].IntermediaryId, epoch, t, sizes)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	eList := make([]*Ephemeral, 0, len(identities)*len(sizes))
+	failed := make(map[string]error)
+	for i, identityList := range results {
+		if errs[i] != nil {
+			failed[string(identities[i].IntermediaryId)] = errs[i]
+			continue
+		}
+		eList = append(eList, identityList...)
+	}
+	return eList, failed
+}
+
+// identityEphemerals returns the ephemerals of an intermediary ID at the passed
+// in time for each address space size.
+func identityEphemerals(iid []byte, epoch int32, t time.Time, sizes []uint8) ([]*Ephemeral, error) {
+	eList := make([]*Ephemeral, 0, len(sizes))
+	for _, size := range sizes {
+		eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, uint(size), t.UnixNano())
 		if err != nil {
-			return errors.WithMessage(err, "Failed to get eid for user")
+			return nil, errors.WithMessage(err, "Failed to get eid for user")
 		}
-		err = s.insertEphemeral(&Ephemeral{
-			IntermediaryId: i.IntermediaryId,
+		eList = append(eList, &Ephemeral{
+			IntermediaryId: iid,
 			EphemeralId:    eid.Int64(),
 			Epoch:          epoch,
 		})
+	}
+	return eList, nil
+}
+
+// BackfillEphemerals generates ephemerals for every identity, covering every
+// ephemeral ID valid at any time between from and to. The address space sizes
+// of each offset are those sizes returns for the time it is generated at.
+// Ephemerals which are already stored are left as they are, so a range may be
+// backfilled repeatedly. An offset which fails does not stop the backfill.
+// Returns the number of offsets generated.
+// A range starting more than one ephemeral period ago is rejected: the IDs
+// valid only before then have expired, and the deleter would remove them.
+func (s *Storage) BackfillEphemerals(from, to time.Time, sizes func(time.Time) []uint8) (int, error) {
+	if !from.Before(to) {
+		return 0, errors.Errorf("Backfill start %s must be before end %s", from, to)
+	}
+	if oldest := time.Now().Add(-time.Duration(ephemeral.Period)); from.Before(oldest) {
+		return 0, errors.Errorf("Backfill start %s is more than one ephemeral period "+
+			"(%s) ago; ephemerals valid before %s have expired", from, time.Duration(ephemeral.Period), oldest)
+	}
+	// IDs valid at from may have been generated up to a period earlier
+	count, failed := 0, 0
+	step := time.Duration(ephemeral.NsPerOffset)
+	for t := from.Add(-time.Duration(ephemeral.Period)).Add(step); !t.After(to); t = t.Add(step) {
+		offset, epoch := ephemeral.HandleQuantization(t)
+		err := s.AddEphemeralsForOffset(offset, epoch, t, sizes(t)...)
 		if err != nil {
-			return errors.WithMessage(err, "Failed to insert ephemeral ID for user")
+			jww.WARN.Printf("Failed to backfill ephemerals at %s: %+v", t, err)
+			failed++
 		}
+		count++
 	}
-	return nil
+	if failed > 0 {
+		return count, errors.Errorf("Failed to backfill ephemerals for %d of %d offsets", failed, count)
+	}
+	return count, nil
 }
 
-func (s *Storage) GetNotificationBuffer() *NotificationBuffer {
-	return s.notificationBuffer
+// RecordRequestSignature stores the hash of a signed request's signature until
+// expiry. It returns an error if the signature has already been recorded,
+// indicating that the request is being replayed.
+func (s *Storage) RecordRequestSignature(signature []byte, expiry time.Time) error {
+	h, err := getHash(signature)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash request signature")
+	}
+	inserted, err := s.insertRequestSignature(&RequestSignature{
+		Hash:   h,
+		Expiry: expiry,
+	})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to record request signature")
+	}
+	if !inserted {
+		return ErrReplayedRequest
+	}
+	return nil
 }
 
 func getHash(transmissionRSA []byte) (transmissionRSAHash []byte, err error) {
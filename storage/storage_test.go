@@ -9,6 +9,9 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/xx_network/crypto/csprng"
 	"gitlab.com/xx_network/crypto/signature/rsa"
@@ -71,17 +74,193 @@ func TestStorage_RegisterTrackedID(t *testing.T) {
 		t.Fatalf("Failed to register token: %+v", err)
 	}
 
-	err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
+	_, err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
 	if err != nil {
 		t.Fatalf("Received error registering identity: %+v", err)
 	}
 
-	err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
+	_, err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
 	if err != nil {
 		t.Fatalf("Received unexpected error on duplicate identity registration: %+v", err)
 	}
 }
 
+// Tests that RegisterTrackedID reports the outcome of each ID in the list.
+func TestStorage_RegisterTrackedID_Results(t *testing.T) {
+	s, err := NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	var iids [][]byte
+	for i := 0; i < 250; i++ {
+		testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+		if err != nil {
+			t.Fatalf("Failed to generate test ID: %+v", err)
+		}
+		iid, err := ephemeral.GetIntermediaryId(testId)
+		if err != nil {
+			t.Fatalf("Failed to generate intermediary ID: %+v", err)
+		}
+		iids = append(iids, iid)
+	}
+
+	results, err := s.RegisterTrackedID(iids[:100], pub, epoch, 16)
+	if err != nil {
+		t.Fatalf("Received error registering identities: %+v", err)
+	}
+	for i, res := range results {
+		if res.Status != TrackedIDCreated {
+			t.Errorf("Result %d had unexpected status %s: %+v", i, res.Status, res.Err)
+		}
+	}
+
+	list := append([][]byte{[]byte("short")}, iids...)
+	results, err = s.RegisterTrackedID(list, pub, epoch, 16)
+	if err != nil {
+		t.Fatalf("Received error registering identities: %+v", err)
+	}
+	if len(results) != len(list) {
+		t.Fatalf("Expected %d results, received %d", len(list), len(results))
+	}
+	if results[0].Status != TrackedIDFailed || results[0].Err == nil {
+		t.Errorf("Invalid intermediary ID should have failed, instead got %s", results[0].Status)
+	}
+	for i, res := range results[1:] {
+		expected := TrackedIDCreated
+		if i < 100 {
+			expected = TrackedIDAlreadyTracked
+		}
+		if res.Status != expected {
+			t.Errorf("Result %d had status %s, expected %s: %+v", i+1, res.Status, expected, res.Err)
+		}
+	}
+
+	trsaHash, err := getHash(pub)
+	if err != nil {
+		t.Fatalf("Failed to get trsa hash: %+v", err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if len(u.Identities) != len(iids) {
+		t.Errorf("User should track %d identities, found %d", len(iids), len(u.Identities))
+	}
+
+	orphaned, err := s.GetOrphanedIdentities()
+	if err != nil {
+		t.Fatalf("Failed to get orphaned identities: %+v", err)
+	}
+	if len(orphaned) != 0 {
+		t.Errorf("New identities should have ephemerals, found %d orphaned", len(orphaned))
+	}
+}
+
+// Tests that intermediary IDs which are not 32 bytes are rejected, and that
+// the rest of the list is still registered.
+func TestStorage_RegisterTrackedID_IntermediaryIdLength(t *testing.T) {
+	s, err := NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	invalid := [][]byte{{}, iid[:intermediaryIdLen-1], append(append([]byte{}, iid...), 0)}
+	results, err := s.RegisterTrackedID(append(invalid, iid), pub, epoch, 16)
+	if err != nil {
+		t.Fatalf("Received error registering identities: %+v", err)
+	}
+	for i := range invalid {
+		if results[i].Status != TrackedIDFailed || results[i].Err == nil {
+			t.Errorf("%d byte intermediary ID should have failed, instead got %s", len(invalid[i]), results[i].Status)
+		}
+		if _, err = s.GetIdentity(invalid[i]); err == nil {
+			t.Errorf("%d byte intermediary ID should not be stored", len(invalid[i]))
+		}
+	}
+	if results[len(invalid)].Status != TrackedIDCreated {
+		t.Errorf("Valid intermediary ID should be created, instead got %s: %+v",
+			results[len(invalid)].Status, results[len(invalid)].Err)
+	}
+}
+
+// failingBulkDatabase fails to register any list of tracked identities
+// containing the intermediary ID fail.
+type failingBulkDatabase struct {
+	Database
+	fail []byte
+}
+
+func (f *failingBulkDatabase) registerTrackedIdentitiesBulk(u *User, ids []Identity, ephemerals map[string][]*Ephemeral) (map[string]bool, error) {
+	for _, identity := range ids {
+		if bytes.Equal(identity.IntermediaryId, f.fail) {
+			return nil, errors.New("registration failure")
+		}
+	}
+	return f.Database.registerTrackedIdentitiesBulk(u, ids, ephemerals)
+}
+
+// Tests that a database error registering one ID only fails that ID.
+func TestStorage_RegisterTrackedID_DatabaseFailure(t *testing.T) {
+	s, err := NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	var iids [][]byte
+	for i := 0; i < 3; i++ {
+		iid, err := ephemeral.GetIntermediaryId(id.NewIdFromUInt(uint64(i), id.User, t))
+		if err != nil {
+			t.Fatalf("Failed to generate intermediary ID: %+v", err)
+		}
+		iids = append(iids, iid)
+	}
+	s.Database = &failingBulkDatabase{Database: s.Database, fail: iids[1]}
+
+	results, err := s.RegisterTrackedID(iids, pub, epoch, 16)
+	if err != nil {
+		t.Fatalf("Received error registering identities: %+v", err)
+	}
+	for i, res := range results {
+		expected := TrackedIDCreated
+		if i == 1 {
+			expected = TrackedIDFailed
+		}
+		if res.Status != expected {
+			t.Errorf("Result %d had status %s, expected %s: %+v", i, res.Status, expected, res.Err)
+		}
+	}
+	for i, iid := range iids {
+		_, err = s.GetIdentity(iid)
+		if stored := err == nil; stored != (i != 1) {
+			t.Errorf("Identity %d stored: %t", i, stored)
+		}
+	}
+}
+
 func TestStorage_UnregisterToken(t *testing.T) {
 	s, err := NewStorage("", "", "", "", "")
 	if err != nil {
@@ -207,7 +386,7 @@ func TestStorage_UnregisterTrackedID(t *testing.T) {
 		t.Fatalf("Failed to register token: %+v", err)
 	}
 
-	err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
+	_, err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16)
 	if err != nil {
 		t.Fatalf("Received error registering identity: %+v", err)
 	}
@@ -217,7 +396,7 @@ func TestStorage_UnregisterTrackedID(t *testing.T) {
 		t.Fatalf("Error on unregister untracked ID: %+v", err)
 	}
 
-	err = s.RegisterTrackedID([][]byte{iid2}, pub, epoch, 16)
+	_, err = s.RegisterTrackedID([][]byte{iid2}, pub, epoch, 16)
 	if err != nil {
 		t.Fatalf("Received error registering identity: %+v", err)
 	}
@@ -310,8 +489,278 @@ func TestStorage_AddLatestEphemeral(t *testing.T) {
 }
 
 func TestStorage_AddEphemeralsForOffset(t *testing.T) {
-	_, err := NewStorage("", "", "", "", "")
+	s, err := NewStorage("", "", "TestStorage_AddEphemeralsForOffset", "", "")
 	if err != nil {
-		t.Errorf("Failed to create new storage object: %+v", err)
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	db := s.Database.(*DatabaseImpl).db
+
+	// Enough identities to span several insert batches
+	const offset = 7
+	numIdentities := 2*ephemeralInsertBatchSize + 10
+	insertTestIdentities(t, s, numIdentities, offset)
+	insertTestIdentities(t, s, 5, 0)
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		err = s.AddEphemeralsForOffset(offset, 11, now, 16)
+		if err != nil {
+			t.Fatalf("Failed to add ephemerals for offset: %+v", err)
+		}
+		var count int64
+		err = db.Model(&Ephemeral{}).Where("epoch = ?", 11).Count(&count).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(numIdentities) {
+			t.Fatalf("Expected %d ephemerals after run %d, found %d", numIdentities, i+1, count)
+		}
+	}
+
+	// Offset zero must only match identities with an offset of zero
+	err = s.AddEphemeralsForOffset(0, 12, now, 16)
+	if err != nil {
+		t.Fatalf("Failed to add ephemerals for offset 0: %+v", err)
+	}
+	var count int64
+	err = db.Model(&Ephemeral{}).Where("epoch = ?", 12).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("Expected 5 ephemerals for offset 0, found %d", count)
+	}
+}
+
+// Tests that an identity whose ephemeral cannot be stored does not stop the
+// ephemerals of the other identities being stored.
+func TestStorage_AddEphemeralsForOffset_Failure(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_AddEphemeralsForOffset_Failure", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	db := s.Database.(*DatabaseImpl).db
+
+	identities := insertTestIdentities(t, s, 50, 3)
+	err = db.Exec(fmt.Sprintf("CREATE TRIGGER fail_ephemeral BEFORE INSERT ON ephemerals "+
+		"WHEN NEW.intermediary_id = X'%x' BEGIN SELECT RAISE(ABORT, 'rejected'); END",
+		identities[20].IntermediaryId)).Error
+	if err != nil {
+		t.Fatalf("Failed to create trigger: %+v", err)
+	}
+
+	err = s.AddEphemeralsForOffset(3, 4, time.Now(), 16)
+	if err == nil {
+		t.Fatalf("Expected an error for the rejected identity")
+	}
+	var count int64
+	err = db.Model(&Ephemeral{}).Where("epoch = ?", 4).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 49 {
+		t.Errorf("Expected ephemerals for the 49 other identities, found %d", count)
+	}
+
+	// An invalid size fails every identity without storing anything
+	err = s.AddEphemeralsForOffset(3, 5, time.Now(), 65)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid address space size")
+	}
+}
+
+// insertTestIdentities stores num random identities with the passed in offset.
+func insertTestIdentities(t testing.TB, s *Storage, num int, offset int64) []Identity {
+	identities := make([]Identity, num)
+	for i := range identities {
+		uid, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iid, err := ephemeral.GetIntermediaryId(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[i] = Identity{IntermediaryId: iid, OffsetNum: offset}
+	}
+	err := s.Database.(*DatabaseImpl).db.CreateInBatches(identities, bulkInsertBatchSize).Error
+	if err != nil {
+		t.Fatalf("Failed to insert identities: %+v", err)
+	}
+	return identities
+}
+
+// benchmarkIdentities is the number of identities with the offset generated
+// in the AddEphemeralsForOffset benchmarks.
+const benchmarkIdentities = 5000
+
+func BenchmarkStorage_AddEphemeralsForOffset(b *testing.B) {
+	s, err := NewStorage("", "", "BenchmarkStorage_AddEphemeralsForOffset", "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	insertTestIdentities(b, s, benchmarkIdentities, 1)
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = s.AddEphemeralsForOffset(1, int32(i), now, 16)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmarks the previous approach of computing and inserting one ephemeral
+// at a time, for comparison.
+func BenchmarkStorage_AddEphemeralsForOffset_PerRow(b *testing.B) {
+	s, err := NewStorage("", "", "BenchmarkStorage_AddEphemeralsForOffset_PerRow", "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	insertTestIdentities(b, s, benchmarkIdentities, 1)
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		identities, err := s.getIdentitiesByOffset(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, identity := range identities {
+			eid, _, _, err := ephemeral.GetIdFromIntermediary(identity.IntermediaryId, 16, now.UnixNano())
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = s.insertEphemeral(&Ephemeral{
+				IntermediaryId: identity.IntermediaryId,
+				EphemeralId:    eid.Int64(),
+				Epoch:          int32(i),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestStorage_RecordRequestSignature(t *testing.T) {
+	s, err := NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	expiry := time.Now().Add(5 * time.Second)
+	err = s.RecordRequestSignature([]byte("signature"), expiry)
+	if err != nil {
+		t.Fatalf("Failed to record request signature: %+v", err)
+	}
+
+	err = s.RecordRequestSignature([]byte("signature"), expiry)
+	if !errors.Is(err, ErrReplayedRequest) {
+		t.Fatalf("Expected replay error on duplicate signature, instead got %+v", err)
+	}
+
+	err = s.RecordRequestSignature([]byte("signature2"), expiry)
+	if err != nil {
+		t.Fatalf("Failed to record second request signature: %+v", err)
+	}
+}
+
+func TestStorage_BackfillEphemerals(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_BackfillEphemerals", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	err = s.insertIdentity(&Identity{
+		IntermediaryId: iid,
+		OffsetNum:      ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert identity: %+v", err)
+	}
+
+	from := time.Now()
+	to := from.Add(time.Minute)
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, from.UnixNano())
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral ID: %+v", err)
+	}
+
+	// Each offset is generated with the sizes in effect when it starts
+	var generatedAt []time.Time
+	sizes := func(t time.Time) []uint8 {
+		generatedAt = append(generatedAt, t)
+		return []uint8{16}
+	}
+
+	// Backfilling the same range twice must not duplicate ephemerals
+	for i := 0; i < 2; i++ {
+		count, err := s.BackfillEphemerals(from, to, sizes)
+		if err != nil {
+			t.Fatalf("Failed to backfill ephemerals: %+v", err)
+		}
+		if count == 0 {
+			t.Fatalf("Backfill generated no offsets")
+		}
+		eList, err := s.GetEphemeral(eid.Int64())
+		if err != nil {
+			t.Fatalf("Failed to get backfilled ephemeral: %+v", err)
+		}
+		if len(eList) != 1 {
+			t.Fatalf("Expected 1 ephemeral after backfill %d, found %d", i+1, len(eList))
+		}
+		if len(generatedAt) != count || generatedAt[0].Before(from.Add(-time.Duration(ephemeral.Period))) {
+			t.Fatalf("Expected sizes to be looked up at each offset in the range, got %d lookups", len(generatedAt))
+		}
+		generatedAt = generatedAt[:0]
+	}
+
+	_, err = s.BackfillEphemerals(to, from, sizes)
+	if err == nil {
+		t.Errorf("Backfill should fail when the range is reversed")
+	}
+
+	// Ephemerals valid only more than a period ago would be deleted
+	_, err = s.BackfillEphemerals(from.Add(-time.Duration(ephemeral.Period)-time.Minute), to, sizes)
+	if err == nil {
+		t.Errorf("Backfill should fail when starting more than one period ago")
+	}
+}
+
+func TestGetLatestEphemerals(t *testing.T) {
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	now := time.Now()
+	_, epoch := ephemeral.HandleQuantization(now)
+
+	// A look-ahead of two periods covers exactly three ephemeral IDs
+	lookAhead := 2 * time.Duration(ephemeral.Period)
+	eList, err := getLatestEphemerals(iid, epoch, []uint8{16}, now, lookAhead)
+	if err != nil {
+		t.Fatalf("Failed to get latest ephemerals: %+v", err)
+	}
+	if len(eList) != 3 {
+		t.Fatalf("Expected 3 ephemerals over %s, got %d", lookAhead, len(eList))
+	}
+	for i := 0; i < 3; i++ {
+		ts := now.Add(time.Duration(i) * time.Duration(ephemeral.Period))
+		eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, ts.UnixNano())
+		if err != nil {
+			t.Fatalf("Failed to get ephemeral ID: %+v", err)
+		}
+		if eList[i].EphemeralId != eid.Int64() {
+			t.Errorf("Ephemeral %d does not match the ID valid at %s", i, ts)
+		}
+		if i > 0 && eList[i].Epoch <= eList[i-1].Epoch {
+			t.Errorf("Ephemeral %d has epoch %d, not after %d", i, eList[i].Epoch, eList[i-1].Epoch)
+		}
+	}
+	if eList[0].Epoch != epoch {
+		t.Errorf("First ephemeral should have epoch %d, got %d", epoch, eList[0].Epoch)
 	}
 }
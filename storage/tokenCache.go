@@ -0,0 +1,421 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Caches the tokens to notify for each ephemeral ID
+
+package storage
+
+import (
+	"container/list"
+	jww "github.com/spf13/jwalterweatherman"
+	"sync"
+	"time"
+)
+
+// toNotifyRow is a row of the GetToNotify query, along with the identity and
+// epoch of the ephemeral it matched. The tokenCache uses them to find the
+// entries a change to storage affects.
+type toNotifyRow struct {
+	GTNResult
+	IntermediaryId []byte
+	Epoch          int32
+}
+
+// tokenCache is a bounded LRU cache of the GetToNotify rows for each
+// ephemeral ID, so the send path does not query the database for ephemeral
+// IDs it has recently looked up. Ephemeral IDs with no rows are cached too.
+//
+// Entries are invalidated when the users, tokens or identities they hold are
+// changed through Storage, and are read again once the change is stored.
+// Ephemerals added by the creator or on registration are read into the cache
+// as they are stored, so the current and next epochs are cached before they
+// are needed. Rows of deleted ephemerals are dropped by the deleter. Changes
+// made to the database by another process are only seen once an entry is
+// older than the max age.
+type tokenCache struct {
+	mux     sync.Mutex
+	size    int
+	maxAge  time.Duration
+	order   *list.List
+	entries map[int64]*list.Element
+
+	// Ephemeral IDs of the cached entries holding each user, token & identity
+	byUser     map[string]map[int64]struct{}
+	byToken    map[string]map[int64]struct{}
+	byIdentity map[string]map[int64]struct{}
+
+	// generation is incremented on every invalidation, so that rows read
+	// from the database before it are not cached
+	generation uint64
+
+	// Ephemeral IDs to read into the cache on the next refresh
+	stale map[int64]struct{}
+}
+
+// EnableTokenCache caches the tokens to notify for up to size ephemeral IDs
+// in front of GetToNotify, for up to maxAge each. A maxAge of zero keeps
+// entries until they are invalidated or evicted. It must be called before
+// storage is used. A size of zero disables the cache.
+// The cache is only invalidated by changes made through this Storage, so it is
+// not enabled while ephemerals are held in a HotStore shared by several bots.
+func (s *Storage) EnableTokenCache(size int, maxAge time.Duration) {
+	s.tokenCache = newTokenCache(size, maxAge)
+	s.disableSharedTokenCache()
+}
+
+// disableSharedTokenCache disables the token cache if ephemerals are held
+// outside the database, where other bots may change them, as their changes
+// would not be seen until entries reach the max age.
+func (s *Storage) disableSharedTokenCache() {
+	if s.tokenCache == nil || s.ephemeralsInDatabase() {
+		return
+	}
+	jww.WARN.Printf("Token cache disabled: the hot store may be shared by several servers, " +
+		"whose changes would not invalidate it")
+	s.tokenCache = nil
+}
+
+// tokenCacheEntry is the value stored in the tokenCache list.
+type tokenCacheEntry struct {
+	ephemeralId int64
+	rows        []toNotifyRow
+	added       time.Time
+}
+
+// newTokenCache creates a tokenCache which holds up to size ephemeral IDs for
+// up to maxAge each. It returns nil, disabling caching, if size is not
+// positive.
+func newTokenCache(size int, maxAge time.Duration) *tokenCache {
+	if size <= 0 {
+		return nil
+	}
+	tc := &tokenCache{
+		size:   size,
+		maxAge: maxAge,
+		order:  list.New(),
+	}
+	tc.reset()
+	return tc
+}
+
+// reset empties the cache. The lock must be held.
+func (tc *tokenCache) reset() {
+	tc.order.Init()
+	tc.entries = make(map[int64]*list.Element)
+	tc.byUser = make(map[string]map[int64]struct{})
+	tc.byToken = make(map[string]map[int64]struct{})
+	tc.byIdentity = make(map[string]map[int64]struct{})
+	tc.stale = make(map[int64]struct{})
+	tc.generation++
+}
+
+// get returns the cached rows of the passed in ephemeral IDs and the IDs which
+// are not cached, or whose entries are older than the max age. The returned
+// generation must be passed to add with the rows read from the database for
+// the missing IDs.
+func (tc *tokenCache) get(ephemeralIds []int64, now time.Time) ([]toNotifyRow, []int64, uint64) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+
+	var rows []toNotifyRow
+	var misses []int64
+	for _, eid := range ephemeralIds {
+		e, ok := tc.entries[eid]
+		if ok && tc.maxAge > 0 && now.Sub(e.Value.(*tokenCacheEntry).added) > tc.maxAge {
+			tc.remove(e)
+			ok = false
+		}
+		if !ok {
+			misses = append(misses, eid)
+			continue
+		}
+		tc.order.MoveToFront(e)
+		rows = append(rows, e.Value.(*tokenCacheEntry).rows...)
+	}
+	return rows, misses, tc.generation
+}
+
+// add caches the rows read from the database for the passed in ephemeral IDs,
+// evicting the least recently used entries if the cache is full. Nothing is
+// cached if the cache was invalidated since the generation was returned by
+// get, as the rows may already be out of date.
+func (tc *tokenCache) add(generation uint64, ephemeralIds []int64, rows []toNotifyRow, now time.Time) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+
+	if generation != tc.generation {
+		return
+	}
+
+	byEphemeral := make(map[int64][]toNotifyRow, len(ephemeralIds))
+	for _, r := range rows {
+		byEphemeral[r.EphemeralId] = append(byEphemeral[r.EphemeralId], r)
+	}
+	for _, eid := range ephemeralIds {
+		if e, ok := tc.entries[eid]; ok {
+			tc.remove(e)
+		}
+		entry := &tokenCacheEntry{ephemeralId: eid, rows: byEphemeral[eid], added: now}
+		tc.entries[eid] = tc.order.PushFront(entry)
+		for _, r := range entry.rows {
+			addToIndex(tc.byUser, string(r.TransmissionRSAHash), eid)
+			addToIndex(tc.byToken, r.Token, eid)
+			addToIndex(tc.byIdentity, string(r.IntermediaryId), eid)
+		}
+	}
+	for tc.order.Len() > tc.size {
+		tc.remove(tc.order.Back())
+	}
+}
+
+// remove deletes an entry and its index references. The lock must be held.
+func (tc *tokenCache) remove(e *list.Element) {
+	entry := tc.order.Remove(e).(*tokenCacheEntry)
+	delete(tc.entries, entry.ephemeralId)
+	for _, r := range entry.rows {
+		removeFromIndex(tc.byUser, string(r.TransmissionRSAHash), entry.ephemeralId)
+		removeFromIndex(tc.byToken, r.Token, entry.ephemeralId)
+		removeFromIndex(tc.byIdentity, string(r.IntermediaryId), entry.ephemeralId)
+	}
+}
+
+// invalidateEphemerals removes the entries of the passed in ephemeral IDs and
+// marks them all to be read on the next refresh, cached or not.
+func (tc *tokenCache) invalidateEphemerals(ephemeralIds ...int64) {
+	if tc == nil {
+		return
+	}
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.generation++
+	for _, eid := range ephemeralIds {
+		if e, ok := tc.entries[eid]; ok {
+			tc.remove(e)
+		}
+		tc.markStale(eid)
+	}
+}
+
+// invalidateUser removes every entry holding the user with the passed in
+// transmission RSA hash.
+func (tc *tokenCache) invalidateUser(transmissionRSAHash []byte) {
+	if tc == nil {
+		return
+	}
+	tc.invalidateIndexed(tc.byUser, string(transmissionRSAHash))
+}
+
+// invalidateTokens removes every entry holding one of the passed in tokens,
+// as stored in the database.
+func (tc *tokenCache) invalidateTokens(tokens ...string) {
+	if tc == nil {
+		return
+	}
+	for _, t := range tokens {
+		tc.invalidateIndexed(tc.byToken, t)
+	}
+}
+
+// invalidateIdentities removes every entry holding one of the passed in
+// intermediary IDs.
+func (tc *tokenCache) invalidateIdentities(iids ...[]byte) {
+	if tc == nil {
+		return
+	}
+	for _, iid := range iids {
+		tc.invalidateIndexed(tc.byIdentity, string(iid))
+	}
+}
+
+// invalidateIndexed removes every entry listed under the key in the passed in
+// index and marks them to be read on the next refresh.
+func (tc *tokenCache) invalidateIndexed(idx map[string]map[int64]struct{}, key string) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.generation++
+	for eid := range idx[key] {
+		if e, ok := tc.entries[eid]; ok {
+			tc.remove(e)
+			tc.markStale(eid)
+		}
+	}
+}
+
+// markStale marks an ephemeral ID to be read on the next refresh. IDs past
+// the size of the cache are left to be read on lookup. The lock must be held.
+func (tc *tokenCache) markStale(eid int64) {
+	if len(tc.stale) < tc.size {
+		tc.stale[eid] = struct{}{}
+	}
+}
+
+// takeStale returns and clears the ephemeral IDs marked to be read, along
+// with the generation to pass to add with their rows.
+func (tc *tokenCache) takeStale() ([]int64, uint64) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	ephemeralIds := make([]int64, 0, len(tc.stale))
+	for eid := range tc.stale {
+		ephemeralIds = append(ephemeralIds, eid)
+	}
+	tc.stale = make(map[int64]struct{})
+	return ephemeralIds, tc.generation
+}
+
+// expire drops the rows of ephemerals with an epoch before the passed in
+// epoch, matching the deletion of those ephemerals from the database. The
+// remaining rows of each entry are kept.
+func (tc *tokenCache) expire(epoch int32) {
+	if tc == nil {
+		return
+	}
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.generation++
+	for eid, e := range tc.entries {
+		entry := e.Value.(*tokenCacheEntry)
+		kept := entry.rows[:0:0]
+		for _, r := range entry.rows {
+			if r.Epoch >= epoch {
+				kept = append(kept, r)
+				continue
+			}
+			removeFromIndex(tc.byUser, string(r.TransmissionRSAHash), eid)
+			removeFromIndex(tc.byToken, r.Token, eid)
+			removeFromIndex(tc.byIdentity, string(r.IntermediaryId), eid)
+		}
+		if len(kept) < len(entry.rows) {
+			entry.rows = kept
+			// Rows left for the ephemeral ID must stay indexed
+			for _, r := range kept {
+				addToIndex(tc.byUser, string(r.TransmissionRSAHash), eid)
+				addToIndex(tc.byToken, r.Token, eid)
+				addToIndex(tc.byIdentity, string(r.IntermediaryId), eid)
+			}
+		}
+	}
+}
+
+// clear empties the cache.
+func (tc *tokenCache) clear() {
+	if tc == nil {
+		return
+	}
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.reset()
+}
+
+// getToNotifyCached returns the GetToNotify results for the passed in
+// ephemeral IDs from the token cache, reading those which are not cached from
+// the database and caching them.
+func (s *Storage) getToNotifyCached(ephemeralIds []int64) ([]GTNResult, error) {
+	now := time.Now()
+	rows, misses, generation := s.tokenCache.get(ephemeralIds, now)
+	if len(misses) > 0 {
+		missed, err := s.toNotifyRows(misses)
+		if err != nil {
+			return nil, err
+		}
+		s.tokenCache.add(generation, misses, missed, now)
+		rows = append(rows, missed...)
+	}
+	return distinctResults(rows), nil
+}
+
+// refreshTokenCache reads the rows of the ephemeral IDs invalidated since the
+// last refresh into the token cache. It is deferred by each change to
+// storage, so that it runs once the change is stored and its entries are
+// invalidated. If the rows cannot be read, they are read on lookup instead.
+func (s *Storage) refreshTokenCache() {
+	if s.tokenCache == nil {
+		return
+	}
+	ephemeralIds, generation := s.tokenCache.takeStale()
+	if len(ephemeralIds) == 0 {
+		return
+	}
+	now := time.Now()
+	rows, err := s.toNotifyRows(ephemeralIds)
+	if err != nil {
+		jww.DEBUG.Printf("Failed to refresh %d token cache entries: %+v", len(ephemeralIds), err)
+		return
+	}
+	s.tokenCache.add(generation, ephemeralIds, rows, now)
+}
+
+// DeleteOldEphemerals deletes all ephemerals from storage with an epoch before
+// the passed in value.
+func (s *Storage) DeleteOldEphemerals(currentEpoch int32) error {
+	defer s.tokenCache.expire(currentEpoch)
+	return s.hot.DeleteOldEphemerals(currentEpoch)
+}
+
+// LegacyUnregister removes the identity with the passed in intermediary ID,
+// its ephemerals and the users registered to it.
+func (s *Storage) LegacyUnregister(iid []byte) error {
+	defer s.refreshTokenCache()
+	defer s.tokenCache.invalidateIdentities(iid)
+	err := s.Database.LegacyUnregister(iid)
+	if err != nil {
+		return err
+	}
+	// Ephemerals left behind have no tokens to notify and expire with their epoch
+	if err = s.deleteHotEphemerals([][]byte{iid}); err != nil {
+		jww.WARN.Printf("Failed to delete ephemerals of unregistered identity: %+v", err)
+	}
+	return nil
+}
+
+// ephemeralIds returns the ephemeral ID of each of the passed in ephemerals.
+func ephemeralIds(eList []*Ephemeral) []int64 {
+	ids := make([]int64, len(eList))
+	for i, e := range eList {
+		ids[i] = e.EphemeralId
+	}
+	return ids
+}
+
+// addToIndex adds an ephemeral ID under the key in the passed in index.
+func addToIndex(idx map[string]map[int64]struct{}, key string, eid int64) {
+	set, ok := idx[key]
+	if !ok {
+		set = make(map[int64]struct{})
+		idx[key] = set
+	}
+	set[eid] = struct{}{}
+}
+
+// removeFromIndex removes an ephemeral ID from under the key in the passed in
+// index.
+func removeFromIndex(idx map[string]map[int64]struct{}, key string, eid int64) {
+	set := idx[key]
+	delete(set, eid)
+	if len(set) == 0 {
+		delete(idx, key)
+	}
+}
+
+// distinctResults returns the GTNResult of each row, without duplicates.
+func distinctResults(rows []toNotifyRow) []GTNResult {
+	type resultKey struct {
+		token, app, encryptedToken, transmissionRSAHash string
+		ephemeralId                                     int64
+	}
+	seen := make(map[resultKey]struct{}, len(rows))
+	results := make([]GTNResult, 0, len(rows))
+	for _, r := range rows {
+		key := resultKey{r.Token, r.App, string(r.EncryptedToken),
+			string(r.TransmissionRSAHash), r.EphemeralId}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		results = append(results, r.GTNResult)
+	}
+	return results
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+	"time"
+)
+
+// testRow returns a toNotifyRow for the passed in values.
+func testRow(eid int64, epoch int32, token, user, iid string) toNotifyRow {
+	return toNotifyRow{
+		GTNResult: GTNResult{
+			Token:               token,
+			TransmissionRSAHash: []byte(user),
+			EphemeralId:         eid,
+		},
+		IntermediaryId: []byte(iid),
+		Epoch:          epoch,
+	}
+}
+
+// Tests that rows added to the tokenCache are returned, including ephemeral
+// IDs with no rows, and that others are reported as misses.
+func TestTokenCache_GetAdd(t *testing.T) {
+	tc := newTokenCache(10, 0)
+	now := time.Now()
+
+	rows, misses, gen := tc.get([]int64{1, 2, 3}, now)
+	if len(rows) != 0 || len(misses) != 3 {
+		t.Fatalf("Expected 3 misses from empty cache, got %d rows and %d misses", len(rows), len(misses))
+	}
+	tc.add(gen, []int64{1, 2}, []toNotifyRow{
+		testRow(1, 5, "tokenA", "userA", "iidA"),
+		testRow(1, 5, "tokenB", "userB", "iidB"),
+	}, now)
+
+	rows, misses, _ = tc.get([]int64{1, 2, 3}, now)
+	if len(rows) != 2 {
+		t.Errorf("Expected 2 cached rows, got %d", len(rows))
+	}
+	if len(misses) != 1 || misses[0] != 3 {
+		t.Errorf("Expected only ephemeral ID 3 to miss, got %v", misses)
+	}
+}
+
+// Tests that rows read before an invalidation are not cached.
+func TestTokenCache_StaleGeneration(t *testing.T) {
+	tc := newTokenCache(10, 0)
+	now := time.Now()
+
+	_, _, gen := tc.get([]int64{1}, now)
+	tc.invalidateEphemerals(1)
+	tc.add(gen, []int64{1}, []toNotifyRow{testRow(1, 5, "token", "user", "iid")}, now)
+
+	_, misses, _ := tc.get([]int64{1}, now)
+	if len(misses) != 1 {
+		t.Errorf("Rows read before an invalidation should not be cached")
+	}
+}
+
+// Tests each way entries are removed from the tokenCache.
+func TestTokenCache_Invalidate(t *testing.T) {
+	tc := newTokenCache(10, 0)
+	now := time.Now()
+	fill := func() {
+		_, _, gen := tc.get(nil, now)
+		tc.add(gen, []int64{1, 2, 3, 4}, []toNotifyRow{
+			testRow(1, 5, "tokenA", "userA", "iidA"),
+			testRow(2, 6, "tokenB", "userB", "iidB"),
+			testRow(3, 7, "tokenC", "userC", "iidC"),
+		}, now)
+	}
+	check := func(name string, expectedMisses ...int64) {
+		_, misses, _ := tc.get([]int64{1, 2, 3, 4}, now)
+		if len(misses) != len(expectedMisses) {
+			t.Errorf("%s: expected misses %v, got %v", name, expectedMisses, misses)
+			return
+		}
+		for i := range misses {
+			if misses[i] != expectedMisses[i] {
+				t.Errorf("%s: expected misses %v, got %v", name, expectedMisses, misses)
+				return
+			}
+		}
+	}
+
+	fill()
+	tc.invalidateEphemerals(4)
+	check("invalidateEphemerals", 4)
+
+	fill()
+	tc.invalidateUser([]byte("userA"))
+	check("invalidateUser", 1)
+
+	fill()
+	tc.invalidateTokens("tokenB")
+	check("invalidateTokens", 2)
+
+	fill()
+	tc.invalidateIdentities([]byte("iidC"))
+	check("invalidateIdentities", 3)
+
+	fill()
+	tc.expire(7)
+	check("expire")
+	rows, _, _ := tc.get([]int64{1, 2, 3, 4}, now)
+	if len(rows) != 1 || rows[0].EphemeralId != 3 {
+		t.Errorf("expire: expected only the row of ephemeral ID 3 to be kept, got %+v", rows)
+	}
+	if _, ok := tc.byUser["userA"]; ok {
+		t.Errorf("expire: expired rows should be removed from the indexes")
+	}
+
+	fill()
+	tc.clear()
+	check("clear", 1, 2, 3, 4)
+
+	if len(tc.byUser) != 0 || len(tc.byToken) != 0 || len(tc.byIdentity) != 0 {
+		t.Errorf("Indexes should be empty after clear")
+	}
+}
+
+// Tests that the least recently used entries are evicted when the cache is
+// full, and that entries older than the max age are not returned.
+func TestTokenCache_Limits(t *testing.T) {
+	tc := newTokenCache(2, time.Minute)
+	now := time.Now()
+
+	_, _, gen := tc.get(nil, now)
+	tc.add(gen, []int64{1, 2}, []toNotifyRow{testRow(1, 5, "tokenA", "userA", "iidA")}, now)
+	tc.get([]int64{1}, now)
+	_, _, gen = tc.get(nil, now)
+	tc.add(gen, []int64{3}, nil, now)
+
+	_, misses, _ := tc.get([]int64{1, 2, 3}, now)
+	if len(misses) != 1 || misses[0] != 2 {
+		t.Errorf("Expected least recently used ephemeral ID 2 to be evicted, got misses %v", misses)
+	}
+
+	_, misses, _ = tc.get([]int64{1, 3}, now.Add(2*time.Minute))
+	if len(misses) != 2 {
+		t.Errorf("Expected entries past the max age to miss, got misses %v", misses)
+	}
+	if len(tc.byUser) != 0 {
+		t.Errorf("Expired entries should be removed from the indexes")
+	}
+}
+
+// Tests that GetToNotify serves cached tokens, and that registering a token
+// through Storage updates them.
+func TestStorage_GetToNotify_TokenCache(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_GetToNotify_TokenCache", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	s.EnableTokenCache(100, time.Hour)
+
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	trsa := []byte("transmissionrsa")
+	_, err = s.RegisterForNotifications(iid, trsa, "token", constants.MessengerIOS.String(), 5, 16)
+	if err != nil {
+		t.Fatalf("Failed to register for notifications: %+v", err)
+	}
+	e, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+
+	results, err := s.GetToNotify([]int64{e.EphemeralId})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != 1 || results[0].Token != "token" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+
+	// Removing the token behind the cache's back is not seen
+	err = s.Database.DeleteToken("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = s.GetToNotify([]int64{e.EphemeralId})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected cached result, got %+v", results)
+	}
+
+	// Registering a token through Storage is seen at once
+	err = s.RegisterToken("token2", constants.MessengerIOS.String(), trsa)
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	results, err = s.GetToNotify([]int64{e.EphemeralId})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(results) != 1 || results[0].Token != "token2" {
+		t.Fatalf("Expected only the newly registered token, got %+v", results)
+	}
+
+	// Deleting the ephemerals drops them from the cache
+	err = s.DeleteOldEphemerals(e.Epoch + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = s.GetToNotify([]int64{e.EphemeralId})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	for _, r := range results {
+		if r.Token != "" {
+			t.Errorf("Expected no tokens after deleting ephemerals, got %+v", results)
+		}
+	}
+}
+
+// Tests that ephemerals added by the creator and changes made through Storage
+// are read into the cache without waiting for a lookup.
+func TestStorage_TokenCache_Refresh(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_TokenCache_Refresh", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	s.EnableTokenCache(100, time.Hour)
+
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	trsa := []byte("transmissionrsa")
+	_, err = s.RegisterForNotifications(iid, trsa, "token", constants.MessengerIOS.String(), 5, 16)
+	if err != nil {
+		t.Fatalf("Failed to register for notifications: %+v", err)
+	}
+	e, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+	cachedTokens := func(eid int64) []string {
+		rows, misses, _ := s.tokenCache.get([]int64{eid}, time.Now())
+		if len(misses) != 0 {
+			t.Fatalf("Ephemeral ID %d should be cached", eid)
+		}
+		var tokens []string
+		for _, r := range rows {
+			tokens = append(tokens, r.Token)
+		}
+		return tokens
+	}
+	if tokens := cachedTokens(e.EphemeralId); len(tokens) != 1 || tokens[0] != "token" {
+		t.Errorf("Registration should cache its ephemeral, got tokens %v", tokens)
+	}
+
+	err = s.RegisterToken("token2", constants.MessengerIOS.String(), trsa)
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if tokens := cachedTokens(e.EphemeralId); len(tokens) != 2 {
+		t.Errorf("Registering a token should refresh the cache, got tokens %v", tokens)
+	}
+
+	// The creator caches the ephemerals of the next period as it adds them
+	next := time.Now().Add(time.Duration(ephemeral.Period))
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, next.UnixNano())
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(next)
+	err = s.AddEphemeralsForOffset(ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)), epoch, next, 16)
+	if err != nil {
+		t.Fatalf("Failed to add ephemerals: %+v", err)
+	}
+	if tokens := cachedTokens(eid.Int64()); len(tokens) != 2 {
+		t.Errorf("Adding ephemerals should cache them, got tokens %v", tokens)
+	}
+}
+
+// Tests that the token cache is disabled while ephemerals are held in a hot
+// store which may be shared by several servers.
+func TestStorage_EnableTokenCache_SharedHotStore(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_EnableTokenCache_SharedHotStore", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	s.EnableTokenCache(100, time.Hour)
+	if s.tokenCache == nil {
+		t.Fatal("Token cache should be enabled with ephemerals in the database")
+	}
+
+	r, _ := newTestRedisHotStore(t)
+	s.SetHotStore(r)
+	if s.tokenCache != nil {
+		t.Error("Token cache should be disabled once ephemerals are held in redis")
+	}
+	s.EnableTokenCache(100, time.Hour)
+	if s.tokenCache != nil {
+		t.Error("Token cache should not be enabled while ephemerals are held in redis")
+	}
+}